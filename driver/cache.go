@@ -0,0 +1,72 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Rewritten packages are cached by go build cache itself. Cache key of
+// compiled package (action ID) is derived from hashes of its sources,
+// compiler flags, keys of its dependencies and the compiler ID obtained
+// by running the compiler with -V=full through toolexec. Driver extends
+// compiler ID with fingerprint of command file, which holds rewriter
+// config and identity of instrgen binary, so instrumented packages never
+// mix with regular ones and only packages whose sources, dependencies,
+// config or Go version changed are rewritten again.
+
+// isVersionQuery tells whether go command asks tool for its ID.
+func isVersionQuery(args []string) bool {
+	return len(args) == 2 && args[1] == "-V=full"
+}
+
+// cmdFingerprint returns hash of command file content.
+func cmdFingerprint(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:8])
+}
+
+// amendToolID adds fingerprint to tool version line. Go command uses
+// the whole line of release toolchains and content part of build ID
+// (the last field) of development ones, so fingerprint is appended
+// to build ID when present.
+func amendToolID(line string, fingerprint string) string {
+	line = strings.TrimSpace(line)
+	if fields := strings.Fields(line); len(fields) > 0 && strings.HasPrefix(fields[len(fields)-1], "buildID=") {
+		return line + "-instrgen" + fingerprint
+	}
+	return line + " instrgen=" + fingerprint
+}
+
+// printToolID runs tool version query and prints its output
+// extended with fingerprint of instrgen command.
+func printToolID(w io.Writer, args []string, content []byte) error {
+	var stdout bytes.Buffer
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(w, amendToolID(stdout.String(), cmdFingerprint(content)))
+	return err
+}
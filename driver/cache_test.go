@@ -0,0 +1,55 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAmendToolID(t *testing.T) {
+	assert.Equal(t, "compile version go1.21.1 instrgen=abcd",
+		amendToolID("compile version go1.21.1\n", "abcd"))
+	assert.Equal(t, "compile version go1.21.1 X:loopvar instrgen=abcd",
+		amendToolID("compile version go1.21.1 X:loopvar\n", "abcd"))
+	assert.Equal(t, "compile version devel go1.22-123 buildID=action/content-instrgenabcd",
+		amendToolID("compile version devel go1.22-123 buildID=action/content\n", "abcd"))
+}
+
+func TestCmdFingerprint(t *testing.T) {
+	a := cmdFingerprint([]byte(`{"Cmd": "inject"}`))
+	assert.Len(t, a, 16)
+	assert.Equal(t, a, cmdFingerprint([]byte(`{"Cmd": "inject"}`)))
+	assert.NotEqual(t, a, cmdFingerprint([]byte(`{"Cmd": "prune"}`)))
+}
+
+func TestPrintToolID(t *testing.T) {
+	assert.True(t, isVersionQuery([]string{"/usr/local/go/pkg/tool/compile", "-V=full"}))
+	assert.False(t, isVersionQuery([]string{"/usr/local/go/pkg/tool/compile", "-p", "main"}))
+
+	tool := filepath.Join(t.TempDir(), "compile")
+	require.NoError(t, os.WriteFile(tool, []byte("#!/bin/sh\necho compile version go1.21.1\n"), 0755))
+	content := []byte(`{"Cmd": "inject"}`)
+	var out bytes.Buffer
+	require.NoError(t, printToolID(&out, []string{tool, "-V=full"}, content))
+	assert.Equal(t, "compile version go1.21.1 instrgen="+cmdFingerprint(content)+"\n", out.String())
+}
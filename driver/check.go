@@ -0,0 +1,179 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+)
+
+// Problems of committed instrumentation found by check.
+const (
+	// problemMissing function should be instrumented but is not.
+	problemMissing = "missing"
+	// problemStale function is instrumented differently than inject would do now.
+	problemStale = "stale"
+	// problemExtraneous function is instrumented but should not be.
+	problemExtraneous = "extraneous"
+)
+
+// instrumentationIssue describes function whose instrumentation
+// is not up to date.
+type instrumentationIssue struct {
+	pos      token.Position
+	function string
+	problem  string
+}
+
+func (issue instrumentationIssue) String() string {
+	return fmt.Sprintf("%s: %s: instrumentation %s", issue.pos, issue.function, issue.problem)
+}
+
+// funcDecls returns printed function declarations of file keyed like
+// declSnapshot keys them, along with their positions.
+func funcDecls(fset *token.FileSet, file *ast.File) (map[string]string, map[string]token.Position) {
+	printed := make(map[string]string)
+	positions := make(map[string]token.Position)
+	for _, decl := range file.Decls {
+		funcDecl, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		key := funcName(funcDecl)
+		for n := 2; printed[key] != ""; n++ {
+			key = funcName(funcDecl) + "#" + strconv.Itoa(n)
+		}
+		var out bytes.Buffer
+		printer.Fprint(&out, fset, funcDecl)
+		printed[key] = out.String()
+		positions[key] = fset.Position(funcDecl.Pos())
+	}
+	return printed, positions
+}
+
+// isInstrumented tells whether printed declaration holds code added by inject.
+func isInstrumented(decl string) bool {
+	return strings.Contains(decl, "__atel_")
+}
+
+// compareInstrumentation compares functions of committed source with
+// source inject produces now and returns issues sorted by position.
+func compareInstrumentation(filePath string, src []byte, expected []byte) ([]instrumentationIssue, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filePath, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	// both sources are printed from parsed files, layout differences
+	// of rewritten code do not count
+	expectedFset := token.NewFileSet()
+	expectedFile, err := parser.ParseFile(expectedFset, filePath, expected, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+	actualDecls, positions := funcDecls(fset, file)
+	expectedDecls, _ := funcDecls(expectedFset, expectedFile)
+	var issues []instrumentationIssue
+	for key, actual := range actualDecls {
+		want, ok := expectedDecls[key]
+		if !ok || want == actual {
+			continue
+		}
+		problem := problemStale
+		switch {
+		case !isInstrumented(actual) && isInstrumented(want):
+			problem = problemMissing
+		case isInstrumented(actual) && !isInstrumented(want):
+			problem = problemExtraneous
+		}
+		name, _, _ := strings.Cut(key, "#")
+		issues = append(issues, instrumentationIssue{pos: positions[key], function: name, problem: problem})
+	}
+	sort.Slice(issues, func(i, j int) bool {
+		return issues[i].pos.Offset < issues[j].pos.Offset
+	})
+	return issues, nil
+}
+
+// pruneSources returns project sources with instrumentation removed,
+// keyed by absolute path. Files prune leaves unchanged are omitted.
+func pruneSources(root string, pkgs []*packages.Package, pruners []alib.PackageRewriter) (map[string][]byte, error) {
+	changes, err := collectChanges(root, pkgs, pruners)
+	if err != nil {
+		return nil, err
+	}
+	pruned := make(map[string][]byte)
+	for _, change := range changes {
+		pruned[filepath.Join(root, filepath.FromSlash(change.path))] = change.new
+	}
+	return pruned, nil
+}
+
+// checkInstrumentation runs inject rewriters over pruned project sources
+// and compares the result with committed ones. Packages are expected to be
+// loaded with pruned sources, positions of log calls found by semantic
+// analysis refer to them.
+func checkInstrumentation(root string, pkgs []*packages.Package, pruned map[string][]byte, injectors []alib.PackageRewriter) ([]instrumentationIssue, error) {
+	var issues []instrumentationIssue
+	for _, pkg := range pkgs {
+		for _, filePath := range pkg.GoFiles {
+			rel, err := filepath.Rel(root, filePath)
+			if err != nil || !filepath.IsLocal(rel) {
+				continue
+			}
+			src, err := os.ReadFile(filePath)
+			if err != nil {
+				return nil, err
+			}
+			base, ok := pruned[filePath]
+			if !ok {
+				base = src
+			}
+			expected, err := rewriteSource(injectors, pkg.PkgPath, filePath, base)
+			if err != nil {
+				return nil, err
+			}
+			fileIssues, err := compareInstrumentation(rel, src, expected)
+			if err != nil {
+				return nil, err
+			}
+			issues = append(issues, fileIssues...)
+		}
+	}
+	sort.SliceStable(issues, func(i, j int) bool {
+		return issues[i].pos.Filename < issues[j].pos.Filename
+	})
+	return issues, nil
+}
+
+func writeIssues(w io.Writer, issues []instrumentationIssue) {
+	for _, issue := range issues {
+		fmt.Fprintln(w, issue)
+	}
+}
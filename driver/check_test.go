@@ -0,0 +1,95 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// injectInPlace writes sources rewritten by inject into the project,
+// like inject --replace does.
+func injectInPlace(t *testing.T, dir string) {
+	t.Helper()
+	pkgs, err := LoadProgram(dir, nil)
+	require.NoError(t, err)
+	cfg := defaultConfig()
+	cfg.Replace = true
+	require.NoError(t, sema(cfg.filter(dir, logCtxRewriterName), "yes", pkgs))
+	rewriterS := makeRewriters(InstrgenCmd{ProjectPath: dir, Cmd: "inject", Config: cfg}, make(map[string]string))
+	changes, err := collectChanges(dir, pkgs, rewriterS)
+	require.NoError(t, err)
+	for _, change := range changes {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, change.path), change.new, 0644))
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir := writeModule(t)
+	chdir(t, dir)
+	src := "package main\n\nfunc helper() {\n}\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "helper.go"), []byte(src), 0644))
+	executor := &NullExecutor{}
+
+	err := driverMain([]string{"check"}, executor)
+	var exitErr *exitError
+	require.True(t, errors.As(err, &exitErr), err)
+	assert.Equal(t, exitChanges, exitErr.code)
+	assert.EqualError(t, err, "check: 2 functions have outdated instrumentation")
+
+	injectInPlace(t, dir)
+	require.NoError(t, driverMain([]string{"check"}, executor))
+
+	// new function without span, entry point changed
+	content, err := os.ReadFile(filepath.Join(dir, "helper.go"))
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "helper.go"), append(content, "\nfunc added() {\n}\n"...), 0644))
+	pkgs, err := LoadProgram(dir, nil)
+	require.NoError(t, err)
+	cfg := defaultConfig()
+	cfg.Replace = true
+	cfg.EntryPoints = []string{"main.other"}
+	pruners := makeRewriters(InstrgenCmd{ProjectPath: dir, Cmd: "prune", Config: Config{Replace: true}}, make(map[string]string))
+	pruned, err := pruneSources(dir, pkgs, pruners)
+	require.NoError(t, err)
+	pkgs, err = loadProgram(dir, nil, pruned)
+	require.NoError(t, err)
+	injectors := makeRewriters(InstrgenCmd{ProjectPath: dir, Cmd: "inject", Config: cfg}, make(map[string]string))
+	issues, err := checkInstrumentation(dir, pkgs, pruned, injectors)
+	require.NoError(t, err)
+	var found []string
+	for _, issue := range issues {
+		found = append(found, issue.String())
+	}
+	// instrumentation of helper does not depend on entry points
+	assert.Equal(t, []string{
+		"helper.go:29:1: added: instrumentation missing",
+		"main.go:13:1: main: instrumentation stale",
+	}, found)
+
+	// instrumentation of excluded file is extraneous
+	require.NoError(t, os.WriteFile("instrgen.yaml", []byte("version: 1\nexclude: [\"helper.go\"]\n"), 0644))
+	err = driverMain([]string{"check"}, executor)
+	require.True(t, errors.As(err, &exitErr), err)
+	assert.EqualError(t, err, "check: 1 functions have outdated instrumentation")
+	assert.Empty(t, executor.commands, "check must not build the project")
+}
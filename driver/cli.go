@@ -0,0 +1,860 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+)
+
+const programName = "instrgen"
+
+// Exit codes of instrgen commands.
+const (
+	exitFailure = 1
+	// exitChanges reports that diff found files to be changed
+	// or check found outdated instrumentation.
+	exitChanges = 2
+	// exitRewriteFailed reports rewriter failure in strict mode.
+	exitRewriteFailed = 3
+)
+
+// exitError is an error that sets exit code of the process.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// command describes single instrgen subcommand.
+type command struct {
+	name  string
+	short string
+	long  string
+	// args describes positional arguments in usage line.
+	args string
+	// setFlags registers command specific flags.
+	setFlags func(fs *flag.FlagSet, opts *options)
+	run      func(opts *options, args []string, executor CommandExecutor) error
+}
+
+// options holds values of command line flags shared by subcommands.
+type options struct {
+	dir       string
+	config    string
+	pattern   string
+	replace   bool
+	strict    bool
+	entries   stringList
+	tags      stringList
+	rewriters stringList
+	// prune and patchDir are used by diff only.
+	prune    bool
+	patchDir string
+	// outDir is used by export only.
+	outDir string
+	// json is used by report only.
+	json bool
+	// verbose, quiet and logFormat select driver log output.
+	verbose   bool
+	quiet     bool
+	logFormat string
+	// set holds names of flags given on command line.
+	set map[string]bool
+}
+
+func dirFlag(fs *flag.FlagSet, opts *options) {
+	fs.StringVar(&opts.dir, "C", "", "change to `dir` before running the command")
+}
+
+// logFlags are registered for every command.
+func logFlags(fs *flag.FlagSet, opts *options) {
+	fs.BoolVar(&opts.verbose, "v", false, "print debug messages, like toolexec invocations and per package timing")
+	fs.BoolVar(&opts.quiet, "q", false, "print warnings and errors only")
+	fs.StringVar(&opts.logFormat, "log-format", logFormatText, "log `format`, text or json")
+}
+
+// logSettings returns log settings selected by flags, settings
+// passed by environment are kept for flags not given.
+func (opts *options) logSettings() (logSettings, error) {
+	settings := envLogSettings()
+	switch {
+	case opts.verbose && opts.quiet:
+		return settings, errors.New("flags -v and -q are mutually exclusive")
+	case opts.verbose:
+		settings.level = slog.LevelDebug
+	case opts.quiet:
+		settings.level = slog.LevelWarn
+	}
+	if opts.set["log-format"] {
+		if opts.logFormat != logFormatText && opts.logFormat != logFormatJSON {
+			return settings, fmt.Errorf("invalid value %q for flag -log-format: must be text or json", opts.logFormat)
+		}
+		settings.format = opts.logFormat
+	}
+	return settings, nil
+}
+
+func configFlags(fs *flag.FlagSet, opts *options) {
+	dirFlag(fs, opts)
+	fs.StringVar(&opts.config, "config", "", "read project config from `file` instead of instrgen.yaml or instrgen.json")
+	fs.StringVar(&opts.pattern, "pattern", "", "rewrite only files whose path contains `pattern`")
+	fs.BoolVar(&opts.strict, "strict", false, "fail the build when rewriting of any file fails")
+	fs.Var(&opts.tags, "tags", "comma separated list of build `tags` to consider satisfied, like go build -tags")
+}
+
+func injectFlags(fs *flag.FlagSet, opts *options) {
+	configFlags(fs, opts)
+	fs.BoolVar(&opts.replace, "replace", false, "replace input sources instead of rewriting temporary copies")
+	rewriterFlags(fs, opts)
+}
+
+// rewriterFlags select rewriters of inject.
+func rewriterFlags(fs *flag.FlagSet, opts *options) {
+	fs.Var(&opts.rewriters, "rewriters", "comma separated `list` of rewriters applied in the given order, built-in ones are\nruntime, logctx and basic, plugins are selected by name (default all)")
+	fs.Var(&opts.entries, "entry", "entry point `package.function` that bootstraps the tracer provider, may be repeated\nor comma separated, \"*\" matches any string (default main.main)")
+}
+
+func exportFlags(fs *flag.FlagSet, opts *options) {
+	configFlags(fs, opts)
+	rewriterFlags(fs, opts)
+	fs.StringVar(&opts.outDir, "o", "", "write instrumented sources into `dir`, required")
+}
+
+func pruneFlags(fs *flag.FlagSet, opts *options) {
+	configFlags(fs, opts)
+}
+
+func reportFlags(fs *flag.FlagSet, opts *options) {
+	dirFlag(fs, opts)
+	fs.BoolVar(&opts.json, "json", false, "print report as JSON")
+}
+
+func diffFlags(fs *flag.FlagSet, opts *options) {
+	injectFlags(fs, opts)
+	fs.BoolVar(&opts.prune, "prune", false, "show changes of prune instead of inject")
+	fs.StringVar(&opts.patchDir, "patch-dir", "", "write one .patch file per changed source into `dir` instead of printing the diff")
+}
+
+func commands() []*command {
+	return []*command{
+		{
+			name:  "inject",
+			short: "injects OpenTelemetry calls into project code",
+			long: `Inject builds the project in the current directory with instrgen
+as the compiler toolchain wrapper and adds OpenTelemetry spans to every
+function of the files selected by the project config and --pattern.
+Entry point functions additionally bootstrap the tracer provider,
+so every binary built gets its own root span.
+
+Project config is read from instrgen.yaml, instrgen.yml or instrgen.json
+in the project directory. Flags override values set in the config.`,
+			setFlags: injectFlags,
+			run:      runInject,
+		},
+		{
+			name:  "prune",
+			short: "prunes OpenTelemetry calls from project code",
+			long: `Prune removes instrumentation previously added by inject from the
+files selected by the project config and --pattern. Sources are always
+rewritten in place.`,
+			setFlags: pruneFlags,
+			run:      runPrune,
+		},
+		{
+			name:  "diff",
+			short: "shows changes inject or prune would make",
+			long: `Diff runs the rewriters of inject (or prune with --prune) over the
+project without touching its sources and prints the resulting changes as
+unified diff. Exit status is 2 when any file would change, so diff can
+gate code review.`,
+			setFlags: diffFlags,
+			run:      runDiff,
+		},
+		{
+			name:  "check",
+			short: "verifies committed instrumentation is up to date",
+			long: `Check verifies instrumentation of projects committing sources
+rewritten in place. Rewriters of prune and inject run over the project in
+memory and every function whose committed instrumentation differs from
+what inject would add now is reported as missing, stale or extraneous.
+Exit status is 2 when any function is reported, so check can run in CI.`,
+			setFlags: injectFlags,
+			run:      runCheck,
+		},
+		{
+			name:  "build",
+			short: "builds instrumented binaries with go build",
+			long: `Build runs go build with instrumentation injected like inject does.
+Arguments following -- are passed to go build unchanged, so packages,
+-o, -race, -ldflags and others work as usual. GOOS and GOARCH are taken
+from the environment, which allows cross compiling instrumented binaries:
+
+	GOOS=linux GOARCH=arm64 instrgen build -- -o bin/server ./cmd/server`,
+			args:     "[-- go build args]",
+			setFlags: injectFlags,
+			run:      goRunner("build"),
+		},
+		{
+			name:  "test",
+			short: "runs tests of instrumented code with go test",
+			long: `Test runs go test with instrumentation injected like inject does.
+Arguments following -- are passed to go test unchanged.`,
+			args:     "[-- go test args]",
+			setFlags: injectFlags,
+			run:      goRunner("test"),
+		},
+		{
+			name:  "run",
+			short: "runs instrumented program with go run",
+			long: `Run runs go run with instrumentation injected like inject does.
+Arguments following -- are passed to go run unchanged, including
+arguments of the program itself.`,
+			args:     "[-- go run args]",
+			setFlags: injectFlags,
+			run:      goRunner("run"),
+		},
+		{
+			name:  "export",
+			short: "writes instrumented sources for other build systems",
+			long: `Export runs the rewriters of inject over the given packages or Go files
+and writes instrumented sources into the directory given by -o, so build
+systems other than go build, like Bazel with rules_go or Makefiles, can
+compile them. Packages are given as go list patterns, ./... by default.
+
+Project packages keep their layout relative to the project directory and
+are exported complete, files left unchanged are copied. Files generated
+for instrumented packages, like the import file, are written next to the
+rewritten sources. Standard library packages, like runtime patched by the
+runtime rewriter along with its TLS shim, are written under goroot/src.
+overlay.json in the output directory maps original sources to rewritten
+and generated ones in go build -overlay format:
+
+	instrgen export -o /tmp/instrumented ./cmd/server runtime`,
+			args:     "[packages | files]",
+			setFlags: exportFlags,
+			run:      runExport,
+		},
+		{
+			name:  "report",
+			short: "summarizes files rewritten by the last build",
+			long: `Report prints packages, files and functions instrumented, enriched,
+pruned, skipped or failed during the last build of inject, prune, build,
+test or run in the project directory. The same report is stored as JSON
+in .instrgen/report.json. Exit status is 1 when rewriting of any file failed.`,
+			setFlags: reportFlags,
+			run:      runReport,
+		},
+		{
+			name:  "clean",
+			short: "removes intermediate files of instrgen",
+			long: `Clean removes the .instrgen work directory of the project, holding
+config passed to the toolexec wrapper, traces of tool invocations, import
+files added to instrumented packages and the report of the last build.`,
+			setFlags: dirFlag,
+			run:      runClean,
+		},
+		{
+			name:  "version",
+			short: "prints instrgen version",
+			long: `Version prints version of instrgen followed by hash of its binary
+and the binary location. The same identity is checked by the toolexec
+wrapper, so builds mixing different instrgen binaries are rejected.`,
+			run: runVersion,
+		},
+	}
+}
+
+func lookupCommand(name string) *command {
+	for _, cmd := range commands() {
+		if cmd.name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "usage: %s <command> [flags]\n\ncommands:\n", programName)
+	for _, cmd := range commands() {
+		fmt.Fprintf(w, "\t%-8s %s\n", cmd.name, cmd.short)
+	}
+	fmt.Fprintf(w, "\nRun '%s help <command>' for details about a command.\n", programName)
+}
+
+func (cmd *command) flagSet(opts *options) *flag.FlagSet {
+	fs := flag.NewFlagSet(programName+" "+cmd.name, flag.ContinueOnError)
+	if cmd.setFlags != nil {
+		cmd.setFlags(fs, opts)
+	}
+	logFlags(fs, opts)
+	fs.Usage = func() {
+		out := fs.Output()
+		line := programName + " " + cmd.name + " [flags]"
+		if cmd.args != "" {
+			line += " " + cmd.args
+		}
+		fmt.Fprintf(out, "usage: %s\n\n%s\n\nflags:\n", line, cmd.long)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// runCommand parses command line of a subcommand and runs it.
+func runCommand(args []string, executor CommandExecutor) error {
+	if len(args) == 0 {
+		usage(os.Stderr)
+		return errors.New("missing command")
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		return runHelp(args[1:])
+	}
+	cmd := lookupCommand(args[0])
+	if cmd == nil {
+		usage(os.Stderr)
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+	opts := &options{set: make(map[string]bool)}
+	fs := cmd.flagSet(opts)
+	if err := fs.Parse(args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return fmt.Errorf("%s: %w", cmd.name, err)
+	}
+	fs.Visit(func(f *flag.Flag) {
+		opts.set[f.Name] = true
+	})
+	if opts.set["v"] || opts.set["q"] || opts.set["log-format"] {
+		settings, err := opts.logSettings()
+		if err != nil {
+			return fmt.Errorf("%s: %w", cmd.name, err)
+		}
+		setupLogger(settings)
+	}
+	if opts.dir != "" {
+		isDir, err := isDirectory(opts.dir)
+		if err != nil || !isDir {
+			return fmt.Errorf("%s: invalid value %q for flag -C: not a directory", cmd.name, opts.dir)
+		}
+		if err := os.Chdir(opts.dir); err != nil {
+			return err
+		}
+	}
+	return cmd.run(opts, fs.Args(), executor)
+}
+
+func runHelp(args []string) error {
+	if len(args) == 0 {
+		usage(os.Stdout)
+		return nil
+	}
+	cmd := lookupCommand(args[0])
+	if cmd == nil {
+		return fmt.Errorf("help: unknown command %q", args[0])
+	}
+	fs := cmd.flagSet(&options{})
+	fs.SetOutput(os.Stdout)
+	fs.Usage()
+	return nil
+}
+
+// stringList is a flag value collecting repeated or comma separated values.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// parseEntryPoint splits entry point given in package.function form.
+// Package path itself may contain dots, so the last one is the separator.
+func parseEntryPoint(entry string) (alib.EntryPoint, error) {
+	i := strings.LastIndex(entry, ".")
+	if i <= 0 || i == len(entry)-1 {
+		return alib.EntryPoint{}, fmt.Errorf("invalid entry point %q: want package.function", entry)
+	}
+	return alib.EntryPoint{Pkg: entry[:i], FunName: entry[i+1:]}, nil
+}
+
+// parseEntryPoints parses list of entry points.
+func parseEntryPoints(entries []string) ([]alib.EntryPoint, error) {
+	var entryPoints []alib.EntryPoint
+	for _, entry := range entries {
+		entryPoint, err := parseEntryPoint(entry)
+		if err != nil {
+			return nil, err
+		}
+		entryPoints = append(entryPoints, entryPoint)
+	}
+	return entryPoints, nil
+}
+
+func checkNoArgs(name string, args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("%s: unexpected argument %q", name, args[0])
+	}
+	return nil
+}
+
+// projectConfig loads project config and applies flags overriding it.
+func (opts *options) projectConfig() (Config, error) {
+	configPath := opts.config
+	if configPath == "" {
+		var err error
+		configPath, err = findConfig(".")
+		if err != nil {
+			return Config{}, err
+		}
+	}
+	cfg, err := loadConfig(configPath)
+	if err != nil {
+		return cfg, err
+	}
+	if opts.set["pattern"] {
+		if opts.pattern == "" {
+			return cfg, errors.New("invalid value \"\" for flag --pattern: must not be empty")
+		}
+		cfg.Include = []string{"**" + strings.Trim(opts.pattern, "/") + "**"}
+	}
+	if opts.set["replace"] {
+		cfg.Replace = opts.replace
+	}
+	if opts.set["strict"] {
+		cfg.Strict = opts.strict
+	}
+	if opts.set["tags"] {
+		cfg.Tags = opts.tags
+	}
+	if opts.set["entry"] {
+		if len(opts.entries) == 0 {
+			return cfg, errors.New("invalid value \"\" for flag --entry: must not be empty")
+		}
+		if _, err := parseEntryPoints(opts.entries); err != nil {
+			return cfg, fmt.Errorf("flag --entry: %w", err)
+		}
+		cfg.EntryPoints = opts.entries
+	}
+	if opts.set["rewriters"] {
+		if len(opts.rewriters) == 0 {
+			return cfg, errors.New("invalid value \"\" for flag --rewriters: must not be empty")
+		}
+		if err := checkRewriterNames("flag --rewriters", opts.rewriters, cfg.rewriterNames()); err != nil {
+			return cfg, err
+		}
+		if err := checkPipeline("flag --rewriters", opts.rewriters); err != nil {
+			return cfg, err
+		}
+		cfg.Rewriters = opts.rewriters
+	}
+	return cfg, nil
+}
+
+func replaceValue(replace bool) string {
+	if replace {
+		return "yes"
+	}
+	return "no"
+}
+
+// prepareInject runs semantic analysis of the project ahead of the
+// toolexec build and adds imports and modules needed by instrumented code.
+func prepareInject(cfg Config, executor CommandExecutor) error {
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	replace := replaceValue(cfg.Replace)
+	// do semantic check before injecting
+	logger.Info("instrgen semantic analysis...")
+	pkgs, err := LoadProgram(".", cfg.Tags)
+	if err != nil {
+		return err
+	}
+	// load errors do not stop inject, go build reports them in detail
+	for _, err := range loadErrors(pkgs) {
+		logger.Warn(err.Error())
+	}
+	modules, _, err := projectModules(root)
+	if err != nil {
+		return err
+	}
+	if err := sema(projectFilter(root, cfg, modules, logCtxRewriterName), replace, pkgs); err != nil {
+		return err
+	}
+	imports, mods := requiredDeps(cfg.rewriters())
+	moduleDirs, err := writeImports(importsFilter(root, cfg, modules), imports, pkgs)
+	if err != nil {
+		return err
+	}
+	for _, dir := range moduleDirs {
+		if err := addDeps(dir, imports, mods, executor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildArgs returns arguments of go build run by inject and prune,
+// in workspace mode it builds all workspace modules within the project.
+func buildArgs() ([]string, error) {
+	patterns, err := modulePatterns(".")
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{"build"}, patterns...), nil
+}
+
+func runInject(opts *options, args []string, executor CommandExecutor) error {
+	if err := checkNoArgs("inject", args); err != nil {
+		return err
+	}
+	cfg, err := opts.projectConfig()
+	if err != nil {
+		return fmt.Errorf("inject: %w", err)
+	}
+	if err := prepareInject(cfg, executor); err != nil {
+		return fmt.Errorf("inject: %w", err)
+	}
+	goArgs, err := buildArgs()
+	if err != nil {
+		return fmt.Errorf("inject: %w", err)
+	}
+	logger.Info("instrgen compiler")
+	return executeCommand("inject", ".", cfg, goArgs, executor)
+}
+
+// goRunner returns run function of command passing its arguments
+// to go subcommand goCmd built with instrumentation injected.
+func goRunner(goCmd string) func(opts *options, args []string, executor CommandExecutor) error {
+	return func(opts *options, args []string, executor CommandExecutor) error {
+		cfg, err := opts.projectConfig()
+		if err != nil {
+			return fmt.Errorf("%s: %w", goCmd, err)
+		}
+		if err := prepareInject(cfg, executor); err != nil {
+			return fmt.Errorf("%s: %w", goCmd, err)
+		}
+		logger.Info("instrgen compiler")
+		err = executeCommand("inject", ".", cfg, append([]string{goCmd}, args...), executor)
+		var goErr *exec.ExitError
+		if errors.As(err, &goErr) {
+			// go command already reported its failure
+			return &exitError{code: goErr.ExitCode(), err: fmt.Errorf("%s: go %s failed", goCmd, goCmd)}
+		}
+		return err
+	}
+}
+
+func runPrune(opts *options, args []string, executor CommandExecutor) error {
+	if err := checkNoArgs("prune", args); err != nil {
+		return err
+	}
+	cfg, err := opts.projectConfig()
+	if err != nil {
+		return fmt.Errorf("prune: %w", err)
+	}
+	goArgs, err := buildArgs()
+	if err != nil {
+		return fmt.Errorf("prune: %w", err)
+	}
+	logger.Info("instrgen compiler")
+	if err := executeCommand("prune", ".", cfg, goArgs, executor); err != nil {
+		return err
+	}
+	// pruned sources build without modules added by inject
+	if err := removeDeps(executor); err != nil {
+		return fmt.Errorf("prune: %w", err)
+	}
+	return nil
+}
+
+func runDiff(opts *options, args []string, executor CommandExecutor) error {
+	if err := checkNoArgs("diff", args); err != nil {
+		return err
+	}
+	cfg, err := opts.projectConfig()
+	if err != nil {
+		return fmt.Errorf("diff: %w", err)
+	}
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	pkgs, err := LoadProgram(".", cfg.Tags)
+	if err != nil {
+		return fmt.Errorf("diff: %w", err)
+	}
+	for _, err := range loadErrors(pkgs) {
+		logger.Warn(err.Error())
+	}
+	modules, _, err := projectModules(root)
+	if err != nil {
+		return fmt.Errorf("diff: %w", err)
+	}
+	// rewriters see real source paths, as if sources were replaced
+	cfg.Replace = true
+	command := "inject"
+	if opts.prune {
+		command = "prune"
+	} else if err := sema(projectFilter(root, cfg, modules, logCtxRewriterName), replaceValue(cfg.Replace), pkgs); err != nil {
+		return err
+	}
+	var plugins []pluginBinary
+	if command == "inject" {
+		if plugins, err = resolvePlugins(root, cfg.Plugins); err != nil {
+			return fmt.Errorf("diff: %w", err)
+		}
+	}
+	rewriterS := makeRewriters(InstrgenCmd{ProjectPath: root, Modules: modules, Cmd: command, Config: cfg, Plugins: plugins},
+		make(map[string]string))
+	changes, err := collectChanges(root, pkgs, rewriterS)
+	if err != nil {
+		return fmt.Errorf("diff: %w", err)
+	}
+	if err := writeDiffs(os.Stdout, changes, opts.patchDir); err != nil {
+		return err
+	}
+	if len(changes) > 0 {
+		return &exitError{code: exitChanges, err: fmt.Errorf("diff: %d files would change", len(changes))}
+	}
+	return nil
+}
+
+func runCheck(opts *options, args []string, executor CommandExecutor) error {
+	if err := checkNoArgs("check", args); err != nil {
+		return err
+	}
+	cfg, err := opts.projectConfig()
+	if err != nil {
+		return fmt.Errorf("check: %w", err)
+	}
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	pkgs, err := LoadProgram(".", cfg.Tags)
+	if err != nil {
+		return fmt.Errorf("check: %w", err)
+	}
+	modules, _, err := projectModules(root)
+	if err != nil {
+		return fmt.Errorf("check: %w", err)
+	}
+	// committed instrumentation is always rewritten in place
+	cfg.Replace = true
+	// files excluded since they were instrumented are pruned too
+	pruners := makeRewriters(InstrgenCmd{ProjectPath: root, Cmd: "prune", Config: Config{Replace: true}}, make(map[string]string))
+	pruned, err := pruneSources(root, pkgs, pruners)
+	if err != nil {
+		return fmt.Errorf("check: %w", err)
+	}
+	if pkgs, err = loadProgram(".", cfg.Tags, pruned); err != nil {
+		return fmt.Errorf("check: %w", err)
+	}
+	for _, err := range loadErrors(pkgs) {
+		logger.Warn(err.Error())
+	}
+	if err := sema(projectFilter(root, cfg, modules, logCtxRewriterName), replaceValue(cfg.Replace), pkgs); err != nil {
+		return err
+	}
+	plugins, err := resolvePlugins(root, cfg.Plugins)
+	if err != nil {
+		return fmt.Errorf("check: %w", err)
+	}
+	injectors := makeRewriters(InstrgenCmd{ProjectPath: root, Modules: modules, Cmd: "inject", Config: cfg, Plugins: plugins},
+		make(map[string]string))
+	issues, err := checkInstrumentation(root, pkgs, pruned, injectors)
+	if err != nil {
+		return fmt.Errorf("check: %w", err)
+	}
+	writeIssues(os.Stdout, issues)
+	if len(issues) > 0 {
+		return &exitError{code: exitChanges, err: fmt.Errorf("check: %d functions have outdated instrumentation", len(issues))}
+	}
+	return nil
+}
+
+func runExport(opts *options, args []string, executor CommandExecutor) error {
+	if opts.outDir == "" {
+		return errors.New("export: missing output directory, set it with -o")
+	}
+	cfg, err := opts.projectConfig()
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	root, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	outDir, err := filepath.Abs(opts.outDir)
+	if err != nil {
+		return err
+	}
+	patterns, files, err := exportPatterns(args)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	pkgs, err := loadPackages(cfg.Tags, patterns)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	for _, err := range loadErrors(pkgs) {
+		logger.Warn(err.Error())
+	}
+	modules, _, err := projectModules(root)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	// rewriters see real source paths, exported files replace them
+	cfg.Replace = true
+	if err := sema(projectFilter(root, cfg, modules, logCtxRewriterName), replaceValue(cfg.Replace), pkgs); err != nil {
+		return err
+	}
+	plugins, err := resolvePlugins(root, cfg.Plugins)
+	if err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	imports, _ := requiredDeps(cfg.rewriters())
+	e := &exporter{root: root, outDir: outDir,
+		rewriterS: makeRewriters(InstrgenCmd{ProjectPath: root, Modules: modules, Cmd: "inject", Config: cfg, Plugins: plugins},
+			make(map[string]string)),
+		imports: imports, importsFilter: importsFilter(root, cfg, modules),
+		strict: cfg.Strict, overlay: overlay{Replace: make(map[string]string)}}
+	exported := 0
+	for _, pkg := range pkgs {
+		if len(pkg.GoFiles) == 0 {
+			continue
+		}
+		if err := e.exportPackage(pkg, files); err != nil {
+			// rewriter failures are returned in strict mode only
+			var rewriteErr *rewriteError
+			if cfg.Strict && errors.As(err, &rewriteErr) {
+				return &exitError{code: exitRewriteFailed, err: fmt.Errorf("export: strict mode: %w", err)}
+			}
+			return fmt.Errorf("export: %w", err)
+		}
+		exported++
+	}
+	if err := e.writeOverlay(); err != nil {
+		return fmt.Errorf("export: %w", err)
+	}
+	logger.Info(fmt.Sprintf("exported %d packages to %s, %d files rewritten", exported, opts.outDir, e.rewritten))
+	return nil
+}
+
+func runReport(opts *options, args []string, executor CommandExecutor) error {
+	if err := checkNoArgs("report", args); err != nil {
+		return err
+	}
+	report, err := readReport(reportFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.New("report: no report found, run inject or prune first")
+		}
+		return fmt.Errorf("report: %w", err)
+	}
+	if opts.json {
+		content, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(content))
+	} else {
+		printReport(os.Stdout, report)
+	}
+	if failed := report.Summary[statusFailed]; failed > 0 {
+		return &exitError{code: exitFailure, err: fmt.Errorf("report: %d files failed", failed)}
+	}
+	return nil
+}
+
+// printReport prints report in human readable form.
+func printReport(w io.Writer, report Report) {
+	var statuses []string
+	for _, status := range []string{statusInstrumented, statusEnriched, statusPruned, statusSkipped, statusFailed} {
+		statuses = append(statuses, fmt.Sprintf("%d %s", report.Summary[status], status))
+	}
+	fmt.Fprintf(w, "%s: %s\n", report.Command, strings.Join(statuses, ", "))
+	for _, pkg := range report.Packages {
+		if pkg.Cached {
+			fmt.Fprintf(w, "%s (cached)\n", pkg.Path)
+		} else {
+			fmt.Fprintln(w, pkg.Path)
+		}
+		for _, file := range pkg.Files {
+			detail := file.Reason
+			if len(file.Functions) > 0 {
+				detail = strings.Join(file.Functions, ", ")
+			}
+			fmt.Fprintf(w, "\t%-12s %s (%s)", file.Status, file.Path, file.Rewriter)
+			if detail != "" {
+				fmt.Fprintf(w, ": %s", detail)
+			}
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+func runClean(opts *options, args []string, executor CommandExecutor) error {
+	if err := checkNoArgs("clean", args); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(workDir); err != nil {
+		return fmt.Errorf("clean: %w", err)
+	}
+	return nil
+}
+
+func runVersion(opts *options, args []string, executor CommandExecutor) error {
+	if err := checkNoArgs("version", args); err != nil {
+		return err
+	}
+	version, err := driverVersion()
+	if err != nil {
+		return err
+	}
+	self, err := executable()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s %s %s\n", programName, version, self)
+	return nil
+}
@@ -0,0 +1,606 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+)
+
+// configVersion is the only config schema version understood by instrgen.
+const configVersion = 1
+
+// configFileNames are looked up in project directory in this order.
+var configFileNames = []string{"instrgen.yaml", "instrgen.yml", "instrgen.json"}
+
+// Rewriter names usable in config and their default order.
+const (
+	runtimeRewriterName = "runtime"
+	logCtxRewriterName  = "logctx"
+	basicRewriterName   = "basic"
+)
+
+var defaultRewriters = []string{runtimeRewriterName, logCtxRewriterName, basicRewriterName}
+
+// rewriterRequires lists rewriters each rewriter relies on. Code added
+// by basic calls runtime.InstrgenSetTls added by runtime. Logctx refers
+// to span context declared by basic and declares it itself otherwise.
+var rewriterRequires = map[string][]string{
+	basicRewriterName: {runtimeRewriterName},
+}
+
+// Exporter names understood by rtlib.
+var exporterNames = []string{"file", "otlp", "zipkin"}
+
+// Config is project configuration read from instrgen.yaml or instrgen.json.
+type Config struct {
+	// Version of the config schema.
+	Version int `yaml:"version" json:"version"`
+	// Include lists globs of files to instrument, relative to project directory.
+	// All project files are included when empty.
+	Include []string `yaml:"include,omitempty" json:"include,omitempty"`
+	// Exclude lists globs of files never instrumented.
+	Exclude []string `yaml:"exclude,omitempty" json:"exclude,omitempty"`
+	// EntryPoints in package.function form bootstrap the tracer provider.
+	// "*" matches any string, so "*/cmd/*.main" selects main function
+	// of every binary under cmd directories.
+	EntryPoints []string `yaml:"entry_points,omitempty" json:"entry_points,omitempty"`
+	// Replace rewrites project sources in place.
+	Replace bool `yaml:"replace,omitempty" json:"replace,omitempty"`
+	// Rewriters selects rewriters used by inject.
+	Rewriters []string `yaml:"rewriters,omitempty" json:"rewriters,omitempty"`
+	// Strict fails the build when any rewriter fails on a project file.
+	Strict bool `yaml:"strict,omitempty" json:"strict,omitempty"`
+	// Tags lists build tags used both by semantic analysis and go build.
+	Tags []string `yaml:"tags,omitempty" json:"tags,omitempty"`
+	// Packages holds per package rules.
+	Packages []PackageRule `yaml:"packages,omitempty" json:"packages,omitempty"`
+	// Exporter holds defaults of instrumented binary exporter.
+	Exporter Exporter `yaml:"exporter,omitempty" json:"exporter,omitempty"`
+	// Plugins lists external rewriters run by inject after built-in ones.
+	Plugins []Plugin `yaml:"plugins,omitempty" json:"plugins,omitempty"`
+}
+
+// Plugin is external rewriter executable, see plugin.go for the protocol.
+type Plugin struct {
+	// Name identifies plugin in rewriters lists and reports.
+	Name string `yaml:"name" json:"name"`
+	// Command holds executable followed by its arguments. Executable
+	// containing path separator is relative to project directory,
+	// otherwise it is looked up in PATH.
+	Command []string `yaml:"command" json:"command"`
+}
+
+// PackageRule narrows project settings for matching packages.
+type PackageRule struct {
+	// Package is import path pattern, "..." matches any string.
+	Package string `yaml:"package" json:"package"`
+	// Skip excludes package from instrumentation.
+	Skip bool `yaml:"skip,omitempty" json:"skip,omitempty"`
+	// Include, when not empty, restricts files of package to matching globs.
+	Include []string `yaml:"include,omitempty" json:"include,omitempty"`
+	// Exclude lists additional globs of files never instrumented.
+	Exclude []string `yaml:"exclude,omitempty" json:"exclude,omitempty"`
+	// Rewriters, when not empty, restricts rewriters applied to package.
+	Rewriters []string `yaml:"rewriters,omitempty" json:"rewriters,omitempty"`
+}
+
+// Exporter holds defaults used by instrumented binary when
+// corresponding OTEL_* environment variables are not set.
+type Exporter struct {
+	Name        string `yaml:"name,omitempty" json:"name,omitempty"`
+	Endpoint    string `yaml:"endpoint,omitempty" json:"endpoint,omitempty"`
+	Protocol    string `yaml:"protocol,omitempty" json:"protocol,omitempty"`
+	ServiceName string `yaml:"service_name,omitempty" json:"service_name,omitempty"`
+}
+
+func defaultConfig() Config {
+	return Config{Version: configVersion, EntryPoints: []string{"main.main"}}
+}
+
+// findConfig returns path of project config in dir or empty string.
+func findConfig(dir string) (string, error) {
+	var found []string
+	for _, name := range configFileNames {
+		if alib.FileExists(filepath.Join(dir, name)) {
+			found = append(found, name)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", nil
+	case 1:
+		return filepath.Join(dir, found[0]), nil
+	default:
+		return "", fmt.Errorf("ambiguous project config: both %s and %s found", found[0], found[1])
+	}
+}
+
+// loadConfig reads and validates project config. Defaults are returned
+// when configPath is empty.
+func loadConfig(configPath string) (Config, error) {
+	cfg := defaultConfig()
+	if configPath == "" {
+		return cfg, nil
+	}
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return cfg, err
+	}
+	cfg, err = parseConfig(filepath.Base(configPath), content)
+	if err != nil {
+		return cfg, fmt.Errorf("%s: %w", configPath, err)
+	}
+	return cfg, nil
+}
+
+// moduleConfigKeys lists keys allowed in config files of workspace
+// modules. They narrow files instrumented in the module, other settings
+// apply to the whole build and are read from project config only.
+var moduleConfigKeys = []string{"version", "include", "exclude", "packages"}
+
+// loadModuleConfig reads and validates config of workspace module,
+// keys other than moduleConfigKeys are rejected.
+func loadModuleConfig(configPath string) (Config, error) {
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return Config{}, err
+	}
+	var raw map[string]interface{}
+	if configUnmarshal(configPath)(content, &raw) == nil {
+		keys := make([]string, 0, len(raw))
+		for key := range raw {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if !contains(moduleConfigKeys, key) {
+				return Config{}, fmt.Errorf("%s: key %q is not supported in module config, set it in project config", configPath, key)
+			}
+		}
+	}
+	return loadConfig(configPath)
+}
+
+// configUnmarshal returns unmarshal function of config file format.
+func configUnmarshal(name string) func([]byte, interface{}) error {
+	if filepath.Ext(name) == ".json" {
+		return json.Unmarshal
+	}
+	return yaml.Unmarshal
+}
+
+func parseConfig(name string, content []byte) (Config, error) {
+	var cfg Config
+	var raw interface{}
+	unmarshal := configUnmarshal(name)
+	if err := unmarshal(content, &raw); err != nil {
+		return cfg, err
+	}
+	if raw == nil {
+		return cfg, errors.New("empty config")
+	}
+	if err := checkKeys("", raw, reflect.TypeOf(cfg)); err != nil {
+		return cfg, err
+	}
+	if err := unmarshal(content, &cfg); err != nil {
+		return cfg, err
+	}
+	if len(cfg.EntryPoints) == 0 {
+		cfg.EntryPoints = defaultConfig().EntryPoints
+	}
+	return cfg, cfg.validate()
+}
+
+// checkKeys reports first key of raw document that has no
+// corresponding field in type t.
+func checkKeys(at string, raw interface{}, t reflect.Type) error {
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := make(map[string]reflect.Type)
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+			fields[name] = t.Field(i).Type
+		}
+		keys := make([]string, 0, len(m))
+		for key := range m {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			keyPath := key
+			if at != "" {
+				keyPath = at + "." + key
+			}
+			fieldType, ok := fields[key]
+			if !ok {
+				return fmt.Errorf("unknown key %q", keyPath)
+			}
+			if err := checkKeys(keyPath, m[key], fieldType); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		items, ok := raw.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, item := range items {
+			if err := checkKeys(fmt.Sprintf("%s[%d]", at, i), item, t.Elem()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func checkGlobs(key string, globs []string) error {
+	_, err := compileGlobs(key, globs)
+	return err
+}
+
+func checkRewriterNames(key string, names []string, known []string) error {
+	for _, name := range names {
+		if !contains(known, name) {
+			return fmt.Errorf("unknown rewriter %q in %s, want one of %s",
+				name, key, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
+
+// checkPipeline reports rewriters listed twice and rewriters
+// whose required rewriters are missing from names. Their order does not
+// matter, runtime rewrites runtime package only, never files of
+// packages basic rewrites.
+func checkPipeline(key string, names []string) error {
+	for i, name := range names {
+		if contains(names[:i], name) {
+			return fmt.Errorf("rewriter %q listed twice in %s", name, key)
+		}
+		for _, required := range rewriterRequires[name] {
+			if !contains(names, required) {
+				return fmt.Errorf("rewriter %q in %s requires %q", name, key, required)
+			}
+		}
+	}
+	return nil
+}
+
+func (cfg Config) validatePlugins() error {
+	for i, plugin := range cfg.Plugins {
+		key := fmt.Sprintf("plugins[%d]", i)
+		switch {
+		case plugin.Name == "":
+			return fmt.Errorf("missing %s.name", key)
+		case contains(defaultRewriters, plugin.Name) || plugin.Name == "prune":
+			return fmt.Errorf("invalid %s.name %q: reserved by built-in rewriter", key, plugin.Name)
+		case len(plugin.Command) == 0 || plugin.Command[0] == "":
+			return fmt.Errorf("missing %s.command", key)
+		}
+		for _, other := range cfg.Plugins[:i] {
+			if other.Name == plugin.Name {
+				return fmt.Errorf("duplicate plugin name %q", plugin.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func (cfg Config) validate() error {
+	if cfg.Version == 0 {
+		return errors.New("missing version")
+	}
+	if cfg.Version != configVersion {
+		return fmt.Errorf("unsupported version %d, want %d", cfg.Version, configVersion)
+	}
+	if err := checkGlobs("include", cfg.Include); err != nil {
+		return err
+	}
+	if err := checkGlobs("exclude", cfg.Exclude); err != nil {
+		return err
+	}
+	if _, err := parseEntryPoints(cfg.EntryPoints); err != nil {
+		return fmt.Errorf("entry_points: %w", err)
+	}
+	if err := cfg.validatePlugins(); err != nil {
+		return err
+	}
+	known := cfg.rewriterNames()
+	if err := checkRewriterNames("rewriters", cfg.Rewriters, known); err != nil {
+		return err
+	}
+	if err := checkPipeline("rewriters", cfg.Rewriters); err != nil {
+		return err
+	}
+	for i, rule := range cfg.Packages {
+		key := fmt.Sprintf("packages[%d]", i)
+		if rule.Package == "" {
+			return fmt.Errorf("missing %s.package", key)
+		}
+		if _, err := compilePackage(rule.Package); err != nil {
+			return fmt.Errorf("invalid %s.package %q: %w", key, rule.Package, err)
+		}
+		if err := checkGlobs(key+".include", rule.Include); err != nil {
+			return err
+		}
+		if err := checkGlobs(key+".exclude", rule.Exclude); err != nil {
+			return err
+		}
+		if err := checkRewriterNames(key+".rewriters", rule.Rewriters, known); err != nil {
+			return err
+		}
+	}
+	if cfg.Exporter.Name != "" && !contains(exporterNames, cfg.Exporter.Name) {
+		return fmt.Errorf("unknown exporter.name %q, want one of %s",
+			cfg.Exporter.Name, strings.Join(exporterNames, ", "))
+	}
+	return nil
+}
+
+// rewriterNames returns names of built-in rewriters followed
+// by names of plugins.
+func (cfg Config) rewriterNames() []string {
+	names := append([]string(nil), defaultRewriters...)
+	for _, plugin := range cfg.Plugins {
+		names = append(names, plugin.Name)
+	}
+	return names
+}
+
+// rewriters returns names of enabled inject rewriters in the order they
+// are applied, by default built-in ones followed by plugins.
+func (cfg Config) rewriters() []string {
+	if len(cfg.Rewriters) == 0 {
+		return cfg.rewriterNames()
+	}
+	return cfg.Rewriters
+}
+
+// exporterDefaults maps exporter settings onto environment
+// variables read by rtlib.
+func (cfg Config) exporterDefaults() map[string]string {
+	defaults := make(map[string]string)
+	exporter := cfg.Exporter
+	if exporter.Name != "" {
+		defaults["OTEL_TRACES_EXPORTER"] = exporter.Name
+	}
+	if exporter.Endpoint != "" {
+		if exporter.Name == "zipkin" {
+			defaults["OTEL_EXPORTER_ZIPKIN_ENDPOINT"] = exporter.Endpoint
+		} else {
+			defaults["OTEL_EXPORTER_OTLP_ENDPOINT"] = exporter.Endpoint
+		}
+	}
+	if exporter.Protocol != "" {
+		defaults["OTEL_EXPORTER_OTLP_PROTOCOL"] = exporter.Protocol
+	}
+	if exporter.ServiceName != "" {
+		defaults["OTEL_SERVICE_NAME"] = exporter.ServiceName
+	}
+	return defaults
+}
+
+// fileRules holds globs and package patterns of config compiled once
+// for all files matched by a filter.
+type fileRules struct {
+	include  []*regexp.Regexp
+	exclude  []*regexp.Regexp
+	packages []packageRules
+}
+
+type packageRules struct {
+	PackageRule
+	pattern *regexp.Regexp
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// compileRules compiles globs and package patterns of cfg, errors
+// are reported by validate when config is loaded.
+func (cfg Config) compileRules() (fileRules, error) {
+	var rules fileRules
+	var err error
+	if rules.include, err = compileGlobs("include", cfg.Include); err != nil {
+		return rules, err
+	}
+	if rules.exclude, err = compileGlobs("exclude", cfg.Exclude); err != nil {
+		return rules, err
+	}
+	for i, rule := range cfg.Packages {
+		key := fmt.Sprintf("packages[%d]", i)
+		compiled := packageRules{PackageRule: rule}
+		if compiled.pattern, err = compilePackage(rule.Package); err != nil {
+			return rules, fmt.Errorf("invalid %s.package %q: %w", key, rule.Package, err)
+		}
+		if compiled.include, err = compileGlobs(key+".include", rule.Include); err != nil {
+			return rules, err
+		}
+		if compiled.exclude, err = compileGlobs(key+".exclude", rule.Exclude); err != nil {
+			return rules, err
+		}
+		rules.packages = append(rules.packages, compiled)
+	}
+	return rules, nil
+}
+
+// filter returns file filter of given rewriter. Files are matched relative
+// to project directory root, files outside of it are never selected.
+// Filter of config failing validation selects no file.
+func (cfg Config) filter(root string, rewriter string) alib.FileFilter {
+	rules, err := cfg.compileRules()
+	if err != nil {
+		logger.Error("config: " + err.Error())
+		return func(pkg string, filePath string) bool { return false }
+	}
+	return func(pkg string, filePath string) bool {
+		if filePath == "" {
+			return false
+		}
+		if !filepath.IsAbs(filePath) {
+			filePath = filepath.Join(root, filePath)
+		}
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return false
+		}
+		rel = filepath.ToSlash(rel)
+		if len(rules.include) > 0 && !matchAny(rules.include, rel) {
+			return false
+		}
+		if matchAny(rules.exclude, rel) {
+			return false
+		}
+		for _, rule := range rules.packages {
+			if !rule.pattern.MatchString(pkg) {
+				continue
+			}
+			if rule.Skip {
+				return false
+			}
+			if len(rule.Rewriters) > 0 && !contains(rule.Rewriters, rewriter) {
+				return false
+			}
+			if len(rule.include) > 0 && !matchAny(rule.include, rel) {
+				return false
+			}
+			if matchAny(rule.exclude, rel) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// projectFilter returns filter applying rules of module config files
+// to files of their modules and rules of cfg to the rest of the project.
+// Files outside of root are never selected.
+func projectFilter(root string, cfg Config, modules []Module, rewriter string) alib.FileFilter {
+	projectRules := cfg.filter(root, rewriter)
+	moduleRules := make(map[string]alib.FileFilter)
+	for _, module := range modules {
+		if module.Config != nil {
+			moduleRules[module.Dir] = module.Config.filter(module.Dir, rewriter)
+		}
+	}
+	return func(pkg string, filePath string) bool {
+		if filePath != "" && !filepath.IsAbs(filePath) {
+			filePath = filepath.Join(root, filePath)
+		}
+		module, ok := enclosingModule(filePath, modules)
+		if !ok || module.Config == nil {
+			return projectRules(pkg, filePath)
+		}
+		rel, err := filepath.Rel(root, filePath)
+		if err != nil || !filepath.IsLocal(rel) {
+			return false
+		}
+		return moduleRules[module.Dir](pkg, filePath)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func matchAny(globs []*regexp.Regexp, name string) bool {
+	for _, glob := range globs {
+		if glob.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// compileGlobs compiles globs relative to project directory
+// listed under key of config.
+func compileGlobs(key string, globs []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, glob := range globs {
+		if glob == "" || path.IsAbs(glob) || filepath.IsAbs(glob) {
+			return nil, fmt.Errorf("invalid %s glob %q: must be relative to project directory", key, glob)
+		}
+		re, err := compileGlob(glob)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s glob %q: %w", key, glob, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// compileGlob compiles glob matching slash separated names, where "**"
+// matches any string, "*" any string without slash and "?" single
+// character other than slash.
+func compileGlob(glob string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				// "**/" matches zero or more directories
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					i++
+					re.WriteString("(.*/)?")
+				} else {
+					re.WriteString(".*")
+				}
+			} else {
+				re.WriteString("[^/]*")
+			}
+		case '?':
+			re.WriteString("[^/]")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+// compilePackage compiles import path pattern in which "..."
+// matches any string, like in go command package patterns.
+func compilePackage(pattern string) (*regexp.Regexp, error) {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.ReplaceAll(re, `\.\.\.`, `.*`)
+	// "a/..." matches "a" as well
+	if strings.HasSuffix(re, `/.*`) {
+		re = strings.TrimSuffix(re, `/.*`) + `(/.*)?`
+	}
+	return regexp.Compile("^" + re + "$")
+}
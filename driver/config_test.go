@@ -0,0 +1,237 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+	"go.opentelemetry.io/contrib/instrgen/rewriters"
+)
+
+const yamlConfig = `version: 1
+include:
+  - "**/*.go"
+exclude:
+  - "**/*_test.go"
+entry_points:
+  - example.com/app/cmd/server.main
+  - "*/worker.Run"
+replace: true
+rewriters: [basic, runtime]
+packages:
+  - package: example.com/app/internal/...
+    exclude: ["**/gen_*.go"]
+  - package: example.com/app/vendored
+    skip: true
+  - package: example.com/app/logs
+    rewriters: [logctx]
+exporter:
+  name: otlp
+  endpoint: collector:4317
+  service_name: app
+`
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := parseConfig("instrgen.yaml", []byte(yamlConfig))
+	require.NoError(t, err)
+	assert.Equal(t, 1, cfg.Version)
+	assert.Equal(t, []string{"**/*.go"}, cfg.Include)
+	assert.Equal(t, []string{"example.com/app/cmd/server.main", "*/worker.Run"}, cfg.EntryPoints)
+	assert.True(t, cfg.Replace)
+	assert.Equal(t, []string{basicRewriterName, runtimeRewriterName}, cfg.rewriters())
+	assert.Len(t, cfg.Packages, 3)
+	assert.Equal(t, map[string]string{
+		"OTEL_TRACES_EXPORTER":        "otlp",
+		"OTEL_EXPORTER_OTLP_ENDPOINT": "collector:4317",
+		"OTEL_SERVICE_NAME":           "app",
+	}, cfg.exporterDefaults())
+
+	jsonCfg, err := parseConfig("instrgen.json", []byte(`{"version": 1, "exclude": ["gen/**"]}`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"gen/**"}, jsonCfg.Exclude)
+	assert.Equal(t, []string{"main.main"}, jsonCfg.EntryPoints)
+	assert.Equal(t, defaultRewriters, jsonCfg.rewriters())
+}
+
+func TestParseConfigErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{"instrgen.yaml", "", "empty config"},
+		{"instrgen.yaml", "include: [a]", "missing version"},
+		{"instrgen.yaml", "version: 2", "unsupported version 2"},
+		{"instrgen.yaml", "version: 1\nincldue: [a]", `unknown key "incldue"`},
+		{"instrgen.yaml", "version: 1\npackages:\n  - package: a\n    skpi: true", `unknown key "packages[0].skpi"`},
+		{"instrgen.json", `{"version": 1, "exporter": {"nmae": "otlp"}}`, `unknown key "exporter.nmae"`},
+		{"instrgen.yaml", "version: 1\nrewriters: [spans]", `unknown rewriter "spans" in rewriters`},
+		{"instrgen.yaml", "version: 1\ninclude: [/abs/**]", `invalid include glob "/abs/**"`},
+		{"instrgen.yaml", "version: 1\nentry_points: [main.main, main]", `entry_points: invalid entry point "main"`},
+		{"instrgen.yaml", "version: 1\npackages:\n  - skip: true", "missing packages[0].package"},
+		{"instrgen.yaml", "version: 1\nexporter:\n  name: jaeger", `unknown exporter.name "jaeger"`},
+		{"instrgen.yaml", "version: 1\nrewriters: [logctx, basic]", `rewriter "basic" in rewriters requires "runtime"`},
+		{"instrgen.yaml", "version: 1\nrewriters: [runtime, runtime]", `rewriter "runtime" listed twice in rewriters`},
+		{"instrgen.yaml", "version: 1\nplugins:\n  - command: [audit]", "missing plugins[0].name"},
+		{"instrgen.yaml", "version: 1\nplugins:\n  - name: audit", "missing plugins[0].command"},
+		{"instrgen.yaml", "version: 1\nplugins:\n  - name: basic\n    command: [audit]", `invalid plugins[0].name "basic"`},
+		{"instrgen.yaml", "version: 1\nplugins:\n  - name: a\n    command: [a]\n  - name: a\n    command: [b]", `duplicate plugin name "a"`},
+		{"instrgen.yaml", "version: 1\nplugins:\n  - name: a\n    command: [a]\n    args: [x]", `unknown key "plugins[0].args"`},
+	}
+	for _, test := range tests {
+		_, err := parseConfig(test.name, []byte(test.content))
+		assert.ErrorContains(t, err, test.err, test.content)
+	}
+}
+
+func TestFindConfig(t *testing.T) {
+	dir := t.TempDir()
+	configPath, err := findConfig(dir)
+	require.NoError(t, err)
+	assert.Empty(t, configPath)
+	cfg, err := loadConfig(configPath)
+	require.NoError(t, err)
+	assert.Equal(t, defaultConfig(), cfg)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "instrgen.yaml"), []byte("version: 1\n"), 0644))
+	configPath, err = findConfig(dir)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "instrgen.yaml"), configPath)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "instrgen.json"), []byte(`{"version": 2}`), 0644))
+	_, err = findConfig(dir)
+	assert.ErrorContains(t, err, "ambiguous")
+	_, err = loadConfig(filepath.Join(dir, "instrgen.json"))
+	assert.ErrorContains(t, err, "instrgen.json: unsupported version")
+}
+
+func TestConfigFilter(t *testing.T) {
+	cfg, err := parseConfig("instrgen.yaml", []byte(yamlConfig))
+	require.NoError(t, err)
+	root := "/src/app"
+	basic := cfg.filter(root, basicRewriterName)
+	assert.True(t, basic("example.com/app", "/src/app/main.go"))
+	assert.True(t, basic("example.com/app/internal/db", "/src/app/internal/db/db.go"))
+	assert.True(t, basic("example.com/app", "main.go"))
+	assert.False(t, basic("example.com/app", "/src/app/main_test.go"))
+	assert.False(t, basic("example.com/app/internal/db", "/src/app/internal/db/gen_db.go"))
+	assert.False(t, basic("example.com/app/vendored", "/src/app/vendored/lib.go"))
+	assert.False(t, basic("example.com/app/logs", "/src/app/logs/logs.go"))
+	assert.True(t, cfg.filter(root, logCtxRewriterName)("example.com/app/logs", "/src/app/logs/logs.go"))
+	assert.False(t, basic("runtime", "/usr/local/go/src/runtime/proc.go"))
+	assert.False(t, basic("example.com/app", "/src/application/main.go"))
+	assert.False(t, basic("example.com/app", ""))
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		glob    string
+		name    string
+		matches bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "cmd/main.go", false},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "cmd/server/main.go", true},
+		{"cmd/**", "cmd/server/main.go", true},
+		{"cmd/*/main.go", "cmd/server/main.go", true},
+		{"cmd/*/main.go", "cmd/a/b/main.go", false},
+		{"**testdata/basic**", "driver/testdata/basic/fib.go", true},
+		{"?.go", "a.go", true},
+		{"[a].go", "a.go", false},
+	}
+	for _, test := range tests {
+		re, err := compileGlob(test.glob)
+		require.NoError(t, err)
+		assert.Equal(t, test.matches, re.MatchString(test.name), test.glob+" "+test.name)
+	}
+}
+
+func TestMatchPackage(t *testing.T) {
+	matchPackage := func(pattern string, pkg string) bool {
+		re, err := compilePackage(pattern)
+		require.NoError(t, err)
+		return re.MatchString(pkg)
+	}
+	assert.True(t, matchPackage("example.com/app/...", "example.com/app"))
+	assert.True(t, matchPackage("example.com/app/...", "example.com/app/internal/db"))
+	assert.False(t, matchPackage("example.com/app/...", "example.com/application"))
+	assert.True(t, matchPackage(".../cmd/...", "example.com/app/cmd/server"))
+	assert.False(t, matchPackage("example.com/app", "example.com/app/internal"))
+}
+
+func TestExporterDefaultsInjected(t *testing.T) {
+	src := "package main\n\nfunc main() {\n}\n"
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "main.go", src, parser.ParseComments)
+	require.NoError(t, err)
+	cfg := defaultConfig()
+	cfg.Exporter = Exporter{Name: "zipkin", Endpoint: "http://zipkin:9411/api/v2/spans"}
+	rewriter := rewriters.BasicRewriter{Filter: cfg.filter("/", basicRewriterName), Replace: "yes",
+		EntryPoints: []alib.EntryPoint{{Pkg: "main", FunName: "main"}}, Defaults: cfg.exporterDefaults()}
+	rewriter.Rewrite("main", file, fset, nil)
+	var out bytes.Buffer
+	require.NoError(t, printer.Fprint(&out, fset, file))
+	assert.Contains(t, out.String(), `rtlib.NewTracingState(rtlib.WithDefault("OTEL_EXPORTER_ZIPKIN_ENDPOINT", "http://zipkin:9411/api/v2/spans"), rtlib.WithDefault("OTEL_TRACES_EXPORTER", "zipkin"))`)
+}
+
+func TestRewritersFlag(t *testing.T) {
+	chdir(t, t.TempDir())
+	opts := &options{set: map[string]bool{"rewriters": true}, rewriters: stringList{basicRewriterName, runtimeRewriterName}}
+	cfg, err := opts.projectConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []string{basicRewriterName, runtimeRewriterName}, cfg.rewriters())
+	rewriterS := makeRewriters(InstrgenCmd{ProjectPath: "/src/app", Cmd: "inject", Config: cfg}, make(map[string]string))
+	require.Len(t, rewriterS, 2)
+	assert.IsType(t, rewriters.BasicRewriter{}, rewriterS[0])
+	assert.IsType(t, rewriters.RuntimeRewriter{}, rewriterS[1])
+
+	opts.rewriters = stringList{runtimeRewriterName}
+	cfg, err = opts.projectConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []string{runtimeRewriterName}, cfg.rewriters())
+
+	// log calls are enriched without spans
+	opts.rewriters = stringList{logCtxRewriterName}
+	cfg, err = opts.projectConfig()
+	require.NoError(t, err)
+	assert.Equal(t, []string{logCtxRewriterName}, cfg.rewriters())
+
+	tests := []struct {
+		rewriters stringList
+		err       string
+	}{
+		{nil, "invalid value \"\" for flag --rewriters"},
+		{stringList{"spans"}, `unknown rewriter "spans" in flag --rewriters`},
+		{stringList{basicRewriterName}, `rewriter "basic" in flag --rewriters requires "runtime"`},
+	}
+	for _, test := range tests {
+		opts.rewriters = test.rewriters
+		_, err := opts.projectConfig()
+		assert.ErrorContains(t, err, test.err)
+	}
+}
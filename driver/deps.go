@@ -0,0 +1,506 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/tools/go/packages"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+)
+
+const (
+	// instrgenModule provides rtlib imported by instrumented code.
+	instrgenModule = "go.opentelemetry.io/contrib/instrgen"
+	// otelVersion is version of OpenTelemetry modules rtlib is built
+	// with, TestOtelVersion checks it matches go.mod of instrgen module.
+	otelVersion = "v1.18.0"
+	// depsFile records go.mod and go.sum edits of inject undone by prune.
+	depsFile = workDir + "/deps.json"
+	// importsFileName is name of file importing packages needed by
+	// instrumented code, added to every instrumented package.
+	importsFileName = "instrgen_imports.go"
+)
+
+// rewriterDeps lists packages imported by code added by rewriters
+// along with modules providing them. Rewriters missing here add no imports.
+// Logctx reuses logger the project imports already and takes span context
+// from context without basic.
+var rewriterDeps = map[string]struct {
+	packages []string
+	modules  []module.Version
+}{
+	basicRewriterName: {
+		packages: []string{
+			"context",
+			"runtime",
+			"go.opentelemetry.io/contrib/instrgen/rtlib",
+			"go.opentelemetry.io/otel",
+			"go.opentelemetry.io/otel/sdk/trace",
+			"go.opentelemetry.io/otel/trace",
+		},
+		modules: []module.Version{
+			{Path: instrgenModule, Version: instrgenVersion()},
+			{Path: "go.opentelemetry.io/otel", Version: otelVersion},
+			{Path: "go.opentelemetry.io/otel/sdk", Version: otelVersion},
+			{Path: "go.opentelemetry.io/otel/trace", Version: otelVersion},
+		},
+	},
+	logCtxRewriterName: {
+		packages: []string{"go.opentelemetry.io/otel/trace"},
+		modules:  []module.Version{{Path: "go.opentelemetry.io/otel/trace", Version: otelVersion}},
+	},
+}
+
+// instrgenVersion returns version of instrgen module the driver is built
+// with, rtlib of the same version matches its rewriters. Pseudo-versions
+// pin the commit the driver is built from. The version is empty when the
+// module is replaced, like in development builds using local module, then
+// projects have to require it themselves.
+func instrgenVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, dep := range info.Deps {
+			if dep.Path == instrgenModule && dep.Replace == nil {
+				return dep.Version
+			}
+		}
+	}
+	return ""
+}
+
+// requiredDeps returns sorted packages and modules needed by code added
+// by given rewriters.
+func requiredDeps(rewriterNames []string) ([]string, []module.Version) {
+	var pkgs []string
+	var mods []module.Version
+	seen := make(map[string]bool)
+	for _, name := range rewriterNames {
+		for _, pkg := range rewriterDeps[name].packages {
+			if !seen[pkg] {
+				seen[pkg] = true
+				pkgs = append(pkgs, pkg)
+			}
+		}
+		for _, mod := range rewriterDeps[name].modules {
+			if !seen[mod.String()] {
+				seen[mod.String()] = true
+				mods = append(mods, mod)
+			}
+		}
+	}
+	sort.Strings(pkgs)
+	sort.Slice(mods, func(i, j int) bool {
+		return mods[i].Path < mods[j].Path
+	})
+	return pkgs, mods
+}
+
+// importsFilter selects files of packages rewritten by any of given
+// rewriters adding imports.
+func importsFilter(root string, cfg Config, modules []Module) alib.FileFilter {
+	var filters []alib.FileFilter
+	for _, name := range cfg.rewriters() {
+		if _, ok := rewriterDeps[name]; ok {
+			filters = append(filters, projectFilter(root, cfg, modules, name))
+		}
+	}
+	return func(pkg string, filePath string) bool {
+		for _, filter := range filters {
+			if filter(pkg, filePath) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func importsSource(pkgName string, imports []string) string {
+	var src strings.Builder
+	src.WriteString("package " + pkgName + "\n\nimport (\n")
+	for _, path := range imports {
+		src.WriteString("\t_ \"" + path + "\"\n")
+	}
+	src.WriteString(")\n")
+	return src.String()
+}
+
+// overlay is go build -overlay file, see go help build.
+type overlay struct {
+	Replace map[string]string
+}
+
+// writeImports adds file importing given packages to every package
+// selected by filter. Rewritten files are compiled with imports of the
+// original ones, go command has to know about packages used by added
+// code in advance. Import files are kept in work directory and added
+// to packages through overlay, so project sources stay untouched.
+// It returns sorted directories of modules with import files relative
+// to the project, those have to require imported packages.
+func writeImports(filter alib.FileFilter, imports []string, pkgs []*packages.Package) ([]string, error) {
+	root, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+	if err := makeWorkDir(); err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(importsDir); err != nil {
+		return nil, err
+	}
+	files := overlay{Replace: make(map[string]string)}
+	moduleDirs := make(map[string]bool)
+	for _, pkg := range pkgs {
+		if len(imports) == 0 || len(pkg.GoFiles) == 0 {
+			continue
+		}
+		path := pkg.GoFiles[0]
+		// filter never selects packages outside of the project, like GOROOT
+		if !filter(pkg.PkgPath, path) {
+			continue
+		}
+		importsPath := filepath.Join(filepath.Dir(path), importsFileName)
+		// left by older instrgen versions
+		if alib.FileExists(importsPath) {
+			continue
+		}
+		rel, err := filepath.Rel(root, filepath.Dir(path))
+		if err != nil || !filepath.IsLocal(rel) && rel != "." {
+			continue
+		}
+		workPath, err := filepath.Abs(filepath.Join(importsDir, rel, importsFileName))
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(workPath), 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(workPath, []byte(importsSource(pkg.Name, imports)), 0644); err != nil {
+			return nil, err
+		}
+		files.Replace[importsPath] = workPath
+		moduleDir := "."
+		if pkg.Module != nil && pkg.Module.Dir != "" {
+			if moduleDir, err = filepath.Rel(root, pkg.Module.Dir); err != nil {
+				return nil, err
+			}
+		}
+		moduleDirs[moduleDir] = true
+	}
+	content, err := json.MarshalIndent(files, "", " ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(overlayFile, content, 0644); err != nil {
+		return nil, err
+	}
+	dirs := make([]string, 0, len(moduleDirs))
+	for dir := range moduleDirs {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs, nil
+}
+
+// fileEdit holds file content before and after edit.
+type fileEdit struct {
+	Before []byte `json:"before"`
+	After  []byte `json:"after"`
+}
+
+// depsEdit records go.mod and go.sum edits made by inject
+// in module directory Dir relative to the project.
+type depsEdit struct {
+	Dir   string           `json:"dir"`
+	Added []module.Version `json:"added"`
+	GoMod fileEdit         `json:"go_mod"`
+	GoSum fileEdit         `json:"go_sum"`
+	// Vendor is set for vendored modules.
+	Vendor *vendorEdit `json:"vendor,omitempty"`
+}
+
+// readDepsEdits reads edits recorded by inject, one per module.
+func readDepsEdits() ([]depsEdit, error) {
+	content, err := os.ReadFile(depsFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var edits []depsEdit
+	if err := json.Unmarshal(content, &edits); err != nil {
+		// written by instrgen without workspace support
+		var edit depsEdit
+		if json.Unmarshal(content, &edit) != nil {
+			return nil, fmt.Errorf("%s: %w", depsFile, err)
+		}
+		edits = []depsEdit{edit}
+	}
+	for i := range edits {
+		if edits[i].Dir == "" {
+			edits[i].Dir = "."
+		}
+	}
+	return edits, nil
+}
+
+// writeDepsEdits records edits, deps file is removed when there are none.
+func writeDepsEdits(edits []depsEdit) error {
+	if len(edits) == 0 {
+		if err := os.Remove(depsFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	content, err := json.MarshalIndent(edits, "", " ")
+	if err != nil {
+		return err
+	}
+	if err := makeWorkDir(); err != nil {
+		return err
+	}
+	return os.WriteFile(depsFile, content, 0644)
+}
+
+// goArgsIn returns arguments of go command run in module directory.
+func goArgsIn(dir string, args ...string) []string {
+	if dir == "." {
+		return args
+	}
+	return append([]string{"-C", dir}, args...)
+}
+
+// missingModules returns modules not required by go.mod yet. Versions
+// already required are kept, go get would downgrade newer ones.
+func missingModules(gomod []byte, mods []module.Version) ([]module.Version, error) {
+	file, err := modfile.ParseLax("go.mod", gomod, nil)
+	if err != nil {
+		return nil, err
+	}
+	required := make(map[string]bool)
+	if file.Module != nil {
+		required[file.Module.Mod.Path] = true
+	}
+	for _, req := range file.Require {
+		required[req.Mod.Path] = true
+	}
+	var missing []module.Version
+	for _, mod := range mods {
+		if !required[mod.Path] {
+			missing = append(missing, mod)
+		}
+	}
+	return missing, nil
+}
+
+// readOptional reads file, missing file is empty.
+func readOptional(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return content, err
+}
+
+// addDeps adds modules missing in go.mod of module in dir with go get
+// and records the edit, so prune can undo it. Packages imported by
+// instrumented code are vendored as well when the module is vendored.
+func addDeps(dir string, imports []string, mods []module.Version, executor CommandExecutor) error {
+	gomodPath, gosumPath := filepath.Join(dir, "go.mod"), filepath.Join(dir, "go.sum")
+	gomod, err := os.ReadFile(gomodPath)
+	if err != nil {
+		return err
+	}
+	missing, err := missingModules(gomod, mods)
+	if err != nil {
+		return err
+	}
+	vendored, err := vendorMode(dir)
+	if err != nil {
+		return err
+	}
+	complete := !vendored
+	if vendored {
+		if complete, err = isVendored(dir, imports); err != nil {
+			return err
+		}
+	}
+	if len(missing) == 0 && complete {
+		return nil
+	}
+	for _, mod := range missing {
+		if mod.Version == "" {
+			return fmt.Errorf("%s: %s is not required and its version is unknown, the driver is built with replaced module; "+
+				"require the module the driver is built from, with the same replace directive", gomodPath, mod.Path)
+		}
+	}
+	gosum, err := readOptional(gosumPath)
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		args := goArgsIn(dir, "get")
+		for _, mod := range missing {
+			args = append(args, mod.String())
+		}
+		logger.Info("invoke : go " + strings.Join(args, " "))
+		executor.Execute("go", args)
+		run := executor.Run
+		if vendored {
+			// vendored modules are built offline
+			run = func() error { return withEnv(offlineEnv(), executor.Run) }
+		}
+		if err := run(); err != nil {
+			return fmt.Errorf("go get: %w", err)
+		}
+	}
+	var vendor *vendorEdit
+	if vendored {
+		if vendor, err = vendorPackages(dir, imports); err != nil {
+			// keep go.mod consistent with vendor directory
+			os.WriteFile(gomodPath, gomod, 0644)
+			if gosum != nil {
+				os.WriteFile(gosumPath, gosum, 0644)
+			}
+			return fmt.Errorf("vendor: %w", err)
+		}
+	}
+
+	edits, err := readDepsEdits()
+	if err != nil {
+		return err
+	}
+	edit := depsEdit{Dir: dir, Added: missing, GoMod: fileEdit{Before: gomod}, GoSum: fileEdit{Before: gosum}, Vendor: vendor}
+	kept := edits[:0]
+	for _, previous := range edits {
+		// edits of other modules and edits followed by changes of go.mod
+		// are kept, prune undoes them after this one
+		if previous.Dir != dir || !bytes.Equal(previous.GoMod.After, gomod) {
+			kept = append(kept, previous)
+			continue
+		}
+		// edits of consecutive injects are undone at once
+		edit.Added = append(previous.Added, missing...)
+		edit.GoMod.Before, edit.GoSum.Before = previous.GoMod.Before, previous.GoSum.Before
+		if previous.Vendor != nil && vendor != nil {
+			vendor.Files = append(previous.Vendor.Files, vendor.Files...)
+			vendor.ModulesTxt.Before = previous.Vendor.ModulesTxt.Before
+		}
+	}
+	if edit.GoMod.After, err = os.ReadFile(gomodPath); err != nil {
+		return err
+	}
+	if edit.GoSum.After, err = readOptional(gosumPath); err != nil {
+		return err
+	}
+	return writeDepsEdits(append(kept, edit))
+}
+
+// removeDeps undoes go.mod and go.sum edits recorded by inject, latest
+// first. When go.mod changed since, modules added by inject are dropped
+// with go get.
+func removeDeps(executor CommandExecutor) error {
+	edits, err := readDepsEdits()
+	if err != nil {
+		return err
+	}
+	for len(edits) > 0 {
+		if err := removeModuleDeps(edits[len(edits)-1], executor); err != nil {
+			return err
+		}
+		// the rest is kept for the next prune when this one fails
+		edits = edits[:len(edits)-1]
+		if err := writeDepsEdits(edits); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeModuleDeps(edit depsEdit, executor CommandExecutor) error {
+	if edit.Vendor != nil {
+		if err := unvendor(edit.Dir, edit.Vendor); err != nil {
+			return err
+		}
+	}
+	gomodPath := filepath.Join(edit.Dir, "go.mod")
+	gomod, err := os.ReadFile(gomodPath)
+	if err != nil {
+		return err
+	}
+	if len(edit.Added) == 0 {
+		return nil
+	}
+	if bytes.Equal(gomod, edit.GoMod.After) {
+		if err := os.WriteFile(gomodPath, edit.GoMod.Before, 0644); err != nil {
+			return err
+		}
+	} else {
+		args := goArgsIn(edit.Dir, "get")
+		for _, mod := range edit.Added {
+			args = append(args, mod.Path+"@none")
+		}
+		logger.Info("invoke : go " + strings.Join(args, " "))
+		executor.Execute("go", args)
+		run := executor.Run
+		if edit.Vendor != nil {
+			run = func() error { return withEnv(offlineEnv(), executor.Run) }
+		}
+		if err := run(); err != nil {
+			return fmt.Errorf("go get: %w", err)
+		}
+	}
+	return removeSumLines(filepath.Join(edit.Dir, "go.sum"), edit.GoSum)
+}
+
+// removeSumLines removes lines added to go.sum by edit, keeping
+// lines added by anything else.
+func removeSumLines(gosumPath string, edit fileEdit) error {
+	gosum, err := readOptional(gosumPath)
+	if err != nil || gosum == nil {
+		return err
+	}
+	before := make(map[string]bool)
+	for _, line := range splitLines(edit.Before) {
+		before[line] = true
+	}
+	added := make(map[string]bool)
+	for _, line := range splitLines(edit.After) {
+		if !before[line] {
+			added[line] = true
+		}
+	}
+	var kept bytes.Buffer
+	for _, line := range splitLines(gosum) {
+		if !added[line] {
+			kept.WriteString(line)
+		}
+	}
+	if kept.Len() == 0 && len(edit.Before) == 0 {
+		return os.Remove(gosumPath)
+	}
+	return os.WriteFile(gosumPath, kept.Bytes(), 0644)
+}
@@ -0,0 +1,192 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+)
+
+// GoGetExecutor edits go.mod and go.sum in dir the way go get would.
+type GoGetExecutor struct {
+	NullExecutor
+	dir   string
+	gomod string
+	gosum string
+}
+
+func (executor *GoGetExecutor) Run() error {
+	if err := os.WriteFile(filepath.Join(executor.dir, "go.mod"), []byte(executor.gomod), 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(executor.dir, "go.sum"), []byte(executor.gosum), 0644)
+}
+
+func TestMissingModules(t *testing.T) {
+	gomod := "module example.com/app\n\ngo 1.19\n\nrequire go.opentelemetry.io/otel v1.20.0\n"
+	mods := []module.Version{
+		{Path: "example.com/app", Version: "v1.0.0"},
+		{Path: "go.opentelemetry.io/otel", Version: "v1.18.0"},
+		{Path: "go.opentelemetry.io/otel/trace", Version: "v1.18.0"},
+	}
+	missing, err := missingModules([]byte(gomod), mods)
+	require.NoError(t, err)
+	assert.Equal(t, []module.Version{{Path: "go.opentelemetry.io/otel/trace", Version: "v1.18.0"}}, missing)
+
+	imports, mods := requiredDeps([]string{runtimeRewriterName})
+	assert.Empty(t, imports)
+	assert.Empty(t, mods)
+	imports, mods = requiredDeps([]string{runtimeRewriterName, logCtxRewriterName})
+	assert.Equal(t, []string{"go.opentelemetry.io/otel/trace"}, imports)
+	assert.Equal(t, []module.Version{{Path: "go.opentelemetry.io/otel/trace", Version: otelVersion}}, mods)
+	imports, mods = requiredDeps(defaultRewriters)
+	assert.Contains(t, imports, "go.opentelemetry.io/contrib/instrgen/rtlib")
+	assert.NotContains(t, imports, "go.uber.org/zap")
+	assert.Len(t, mods, 4)
+	assert.Equal(t, instrgenModule, mods[0].Path)
+}
+
+func TestAddRemoveDeps(t *testing.T) {
+	chdir(t, t.TempDir())
+	gomod := "module example.com/app\n\ngo 1.19\n"
+	gosum := "example.com/lib v1.0.0 h1:lib=\n"
+	require.NoError(t, os.WriteFile("go.mod", []byte(gomod), 0644))
+	require.NoError(t, os.WriteFile("go.sum", []byte(gosum), 0644))
+	mods := []module.Version{{Path: "go.opentelemetry.io/otel", Version: "v1.18.0"}}
+	executor := &GoGetExecutor{
+		gomod: gomod + "\nrequire go.opentelemetry.io/otel v1.18.0\n",
+		gosum: gosum + "go.opentelemetry.io/otel v1.18.0 h1:otel=\n",
+	}
+	require.NoError(t, addDeps(".", nil, mods, executor))
+	assert.Equal(t, [][]string{{"go", "get", "go.opentelemetry.io/otel@v1.18.0"}}, executor.commands)
+
+	// nothing is missing any more
+	require.NoError(t, addDeps(".", nil, mods, executor))
+	assert.Len(t, executor.commands, 1)
+
+	// go.sum lines added since are kept
+	content, err := os.ReadFile("go.sum")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile("go.sum", append(content, "example.com/other v1.0.0 h1:other=\n"...), 0644))
+	require.NoError(t, removeDeps(executor))
+	content, err = os.ReadFile("go.mod")
+	require.NoError(t, err)
+	assert.Equal(t, gomod, string(content))
+	content, err = os.ReadFile("go.sum")
+	require.NoError(t, err)
+	assert.Equal(t, gosum+"example.com/other v1.0.0 h1:other=\n", string(content))
+	assert.NoFileExists(t, depsFile)
+	require.NoError(t, removeDeps(executor))
+
+	// go.mod edited after inject, added modules are dropped by go get
+	require.NoError(t, addDeps(".", nil, mods, executor))
+	require.NoError(t, os.WriteFile("go.mod", []byte(executor.gomod+"require example.com/lib v1.0.0\n"), 0644))
+	executor.commands = nil
+	require.NoError(t, removeDeps(&executor.NullExecutor))
+	assert.Equal(t, [][]string{{"go", "get", "go.opentelemetry.io/otel@none"}}, executor.commands)
+}
+
+func TestAddDepsAfterGoModEdit(t *testing.T) {
+	chdir(t, t.TempDir())
+	gomod := "module example.com/app\n\ngo 1.19\n"
+	require.NoError(t, os.WriteFile("go.mod", []byte(gomod), 0644))
+	executor := &GoGetExecutor{gomod: gomod + "\nrequire go.opentelemetry.io/otel v1.18.0\n"}
+	require.NoError(t, addDeps(".", nil, []module.Version{{Path: "go.opentelemetry.io/otel", Version: "v1.18.0"}}, executor))
+
+	// go.mod edited between injects, edit of the first one is kept
+	edited := executor.gomod + "require example.com/lib v1.0.0\n"
+	require.NoError(t, os.WriteFile("go.mod", []byte(edited), 0644))
+	executor.gomod = edited + "require go.opentelemetry.io/otel/trace v1.18.0\n"
+	require.NoError(t, addDeps(".", nil, []module.Version{{Path: "go.opentelemetry.io/otel/trace", Version: "v1.18.0"}}, executor))
+	edits, err := readDepsEdits()
+	require.NoError(t, err)
+	require.Len(t, edits, 2)
+
+	// latest edit is restored, the first one is undone with go get
+	executor.commands = nil
+	require.NoError(t, removeDeps(&executor.NullExecutor))
+	assert.Equal(t, [][]string{{"go", "get", "go.opentelemetry.io/otel@none"}}, executor.commands)
+	content, err := os.ReadFile("go.mod")
+	require.NoError(t, err)
+	assert.Equal(t, edited, string(content))
+	assert.NoFileExists(t, depsFile)
+}
+
+func TestOtelVersion(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("..", "go.mod"))
+	require.NoError(t, err)
+	gomod, err := modfile.ParseLax("go.mod", content, nil)
+	require.NoError(t, err)
+	versions := make(map[string]string)
+	for _, req := range gomod.Require {
+		versions[req.Mod.Path] = req.Mod.Version
+	}
+	for _, mod := range rewriterDeps[basicRewriterName].modules {
+		if mod.Path != instrgenModule {
+			assert.Equal(t, versions[mod.Path], mod.Version, mod.Path)
+		}
+	}
+}
+
+func TestAddRemoveWorkspaceDeps(t *testing.T) {
+	chdir(t, t.TempDir())
+	gomod := "module example.com/lib\n\ngo 1.20\n"
+	require.NoError(t, os.MkdirAll("lib", 0755))
+	require.NoError(t, os.WriteFile(filepath.Join("lib", "go.mod"), []byte(gomod), 0644))
+	mods := []module.Version{{Path: "go.opentelemetry.io/otel", Version: "v1.18.0"}}
+	executor := &GoGetExecutor{
+		dir:   "lib",
+		gomod: gomod + "\nrequire go.opentelemetry.io/otel v1.18.0\n",
+		gosum: "go.opentelemetry.io/otel v1.18.0 h1:otel=\n",
+	}
+	require.NoError(t, addDeps("lib", nil, mods, executor))
+	assert.Equal(t, [][]string{{"go", "-C", "lib", "get", "go.opentelemetry.io/otel@v1.18.0"}}, executor.commands)
+	edits, err := readDepsEdits()
+	require.NoError(t, err)
+	require.Len(t, edits, 1)
+	assert.Equal(t, "lib", edits[0].Dir)
+
+	require.NoError(t, removeDeps(executor))
+	content, err := os.ReadFile(filepath.Join("lib", "go.mod"))
+	require.NoError(t, err)
+	assert.Equal(t, gomod, string(content))
+	assert.NoFileExists(t, filepath.Join("lib", "go.sum"))
+	assert.NoFileExists(t, depsFile)
+}
+
+func TestAddDepsUnknownVersion(t *testing.T) {
+	chdir(t, t.TempDir())
+	gomod := "module example.com/app\n\ngo 1.19\n"
+	require.NoError(t, os.WriteFile("go.mod", []byte(gomod), 0644))
+	// driver built with replaced instrgen module never queries latest release
+	mods := []module.Version{{Path: instrgenModule}}
+	executor := &NullExecutor{}
+	err := addDeps(".", nil, mods, executor)
+	assert.ErrorContains(t, err, "go.mod: "+instrgenModule+" is not required and its version is unknown")
+	assert.Empty(t, executor.commands)
+
+	// required already, nothing to add
+	require.NoError(t, os.WriteFile("go.mod", []byte(gomod+"\nrequire "+instrgenModule+" v0.0.0-00010101000000-000000000000\n"), 0644))
+	require.NoError(t, addDeps(".", nil, mods, executor))
+	assert.Empty(t, executor.commands)
+}
@@ -0,0 +1,130 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/token"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"golang.org/x/tools/go/packages"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+)
+
+// fileChange holds content of source file before and after rewriting.
+type fileChange struct {
+	// path of the file relative to project directory.
+	path string
+	old  []byte
+	new  []byte
+}
+
+// rewriteSource applies rewriters to single file the same way analyzePackage
+// does and returns the result, src when no rewriter changed it.
+func rewriteSource(rewriterS []alib.PackageRewriter, pkg string, filePath string, src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	result := rewriteChain(rewriterS, pkg, filePath, filePath, fset, src, nil)
+	if len(result.errs) > 0 {
+		return nil, result.errs[0]
+	}
+	if !result.changed {
+		return src, nil
+	}
+	return result.format(fset)
+}
+
+// collectChanges runs rewriters over project packages without
+// touching sources and returns files that would change, sorted by path.
+func collectChanges(root string, pkgs []*packages.Package, rewriterS []alib.PackageRewriter) ([]fileChange, error) {
+	var changes []fileChange
+	for _, pkg := range pkgs {
+		for _, filePath := range pkg.GoFiles {
+			rel, err := filepath.Rel(root, filePath)
+			if err != nil || !filepath.IsLocal(rel) {
+				continue
+			}
+			src, err := os.ReadFile(filePath)
+			if err != nil {
+				return nil, err
+			}
+			out, err := rewriteSource(rewriterS, pkg.PkgPath, filePath, src)
+			if err != nil {
+				// rewrite errors carry file position already
+				return nil, err
+			}
+			if !bytes.Equal(src, out) {
+				changes = append(changes, fileChange{path: filepath.ToSlash(rel), old: src, new: out})
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].path < changes[j].path
+	})
+	return changes, nil
+}
+
+// unifiedDiff returns change in unified diff format with git style file names.
+func (change fileChange) unifiedDiff() (string, error) {
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        splitLines(change.old),
+		B:        splitLines(change.new),
+		FromFile: "a/" + change.path,
+		ToFile:   "b/" + change.path,
+		Context:  3,
+	})
+}
+
+// splitLines splits content into lines keeping line endings.
+// Unlike difflib.SplitLines it adds no phantom line after the last one.
+func splitLines(content []byte) []string {
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// writeDiffs prints changes to w or, when patchDir is set,
+// writes one .patch file per changed source into patchDir.
+func writeDiffs(w io.Writer, changes []fileChange, patchDir string) error {
+	for _, change := range changes {
+		diff, err := change.unifiedDiff()
+		if err != nil {
+			return err
+		}
+		if patchDir == "" {
+			if _, err := io.WriteString(w, diff); err != nil {
+				return err
+			}
+			continue
+		}
+		patchPath := filepath.Join(patchDir, filepath.FromSlash(change.path)+".patch")
+		if err := os.MkdirAll(filepath.Dir(patchPath), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(patchPath, []byte(diff), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintln(w, patchPath)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	dir := writeModule(t)
+	// -C changes working directory of the test process
+	chdir(t, dir)
+	src, err := os.ReadFile(filepath.Join(dir, "main.go"))
+	require.NoError(t, err)
+	executor := &NullExecutor{}
+
+	err = driverMain([]string{"diff", "-C", dir}, executor)
+	var exitErr *exitError
+	require.True(t, errors.As(err, &exitErr), err)
+	assert.Equal(t, exitChanges, exitErr.code)
+	assert.EqualError(t, err, "diff: 1 files would change")
+	content, err := os.ReadFile(filepath.Join(dir, "main.go"))
+	require.NoError(t, err)
+	assert.Equal(t, src, content, "diff must not touch sources")
+	assert.Empty(t, executor.commands, "diff must not build the project")
+
+	patchDir := t.TempDir()
+	err = driverMain([]string{"diff", "-C", dir, "--patch-dir", patchDir}, executor)
+	require.True(t, errors.As(err, &exitErr), err)
+	patch, err := os.ReadFile(filepath.Join(patchDir, "main.go.patch"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(patch), "--- a/main.go\n+++ b/main.go\n@@ "), string(patch))
+	assert.Contains(t, string(patch), "+\t__atel_ts := rtlib.NewTracingState()\n")
+
+	err = driverMain([]string{"diff", "-C", dir, "--prune"}, executor)
+	require.NoError(t, err, "nothing to prune")
+}
+
+func TestCollectChanges(t *testing.T) {
+	dir := writeModule(t)
+	chdir(t, dir)
+	pkgs, err := LoadProgram(".", nil)
+	require.NoError(t, err)
+	cfg := defaultConfig()
+	cfg.Replace = true
+	changes, err := collectChanges(dir, pkgs, makeRewriters(InstrgenCmd{ProjectPath: dir, Cmd: "inject", Config: cfg}, nil))
+	require.NoError(t, err)
+	require.Len(t, changes, 1)
+	assert.Equal(t, "main.go", changes[0].path)
+
+	// pruning injected code removes all of it
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.go"), changes[0].new, 0644))
+	pruned, err := collectChanges(dir, pkgs, makeRewriters(InstrgenCmd{ProjectPath: dir, Cmd: "prune", Config: cfg}, nil))
+	require.NoError(t, err)
+	require.Len(t, pruned, 1)
+	assert.NotContains(t, string(pruned[0].new), "__atel_")
+	assert.Contains(t, string(pruned[0].new), "fmt.Println(\"app\")")
+
+	var out bytes.Buffer
+	require.NoError(t, writeDiffs(&out, pruned, ""))
+	assert.Contains(t, out.String(), "-\t__atel_ts := rtlib.NewTracingState()\n")
+}
+
+func TestSplitLines(t *testing.T) {
+	assert.Equal(t, []string{"a\n", "b\n"}, splitLines([]byte("a\nb\n")))
+	assert.Equal(t, []string{"a\n", "b"}, splitLines([]byte("a\nb")))
+	assert.Empty(t, splitLines(nil))
+}
@@ -0,0 +1,170 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+	"go.opentelemetry.io/contrib/instrgen/rewriters"
+)
+
+const directivesSource = `package main
+
+//instrgen:ignore
+func hot() {
+}
+
+// serve handles requests.
+//
+//instrgen:span name="GET /users" kind=server
+func serve() {
+}
+`
+
+func TestParseFuncDirectives(t *testing.T) {
+	for _, tc := range []struct {
+		doc        string
+		directives alib.FuncDirectives
+		err        string
+	}{
+		{doc: "// f does nothing.", directives: alib.FuncDirectives{}},
+		{doc: "//instrgen:ignore", directives: alib.FuncDirectives{Ignore: true}},
+		{doc: `//instrgen:span name="GET /users" kind=server`, directives: alib.FuncDirectives{Span: alib.SpanOptions{Name: "GET /users", Kind: "server"}}},
+		{doc: "//instrgen:span kind=client", directives: alib.FuncDirectives{Span: alib.SpanOptions{Kind: "client"}}},
+		{doc: "//instrgen:span kind=backend", err: `//instrgen:span: unknown span kind "backend", expected one of internal, server, client, producer, consumer`},
+		{doc: `//instrgen:span name="GET`, err: "//instrgen:span: option name: unterminated string"},
+		{doc: "//instrgen:span server", err: `//instrgen:span: option "server" is not key=value`},
+		{doc: "//instrgen:span color=red", err: "//instrgen:span: unknown option color"},
+		{doc: "//instrgen:ignore please", err: "//instrgen:ignore takes no options"},
+		{doc: "//instrgen:ignored", err: "unknown directive //instrgen:ignored"},
+	} {
+		file, err := parser.ParseFile(token.NewFileSet(), "f.go", "package p\n\n"+tc.doc+"\nfunc f() {}\n", parser.ParseComments)
+		require.NoError(t, err)
+		directives, comment, err := alib.ParseFuncDirectives(file.Decls[0].(*ast.FuncDecl))
+		if tc.err != "" {
+			assert.EqualError(t, err, tc.err, tc.doc)
+			assert.Equal(t, tc.doc, comment.Text)
+			continue
+		}
+		require.NoError(t, err, tc.doc)
+		assert.Equal(t, tc.directives, directives, tc.doc)
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	all := func(pkg string, filePath string) bool { return true }
+	injector := []alib.PackageRewriter{rewriters.BasicRewriter{Filter: all, Replace: "yes"}}
+	fset := token.NewFileSet()
+	result := rewriteChain(injector, "main", "main.go", "main.go", fset, []byte(directivesSource), nil)
+	require.True(t, result.ok())
+	assert.Equal(t, []string{"serve"}, result.reports[0].Functions)
+	content, err := result.format(fset)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "//instrgen:ignore\nfunc hot() {\n}\n")
+	assert.Contains(t, string(content), `__atel_otel.Tracer("serve").Start(__atel_tracing_ctx, "GET /users", __atel_trace.WithSpanKind(__atel_trace.SpanKindServer))`)
+
+	// pruning keeps directives
+	pruner := []alib.PackageRewriter{rewriters.OtelPruner{Filter: all, Replace: true}}
+	fset = token.NewFileSet()
+	result = rewriteChain(pruner, "main", "main.go", "main.go", fset, content, nil)
+	require.True(t, result.ok())
+	content, err = result.format(fset)
+	require.NoError(t, err)
+	assert.Equal(t, directivesSource, string(content))
+
+	// ignored files are left as they are
+	ignored := "//instrgen:ignore-file\n\n" + directivesSource
+	result = rewriteChain(injector, "main", "main.go", "main.go", token.NewFileSet(), []byte(ignored), nil)
+	assert.False(t, result.ok())
+	assert.Equal(t, reasonUnchanged, result.reports[0].Reason)
+
+	// malformed directives fail the file at their position
+	malformed := "package main\n\n//instrgen:span kind=backend\nfunc f() {\n}\n"
+	result = rewriteChain(injector, "main", "main.go", "main.go", token.NewFileSet(), []byte(malformed), nil)
+	require.Len(t, result.errs, 1)
+	assert.Equal(t, `main.go:3:1: instrgen Basic: //instrgen:span: unknown span kind "backend", expected one of internal, server, client, producer, consumer`,
+		result.errs[0].Error())
+}
+
+func TestPruneIgnoredInstrumentation(t *testing.T) {
+	all := func(pkg string, filePath string) bool { return true }
+	injector := []alib.PackageRewriter{rewriters.BasicRewriter{Filter: all, Replace: "yes"}}
+	pruner := []alib.PackageRewriter{rewriters.OtelPruner{Filter: all, Replace: true}}
+	for _, directive := range []string{"//instrgen:ignore\nfunc hot", "//instrgen:ignore-file\n\npackage main"} {
+		before, _, _ := strings.Cut(directive, "\n")
+		after := strings.TrimPrefix(directive, before+"\n")
+		after = strings.TrimPrefix(after, "\n")
+		src := strings.Replace(directivesSource, "//instrgen:ignore\n", "", 1)
+		fset := token.NewFileSet()
+		result := rewriteChain(injector, "main", "main.go", "main.go", fset, []byte(src), nil)
+		require.True(t, result.ok())
+		content, err := result.format(fset)
+		require.NoError(t, err)
+		require.Contains(t, string(content), "func hot() {\n\t__atel_tracing_ctx")
+
+		// code instrumented earlier and ignored since is pruned, directive stays
+		ignored := strings.Replace(string(content), after, directive, 1)
+		fset = token.NewFileSet()
+		result = rewriteChain(pruner, "main", "main.go", "main.go", fset, []byte(ignored), nil)
+		require.True(t, result.ok(), directive)
+		content, err = result.format(fset)
+		require.NoError(t, err)
+		assert.Equal(t, strings.Replace(src, after, directive, 1), string(content), directive)
+	}
+}
+
+func TestMalformedDirectiveRewrite(t *testing.T) {
+	all := func(pkg string, filePath string) bool { return true }
+	malformed := "//instrgen:span kind=backend\nfunc handle"
+	src := strings.Replace(logCallsSource, "func handle", malformed, 1)
+
+	// Rewrite leaves functions with malformed directives as they are
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "main.go", src, parser.ParseComments)
+	require.NoError(t, err)
+	assert.NotPanics(t, func() {
+		rewriters.BasicRewriter{Filter: all, Replace: "yes"}.Rewrite("main", file, fset, nil)
+	})
+	assert.Len(t, file.Decls[1].(*ast.FuncDecl).Body.List, 1)
+	assert.Greater(t, len(file.Decls[2].(*ast.FuncDecl).Body.List), 1)
+
+	logcalls := map[string]string{"main.go:11:2": "zap", "main.go:15:2": "zap"}
+	enricher := rewriters.LogCtxEnricher{Filter: all, Spans: all, Replace: "yes", LogCalls: logcalls}
+	fset = token.NewFileSet()
+	file, err = parser.ParseFile(fset, "main.go", src, parser.ParseComments)
+	require.NoError(t, err)
+	enricher.Rewrite("main", file, fset, nil)
+	handle := file.Decls[1].(*ast.FuncDecl).Body.List[0].(*ast.ExprStmt).X.(*ast.CallExpr)
+	plain := file.Decls[2].(*ast.FuncDecl).Body.List[0].(*ast.ExprStmt).X.(*ast.CallExpr)
+	assert.Len(t, handle.Args, 1)
+	assert.Len(t, plain.Args, 4)
+
+	// driver fails the file in both rewriters alike
+	for _, rewriter := range []alib.PackageRewriter{rewriters.BasicRewriter{Filter: all, Replace: "yes"}, enricher} {
+		result := rewriteChain([]alib.PackageRewriter{rewriter}, "main", "main.go", "main.go", token.NewFileSet(), []byte(src), nil)
+		require.Len(t, result.errs, 1, rewriter.Id())
+		assert.Contains(t, result.errs[0].Error(), `main.go:9:1: instrgen `+rewriter.Id()+`: //instrgen:span: unknown span kind "backend"`)
+	}
+}
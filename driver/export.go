@@ -0,0 +1,234 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/packages"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+)
+
+// Export runs rewriters over packages or files given explicitly and
+// writes instrumented sources into output directory, so build systems
+// other than go build, like Bazel with rules_go or Makefiles, can compile
+// them. Project packages keep their layout relative to the project
+// directory, standard library packages, like runtime rewritten by runtime
+// rewriter, are written in GOROOT layout under exportGoroot.
+
+const (
+	// exportGoroot holds exported standard library packages.
+	exportGoroot = "goroot"
+	// exportOverlayFile maps original sources to rewritten and generated
+	// ones, it can be passed to go build -overlay.
+	exportOverlayFile = "overlay.json"
+)
+
+// exportPatterns turns arguments of export into package patterns, Go
+// files are queried by file= patterns. It returns absolute paths of the
+// files given, nil when only packages are given.
+func exportPatterns(args []string) ([]string, map[string]bool, error) {
+	var patterns []string
+	var files map[string]bool
+	for _, arg := range args {
+		if !strings.HasSuffix(arg, ".go") {
+			patterns = append(patterns, arg)
+			continue
+		}
+		path, err := filepath.Abs(arg)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !alib.FileExists(path) {
+			return nil, nil, fmt.Errorf("%s: no such file", arg)
+		}
+		if files == nil {
+			files = make(map[string]bool)
+		}
+		files[path] = true
+		patterns = append(patterns, "file="+path)
+	}
+	if len(patterns) == 0 {
+		patterns = []string{"./..."}
+	}
+	return patterns, files, nil
+}
+
+// exporter writes instrumented packages into outDir.
+type exporter struct {
+	root      string
+	outDir    string
+	rewriterS []alib.PackageRewriter
+	// imports are added to packages selected by importsFilter,
+	// like writeImports does for go build.
+	imports       []string
+	importsFilter alib.FileFilter
+	strict        bool
+	// overlay collects rewritten and generated files.
+	overlay overlay
+	// rewritten counts files changed by rewriters.
+	rewritten int
+}
+
+// exportDir returns directory pkg is exported to.
+func (e *exporter) exportDir(pkg *packages.Package) (string, error) {
+	dir := filepath.Dir(pkg.GoFiles[0])
+	if rel, err := filepath.Rel(e.outDir, dir); err == nil && (filepath.IsLocal(rel) || rel == ".") {
+		return "", fmt.Errorf("package %s is within output directory", pkg.PkgPath)
+	}
+	if rel, err := filepath.Rel(e.root, dir); err == nil && (filepath.IsLocal(rel) || rel == ".") {
+		return filepath.Join(e.outDir, rel), nil
+	}
+	if isStandard(pkg.PkgPath) {
+		return filepath.Join(e.outDir, exportGoroot, "src", filepath.FromSlash(pkg.PkgPath)), nil
+	}
+	return "", fmt.Errorf("package %s is outside of project", pkg.PkgPath)
+}
+
+// exportPackage writes files of pkg, all of them when files is nil.
+// Files left unchanged by rewriters, other than Go files and files
+// excluded by build constraints are copied, so the exported package
+// is complete.
+func (e *exporter) exportPackage(pkg *packages.Package, files map[string]bool) error {
+	destDir, err := e.exportDir(pkg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	srcDir := filepath.Dir(pkg.GoFiles[0])
+	fset := token.NewFileSet()
+	appliedRewriters := make([]bool, len(e.rewriterS))
+	for _, filePath := range pkg.GoFiles {
+		if files != nil && !files[filePath] {
+			continue
+		}
+		destPath := filepath.Join(destDir, filepath.Base(filePath))
+		result := rewriteChain(e.rewriterS, pkg.PkgPath, filePath, filePath, fset, nil, nil)
+		for _, err := range result.errs {
+			if e.strict {
+				return err
+			}
+			logger.Warn(err.Error())
+		}
+		if !result.ok() {
+			if err := copyFile(filePath, destPath); err != nil {
+				return err
+			}
+			continue
+		}
+		content, err := result.format(fset)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filePath, err)
+		}
+		if err := writeFile(destPath, content); err != nil {
+			return err
+		}
+		e.overlay.Replace[filePath] = destPath
+		e.rewritten++
+		for r, applied := range result.applied {
+			appliedRewriters[r] = appliedRewriters[r] || applied
+		}
+	}
+	for r, rewriter := range e.rewriterS {
+		if !appliedRewriters[r] {
+			continue
+		}
+		for _, generated := range rewriter.WriteExtraFiles(pkg.PkgPath, destDir) {
+			e.overlay.Replace[filepath.Join(srcDir, filepath.Base(generated))] = generated
+		}
+	}
+	importsPath := filepath.Join(srcDir, importsFileName)
+	if len(e.imports) > 0 && e.importsFilter(pkg.PkgPath, pkg.GoFiles[0]) && !alib.FileExists(importsPath) {
+		destPath := filepath.Join(destDir, importsFileName)
+		if err := os.WriteFile(destPath, []byte(importsSource(pkg.Name, e.imports)), 0644); err != nil {
+			return err
+		}
+		e.overlay.Replace[importsPath] = destPath
+	}
+	if files != nil {
+		return nil
+	}
+	var others []string
+	others = append(others, pkg.OtherFiles...)
+	others = append(others, pkg.IgnoredFiles...)
+	others = append(others, pkg.EmbedFiles...)
+	for _, filePath := range others {
+		rel, err := filepath.Rel(srcDir, filePath)
+		if err != nil || !filepath.IsLocal(rel) {
+			continue
+		}
+		if err := copyFile(filePath, filepath.Join(destDir, rel)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeOverlay writes overlay of exported files into output directory.
+func (e *exporter) writeOverlay() error {
+	content, err := json.MarshalIndent(e.overlay, "", " ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(e.outDir, exportOverlayFile), content, 0644)
+}
+
+// copyFile copies src to dst keeping file mode, directories of dst
+// are created as needed.
+func copyFile(src string, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(dst, content, info.Mode().Perm())
+}
+
+// loadPackages loads packages matching patterns, without packages
+// they depend on.
+func loadPackages(tags []string, patterns []string) ([]*packages.Package, error) {
+	roots, err := packages.Load(packagesConfig(".", tags, nil), patterns...)
+	if err != nil {
+		return nil, err
+	}
+	// files of the same package load it once per file
+	loaded := make(map[string]bool)
+	var pkgs []*packages.Package
+	for _, pkg := range roots {
+		if !loaded[pkg.ID] {
+			loaded[pkg.ID] = true
+			pkgs = append(pkgs, pkg)
+		}
+	}
+	sort.Slice(pkgs, func(i, j int) bool {
+		return pkgs[i].PkgPath < pkgs[j].PkgPath
+	})
+	return pkgs, nil
+}
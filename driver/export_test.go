@@ -0,0 +1,122 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+)
+
+func TestExport(t *testing.T) {
+	dir := writeModule(t)
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "util"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "util", "util.go"), []byte("package util\n\nfunc Util() {}\n"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "util", "util_windows.go"), []byte("package util\n\nfunc Windows() {}\n"), 0644))
+	chdir(t, dir)
+	src, err := os.ReadFile(filepath.Join(dir, "main.go"))
+	require.NoError(t, err)
+	executor := &NullExecutor{}
+
+	err = driverMain([]string{"export", "-C", dir}, executor)
+	assert.EqualError(t, err, "export: missing output directory, set it with -o")
+
+	out := t.TempDir()
+	require.NoError(t, driverMain([]string{"export", "-C", dir, "-o", out}, executor))
+	content, err := os.ReadFile(filepath.Join(dir, "main.go"))
+	require.NoError(t, err)
+	assert.Equal(t, src, content, "export must not touch sources")
+	assert.Empty(t, executor.commands, "export must not build the project")
+
+	exported, err := os.ReadFile(filepath.Join(out, "main.go"))
+	require.NoError(t, err)
+	assert.Contains(t, string(exported), "__atel_ts := rtlib.NewTracingState()\n")
+	assert.FileExists(t, filepath.Join(out, importsFileName))
+	assert.FileExists(t, filepath.Join(out, "util", importsFileName))
+	// excluded by build constraints, copied as is
+	assert.FileExists(t, filepath.Join(out, "util", "util_windows.go"))
+
+	content, err = os.ReadFile(filepath.Join(out, exportOverlayFile))
+	require.NoError(t, err)
+	var files overlay
+	require.NoError(t, json.Unmarshal(content, &files))
+	assert.Equal(t, filepath.Join(out, "main.go"), files.Replace[filepath.Join(dir, "main.go")])
+	assert.Equal(t, filepath.Join(out, importsFileName), files.Replace[filepath.Join(dir, importsFileName)])
+
+	// files given explicitly are exported alone
+	out = t.TempDir()
+	require.NoError(t, driverMain([]string{"export", "-C", dir, "-o", out, "main.go"}, executor))
+	assert.FileExists(t, filepath.Join(out, "main.go"))
+	assert.NoDirExists(t, filepath.Join(out, "util"))
+
+	err = driverMain([]string{"export", "-C", dir, "-o", dir}, executor)
+	assert.ErrorContains(t, err, "export: package example.com/app is within output directory")
+}
+
+func TestExportRuntime(t *testing.T) {
+	dir := writeModule(t)
+	chdir(t, dir)
+	out := t.TempDir()
+	require.NoError(t, driverMain([]string{"export", "-o", out, "--rewriters", "runtime", "runtime"}, &NullExecutor{}))
+	runtimeDir := filepath.Join(out, exportGoroot, "src", "runtime")
+	content, err := os.ReadFile(filepath.Join(runtimeDir, "runtime2.go"))
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "_tls_instrgen")
+	assert.FileExists(t, filepath.Join(runtimeDir, "instrgen_tls.go"))
+	// package is complete, including assembly
+	assert.FileExists(t, filepath.Join(runtimeDir, "asm.s"))
+	assert.NoFileExists(t, filepath.Join(out, "main.go"), "only packages given are exported")
+}
+
+func TestExportFormatFailure(t *testing.T) {
+	dir := writeModule(t)
+	chdir(t, dir)
+	pkgs, err := LoadProgram(".", nil)
+	require.NoError(t, err)
+	// renamed function is printed as invalid source
+	e := &exporter{root: dir, outDir: t.TempDir(), rewriterS: []alib.PackageRewriter{RenamingRewriter{suffix: " x"}},
+		overlay: overlay{Replace: make(map[string]string)}}
+	err = e.exportPackage(pkgs[0], nil)
+	require.Error(t, err)
+	var rewriteErr *rewriteError
+	assert.False(t, errors.As(err, &rewriteErr), "format failure is not rewriter failure")
+	assert.Contains(t, err.Error(), filepath.Join(dir, "main.go")+": ")
+}
+
+func TestExportPatterns(t *testing.T) {
+	dir := writeModule(t)
+	chdir(t, dir)
+	patterns, files, err := exportPatterns(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"./..."}, patterns)
+	assert.Nil(t, files)
+
+	patterns, files, err = exportPatterns([]string{"./cmd/...", "main.go"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"./cmd/...", "file=" + filepath.Join(dir, "main.go")}, patterns)
+	assert.Equal(t, map[string]bool{filepath.Join(dir, "main.go"): true}, files)
+
+	_, _, err = exportPatterns([]string{"missing.go"})
+	assert.EqualError(t, err, "missing.go: no such file")
+}
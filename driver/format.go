@@ -0,0 +1,294 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/printer"
+	"go/token"
+	"reflect"
+	"sort"
+
+	"golang.org/x/tools/go/ast/astutil"
+)
+
+// go/printer lays code out and places comments by node positions, while
+// rewriters build nodes with made up ones. Rewritten files are printed
+// so sources rewritten in place read like hand written: statements and
+// expressions added by rewriters are printed on their own and put in place
+// of marker identifiers printed with the file, so comments of the file stay
+// with parsed nodes they belong to. Other added nodes get position of the
+// parsed token they follow. Lines left empty by removed nodes are merged,
+// so removed code leaves no gaps, and the result is formatted by gofmt.
+
+// parsedNodes holds nodes having positions of parsed source.
+type parsedNodes map[ast.Node]bool
+
+// collectParsedNodes returns all nodes of parsed file.
+func collectParsedNodes(file *ast.File) parsedNodes {
+	nodes := make(parsedNodes)
+	ast.Inspect(file, func(n ast.Node) bool {
+		if n != nil {
+			nodes[n] = true
+		}
+		return true
+	})
+	return nodes
+}
+
+// positionAdded moves nodes added by rewriters right after the parsed
+// token they follow, past comments trailing on its line.
+func positionAdded(fset *token.FileSet, file *ast.File, parsed parsedNodes) {
+	last := file.Package
+	var stack []ast.Node
+	ast.Inspect(file, func(n ast.Node) bool {
+		if n == nil {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if parsed[top] {
+				last = top.End()
+			}
+			return true
+		}
+		stack = append(stack, n)
+		if parsed[n] {
+			last = n.Pos()
+		} else {
+			setPositions(n, trailingEnd(fset, file, last))
+		}
+		return true
+	})
+}
+
+// trailingEnd returns end of comments following pos on its line, pos
+// when there are none.
+func trailingEnd(fset *token.FileSet, file *ast.File, pos token.Pos) token.Pos {
+	line := fset.Position(pos).Line
+	i := sort.Search(len(file.Comments), func(i int) bool {
+		return file.Comments[i].Pos() >= pos
+	})
+	for ; i < len(file.Comments) && fset.Position(file.Comments[i].Pos()).Line == line; i++ {
+		pos = file.Comments[i].End()
+	}
+	return pos
+}
+
+var posType = reflect.TypeOf(token.NoPos)
+
+// setPositions sets positions held by node to pos. Some positions tell
+// the printer what to print, like Ellipsis of call, invalid ones are kept
+// as they are.
+func setPositions(n ast.Node, pos token.Pos) {
+	v := reflect.ValueOf(n)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return
+	}
+	v = v.Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if field.Type() != posType || !field.CanSet() {
+			continue
+		}
+		if token.Pos(field.Int()).IsValid() || !isFlagPos(n, v.Type().Field(i).Name) {
+			field.SetInt(int64(pos))
+		}
+	}
+}
+
+// isFlagPos tells whether field of n is position telling the printer
+// whether to print a token.
+func isFlagPos(n ast.Node, field string) bool {
+	switch n.(type) {
+	case *ast.CallExpr:
+		return field == "Ellipsis"
+	case *ast.TypeSpec:
+		return field == "Assign"
+	case *ast.GenDecl:
+		return field == "Lparen" || field == "Rparen"
+	}
+	return false
+}
+
+// clearPositions clears positions of nodes added by rewriters, so they
+// are laid out as if written on one line.
+func clearPositions(root ast.Node, parsed parsedNodes) {
+	ast.Inspect(root, func(n ast.Node) bool {
+		if n == nil || parsed[n] {
+			return false
+		}
+		v := reflect.ValueOf(n)
+		if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+			return true
+		}
+		v = v.Elem()
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Field(i)
+			if field.Type() == posType && field.CanSet() && !isFlagPos(n, v.Type().Field(i).Name) {
+				field.SetInt(int64(token.NoPos))
+			}
+		}
+		return true
+	})
+}
+
+// markerPrefix starts names of marker identifiers.
+const markerPrefix = "__instrgen_marker_"
+
+// markAdded replaces statements and expressions added by rewriters with
+// markers and returns them by marker name. Added nodes which fields of
+// their parent cannot hold a marker are kept. restore puts them back.
+func markAdded(file *ast.File, parsed parsedNodes) (added map[string]ast.Node, restore func()) {
+	added = make(map[string]ast.Node)
+	markers := make(map[ast.Node]ast.Node)
+	astutil.Apply(file, func(c *astutil.Cursor) bool {
+		n := c.Node()
+		if n == nil || parsed[n] || c.Parent() == nil {
+			return true
+		}
+		name := fmt.Sprintf("%s%d_", markerPrefix, len(added))
+		var marker ast.Node
+		switch n.(type) {
+		case ast.Stmt:
+			marker = &ast.ExprStmt{X: ast.NewIdent(name)}
+		case ast.Expr:
+			marker = ast.NewIdent(name)
+		default:
+			return true
+		}
+		if !fits(c, marker) {
+			return true
+		}
+		added[name] = n
+		markers[marker] = n
+		c.Replace(marker)
+		return false
+	}, nil)
+	restore = func() {
+		astutil.Apply(file, func(c *astutil.Cursor) bool {
+			if n, ok := markers[c.Node()]; ok {
+				c.Replace(n)
+				return false
+			}
+			return true
+		}, nil)
+	}
+	return added, restore
+}
+
+// fits tells whether field of parent the cursor is at can hold n.
+func fits(c *astutil.Cursor, n ast.Node) bool {
+	field, ok := reflect.TypeOf(c.Parent()).Elem().FieldByName(c.Name())
+	if !ok {
+		return false
+	}
+	t := field.Type
+	if c.Index() >= 0 {
+		t = t.Elem()
+	}
+	return reflect.TypeOf(n).AssignableTo(t)
+}
+
+// lineSet collects line numbers.
+type lineSet map[int]bool
+
+func (lines lineSet) addRange(tf *token.File, pos token.Pos, end token.Pos) {
+	for line := tf.Line(pos); line <= tf.Line(end); line++ {
+		lines[line] = true
+	}
+}
+
+// printFileSet returns file set to print file with, lines holding only
+// parsed nodes removed by rewriters are merged with the following ones.
+// Positions of file stay valid, the file is added at its base.
+func printFileSet(fset *token.FileSet, file *ast.File, parsed parsedNodes) *token.FileSet {
+	tf := fset.File(file.Package)
+	if tf == nil {
+		return fset
+	}
+	inFile := func(n ast.Node) bool {
+		return n.Pos().IsValid() && n.End().IsValid() && tf.Base() <= int(n.Pos()) && int(n.End()) <= tf.Base()+tf.Size()
+	}
+	kept := make(lineSet)
+	present := make(map[ast.Node]bool)
+	ast.Inspect(file, func(n ast.Node) bool {
+		if n == nil || !parsed[n] || !inFile(n) {
+			return true
+		}
+		present[n] = true
+		kept[tf.Line(n.Pos())] = true
+		kept[tf.Line(n.End())] = true
+		// lines of raw strings
+		if _, ok := n.(*ast.BasicLit); ok {
+			kept.addRange(tf, n.Pos(), n.End())
+		}
+		return true
+	})
+	for _, group := range file.Comments {
+		if inFile(group) {
+			kept.addRange(tf, group.Pos(), group.End())
+		}
+	}
+	removed := make(lineSet)
+	for n := range parsed {
+		if !present[n] && inFile(n) {
+			removed.addRange(tf, n.Pos(), n.End())
+		}
+	}
+	var merged []int
+	for line := range removed {
+		if !kept[line] && line < tf.LineCount() {
+			merged = append(merged, line)
+		}
+	}
+	printFset := token.NewFileSet()
+	printFile := printFset.AddFile(tf.Name(), tf.Base(), tf.Size())
+	printFile.SetLines(tf.Lines())
+	// later lines first, so numbers of lines to merge do not change
+	sort.Sort(sort.Reverse(sort.IntSlice(merged)))
+	for _, line := range merged {
+		printFile.MergeLine(line)
+	}
+	return printFset
+}
+
+// gofmtConfig prints code like gofmt does.
+var gofmtConfig = printer.Config{Mode: printer.UseSpaces | printer.TabIndent, Tabwidth: 8}
+
+// formatFile prints rewritten file in gofmt style. parsed holds nodes
+// of the file as parsed, before rewriters changed it.
+func formatFile(fset *token.FileSet, file *ast.File, parsed parsedNodes) ([]byte, error) {
+	printFset := printFileSet(fset, file, parsed)
+	added, restore := markAdded(file, parsed)
+	defer restore()
+	positionAdded(fset, file, parsed)
+	var printed bytes.Buffer
+	if err := gofmtConfig.Fprint(&printed, printFset, file); err != nil {
+		return nil, err
+	}
+	content := printed.Bytes()
+	for name, n := range added {
+		clearPositions(n, parsed)
+		var text bytes.Buffer
+		if err := gofmtConfig.Fprint(&text, printFset, n); err != nil {
+			return nil, err
+		}
+		content = bytes.Replace(content, []byte(name), text.Bytes(), 1)
+	}
+	// gofmt indents added code and sorts imports
+	return format.Source(content)
+}
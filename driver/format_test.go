@@ -0,0 +1,149 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"go/format"
+	"go/token"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+	"go.opentelemetry.io/contrib/instrgen/rewriters"
+)
+
+const commentedSource = `package main
+
+import "fmt"
+
+func main() { // prints values
+	// values are empty
+	values := []int{}
+	fmt.Println(values, // of main
+		"values")
+}
+`
+
+func TestFormatFile(t *testing.T) {
+	fset := token.NewFileSet()
+	result := rewriteChain([]alib.PackageRewriter{PrintingRewriter{}}, "main", "/src/main.go", "/src/main.go", fset, []byte(commentedSource), nil)
+	require.True(t, result.ok())
+	content, err := result.format(fset)
+	require.NoError(t, err)
+	assert.Equal(t, `package main
+
+import "fmt"
+
+func main() { // prints values
+	println("instrumented")
+	// values are empty
+	values := []int{}
+	fmt.Println(values, // of main
+		"values")
+}
+`, string(content))
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	all := func(pkg string, filePath string) bool { return true }
+	for _, filePath := range []string{"testdata/basic/fib.go", "testdata/comments/main.go"} {
+		src, err := os.ReadFile(filePath)
+		require.NoError(t, err)
+
+		fset := token.NewFileSet()
+		injected := rewriteChain([]alib.PackageRewriter{rewriters.BasicRewriter{Filter: all, Replace: "yes"}}, "main", filePath, filePath, fset, src, nil)
+		require.True(t, injected.ok())
+		content, err := injected.format(fset)
+		require.NoError(t, err)
+
+		// source laid out other than gofmt would comes back formatted
+		fset = token.NewFileSet()
+		pruned := rewriteChain([]alib.PackageRewriter{rewriters.OtelPruner{Filter: all, Replace: true}}, "main", filePath, filePath, fset, content, nil)
+		require.True(t, pruned.ok())
+		content, err = pruned.format(fset)
+		require.NoError(t, err)
+		formatted, err := format.Source(src)
+		require.NoError(t, err)
+		assert.Equal(t, string(formatted), string(content), filePath)
+	}
+}
+
+func TestInjectIdempotent(t *testing.T) {
+	all := func(pkg string, filePath string) bool { return true }
+	rewriter := rewriters.BasicRewriter{Filter: all, Replace: "yes", EntryPoints: []alib.EntryPoint{{Pkg: "main", FunName: "main"}}}
+	for _, filePath := range []string{"testdata/basic/fib.go", "testdata/basic/main.go", "testdata/comments/main.go"} {
+		src, err := os.ReadFile(filePath)
+		require.NoError(t, err)
+		fset := token.NewFileSet()
+		injected := rewriteChain([]alib.PackageRewriter{rewriter}, "main", filePath, filePath, fset, src, nil)
+		require.True(t, injected.ok())
+		content, err := injected.format(fset)
+		require.NoError(t, err)
+
+		// prologues injected before are refreshed rather than stacked
+		fset = token.NewFileSet()
+		again := rewriteChain([]alib.PackageRewriter{rewriter}, "main", filePath, filePath, fset, content, nil)
+		assert.False(t, again.ok(), filePath)
+		assert.Equal(t, statusSkipped, again.reports[0].Status)
+		assert.Equal(t, reasonUnchanged, again.reports[0].Reason)
+		out, err := again.format(fset)
+		require.NoError(t, err)
+		assert.Equal(t, string(content), string(out), filePath)
+	}
+}
+
+const providerSource = `package main
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func setup(ctx context.Context, tp *sdktrace.TracerProvider) {
+	otel.SetTracerProvider(tp)
+	defer tp.Shutdown(ctx)
+	_ = ctx
+}
+`
+
+func TestInjectKeepsUserStatements(t *testing.T) {
+	all := func(pkg string, filePath string) bool { return true }
+	fset := token.NewFileSet()
+	injected := rewriteChain([]alib.PackageRewriter{rewriters.BasicRewriter{Filter: all, Replace: "yes"}}, "main", "main.go", "main.go", fset, []byte(providerSource), nil)
+	require.True(t, injected.ok())
+	content, err := injected.format(fset)
+	require.NoError(t, err)
+
+	// statements of the function itself follow the refreshed prologue
+	fset = token.NewFileSet()
+	again := rewriteChain([]alib.PackageRewriter{rewriters.BasicRewriter{Filter: all, Replace: "yes"}}, "main", "main.go", "main.go", fset, content, nil)
+	out, err := again.format(fset)
+	require.NoError(t, err)
+	assert.Equal(t, string(content), string(out))
+	assert.Contains(t, string(out), "\t_ = __atel_parent_span_id\n\totel.SetTracerProvider(tp)\n\tdefer tp.Shutdown(ctx)\n\t_ = ctx\n}\n")
+
+	fset = token.NewFileSet()
+	pruned := rewriteChain([]alib.PackageRewriter{rewriters.OtelPruner{Filter: all, Replace: true}}, "main", "main.go", "main.go", fset, content, nil)
+	require.True(t, pruned.ok())
+	out, err = pruned.format(fset)
+	require.NoError(t, err)
+	assert.Equal(t, providerSource, string(out))
+}
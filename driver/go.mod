@@ -1,18 +1,19 @@
 module go.opentelemetry.io/contrib/instrgen/driver
 
-go 1.19
+go 1.23.0
 
 replace go.opentelemetry.io/contrib/instrgen => ../
 
 require (
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/stretchr/testify v1.8.4
 	go.opentelemetry.io/contrib/instrgen v0.0.0-00010101000000-000000000000
-	golang.org/x/tools v0.13.0
+	golang.org/x/mod v0.25.0
+	golang.org/x/tools v0.34.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/sys v0.12.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	golang.org/x/sync v0.15.0 // indirect
 )
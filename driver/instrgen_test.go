@@ -19,13 +19,20 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"go/format"
+	"go/token"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/tools/go/packages"
 
 	alib "go.opentelemetry.io/contrib/instrgen/lib"
 	"go.opentelemetry.io/contrib/instrgen/rewriters"
@@ -34,57 +41,103 @@ import (
 var testcases = map[string]string{
 	"testdata/basic":     "testdata/expected/basic",
 	"testdata/interface": "testdata/expected/interface",
+	// comments in source laid out other than gofmt would
+	"testdata/comments": "testdata/expected/comments",
 }
 
 var failures []string
 
+var update = flag.Bool("update", false, "update expected files in testdata/expected")
+
+// instrgenRoot is resolved before tests change working directory.
+var instrgenRoot, _ = filepath.Abs("..")
+
+// copyTestdata copies testdata directories into temporary directory,
+// so rewriting done in place does not change the repository.
+func copyTestdata(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	for k := range testcases {
+		for _, file := range alib.SearchFiles(k, ".go") {
+			content, err := os.ReadFile(file)
+			require.NoError(t, err)
+			dest := filepath.Join(dir, file)
+			require.NoError(t, os.MkdirAll(filepath.Dir(dest), 0755))
+			require.NoError(t, os.WriteFile(dest, content, 0644))
+		}
+	}
+	return dir
+}
+
+// patternConfig returns config selecting files of testcase k.
+func patternConfig(k string) Config {
+	cfg := defaultConfig()
+	cfg.Include = []string{k + "/**"}
+	return cfg
+}
+
+// chdir changes working directory for the duration of the test.
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(dir))
+	t.Cleanup(func() {
+		require.NoError(t, os.Chdir(cwd))
+	})
+}
+
 func TestCommand(t *testing.T) {
 	executor := &NullExecutor{}
-	err := executeCommand("--unknown", "./testdata/basic", "testdata/basic", "yes", "main.main", executor)
+	err := executeCommand("unknown", "./testdata/basic", patternConfig("testdata/basic"), []string{"build"}, executor)
+	assert.Error(t, err)
+	err = executeCommand("inject", "./testdata/basic/main.go", patternConfig("testdata/basic"), []string{"build"}, executor)
 	assert.Error(t, err)
 }
 
 func TestInstrumentation(t *testing.T) {
 	cwd, _ := os.Getwd()
+	dir := copyTestdata(t)
 	var args []string
 	for k := range testcases {
 		filePaths := make(map[string]int)
 
-		files := alib.SearchFiles(k, ".go")
+		files := alib.SearchFiles(filepath.Join(dir, k), ".go")
 		for index, file := range files {
 			filePaths[file] = index
 		}
 		pruner := rewriters.OtelPruner{
-			FilePattern: k, Replace: true}
-		analyzePackage(pruner, "main", filePaths, nil, "", args)
+			Filter: patternConfig(k).filter(dir, "prune"), Replace: true}
+		analyzePackage([]alib.PackageRewriter{pruner}, "main", filePaths, nil, nil, "", args, make(map[string]string))
 
 		rewriter := rewriters.BasicRewriter{
-			FilePattern: k, Replace: "yes", Pkg: "main", Fun: "main"}
-		analyzePackage(rewriter, "main", filePaths, nil, "", args)
+			Filter: patternConfig(k).filter(dir, "basic"), Replace: "yes",
+			EntryPoints: []alib.EntryPoint{{Pkg: "main", FunName: "main"}}}
+		analyzePackage([]alib.PackageRewriter{rewriter}, "main", filePaths, nil, nil, "", args, make(map[string]string))
 	}
-	fmt.Println(cwd)
 
 	for k, v := range testcases {
-		files := alib.SearchFiles(cwd+"/"+k, ".go")
-		expectedFiles := alib.SearchFiles(cwd+"/"+v, ".go")
+		files := alib.SearchFiles(filepath.Join(dir, k), ".go")
+		expectedFiles := alib.SearchFiles(filepath.Join(cwd, v), ".go")
 		numOfFiles := len(expectedFiles)
-		fmt.Println("Go Files:", len(files))
-		fmt.Println("Expected Go Files:", len(expectedFiles))
 		assert.True(t, len(files) > 0)
 		numOfComparisons := 0
 		for _, file := range files {
-			fmt.Println(filepath.Base(file))
 			for _, expectedFile := range expectedFiles {
-				fmt.Println(filepath.Base(expectedFile))
 				if filepath.Base(file) == filepath.Base(expectedFile) {
-					fmt.Println(file, " : ", expectedFile)
 					f1, err1 := os.ReadFile(file)
 					require.NoError(t, err1)
+					if *update {
+						require.NoError(t, os.WriteFile(expectedFile, f1, 0644))
+					}
 					f2, err2 := os.ReadFile(expectedFile)
 					require.NoError(t, err2)
 					if !assert.True(t, bytes.Equal(f1, f2), file) {
 						failures = append(failures, file)
 					}
+					formatted, err := format.Source(f1)
+					require.NoError(t, err)
+					assert.Equal(t, string(formatted), string(f1), "%s is not gofmt-clean", file)
 					numOfComparisons = numOfComparisons + 1
 				}
 			}
@@ -97,49 +150,68 @@ func TestInstrumentation(t *testing.T) {
 }
 
 type NullExecutor struct {
+	// commands records executed commands.
+	commands [][]string
 }
 
-func (executor *NullExecutor) Execute(_ string, _ []string) {
+func (executor *NullExecutor) Execute(cmd string, args []string) {
+	executor.commands = append(executor.commands, append([]string{cmd}, args...))
 }
 
 func (executor *NullExecutor) Run() error {
 	return nil
 }
 
+// FailingExecutor records commands like NullExecutor and fails running them.
+type FailingExecutor struct {
+	NullExecutor
+	err error
+}
+
+func (executor *FailingExecutor) Run() error {
+	return executor.err
+}
+
 func TestToolExecMain(t *testing.T) {
+	dir := copyTestdata(t)
+	chdir(t, dir)
 	for k := range testcases {
 		var args []string
 		files := alib.SearchFiles(k, ".go")
 		args = append(args, []string{"-o", "/tmp/go-build", "-p", "main", "-pack", "-asmhdr", "go_asm.h"}...)
 		args = append(args, files...)
-		instrgenCfg := InstrgenCmd{FilePattern: k, Cmd: "prune", Replace: "yes",
-			EntryPoint: EntryPoint{Pkg: "main", FunName: "main"}}
-		rewriterS := makeRewriters(instrgenCfg)
-		analyze(args, rewriterS)
+		cfg := patternConfig(k)
+		cfg.Replace = true
+		instrgenCfg := InstrgenCmd{ProjectPath: dir, Cmd: "prune", Config: cfg}
+		remappedFilePaths := make(map[string]string)
+		rewriterS := makeRewriters(instrgenCfg, remappedFilePaths)
+		analyze(args, rewriterS, remappedFilePaths, nil)
 		instrgenCfg.Cmd = "inject"
-		rewriterS = makeRewriters(instrgenCfg)
-		analyze(args, rewriterS)
+		rewriterS = makeRewriters(instrgenCfg, remappedFilePaths)
+		analyze(args, rewriterS, remappedFilePaths, nil)
 	}
 	for k := range testcases {
 		var args []string
 		files := alib.SearchFiles(k, ".go")
-		args = append(args, []string{"-pack", "-asmhdr", "go_asm.h"}...)
+		args = append(args, []string{"-o", t.TempDir() + "/_pkg_.a", "-p", "main", "-pack", "-asmhdr", "go_asm.h"}...)
 		args = append(args, files...)
-		instrgenCfg := InstrgenCmd{FilePattern: k, Cmd: "prune", Replace: "no",
-			EntryPoint: EntryPoint{Pkg: "main", FunName: "main"}}
-		rewriterS := makeRewriters(instrgenCfg)
-		analyze(args, rewriterS)
+		instrgenCfg := InstrgenCmd{ProjectPath: dir, Cmd: "prune", Config: patternConfig(k)}
+		remappedFilePaths := make(map[string]string)
+		rewriterS := makeRewriters(instrgenCfg, remappedFilePaths)
+		analyze(args, rewriterS, remappedFilePaths, nil)
 		instrgenCfg.Cmd = "inject"
-		rewriterS = makeRewriters(instrgenCfg)
-		analyze(args, rewriterS)
+		rewriterS = makeRewriters(instrgenCfg, remappedFilePaths)
+		analyze(args, rewriterS, remappedFilePaths, nil)
 	}
 	for k := range testcases {
-		instrgenCfg := InstrgenCmd{FilePattern: k, Cmd: "prune", Replace: "yes",
-			EntryPoint: EntryPoint{Pkg: "main", FunName: "main"}}
-		rewriterS := makeRewriters(instrgenCfg)
+		cfg := patternConfig(k)
+		cfg.Replace = true
+		instrgenCfg := InstrgenCmd{ProjectPath: dir, Cmd: "prune", Config: cfg}
+		remappedFilePaths := make(map[string]string)
+		rewriterS := makeRewriters(instrgenCfg, remappedFilePaths)
 		var args []string
 		executor := &NullExecutor{}
-		err := toolExecMain(args, rewriterS, executor)
+		err := toolExecMain(args, rewriterS, executor, remappedFilePaths, nil, false)
 		assert.Error(t, err)
 	}
 }
@@ -158,55 +230,316 @@ func TestExecutePass(t *testing.T) {
 	require.NoError(t, executePass([]string{"go", "version"}, executor))
 }
 
+func TestParseEntryPoint(t *testing.T) {
+	entry, err := parseEntryPoint("main.main")
+	require.NoError(t, err)
+	assert.Equal(t, alib.EntryPoint{Pkg: "main", FunName: "main"}, entry)
+	entry, err = parseEntryPoint("example.com/app/cmd.Run")
+	require.NoError(t, err)
+	assert.Equal(t, alib.EntryPoint{Pkg: "example.com/app/cmd", FunName: "Run"}, entry)
+	for _, bad := range []string{"", "main", ".main", "main."} {
+		_, err = parseEntryPoint(bad)
+		assert.ErrorContains(t, err, "entry point", bad)
+	}
+}
+
+func TestMultipleEntryPoints(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module example.com/app\n"), 0644))
+	sources := map[string]string{
+		"cmd/server/main.go": "package main\n\nfunc main() {\n}\n",
+		"cmd/client/main.go": "package main\n\nfunc main() {\n}\n",
+		"worker/main.go":     "package main\n\nfunc main() {\n}\n\nfunc Run() {\n}\n",
+		"tool/main.go":       "package main\n\nfunc main() {\n}\n",
+	}
+	for name, src := range sources {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(src), 0644))
+	}
+	cfg := defaultConfig()
+	cfg.Replace = true
+	cfg.EntryPoints = []string{"*/cmd/*.main", "example.com/app/worker.Run"}
+	module, err := findModule(dir)
+	require.NoError(t, err)
+	instrgenCfg := InstrgenCmd{ProjectPath: dir, Modules: []Module{module}, Cmd: "inject", Config: cfg}
+	for name := range sources {
+		args := []string{"-p", "main", "-pack", filepath.Join(dir, name)}
+		remappedFilePaths := make(map[string]string)
+		analyze(args, makeRewriters(instrgenCfg, remappedFilePaths), remappedFilePaths, instrgenCfg.Modules)
+	}
+	read := func(name string) string {
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		return string(content)
+	}
+	assert.Contains(t, read("cmd/server/main.go"), "rtlib.NewTracingState()")
+	assert.Contains(t, read("cmd/client/main.go"), "rtlib.NewTracingState()")
+	assert.Equal(t, 1, strings.Count(read("worker/main.go"), "rtlib.NewTracingState()"))
+	assert.Contains(t, read("worker/main.go"), `__atel_otel.Tracer("main").Start(__atel_tracing_ctx, "main")`)
+	assert.NotContains(t, read("tool/main.go"), "rtlib.NewTracingState()")
+}
+
+func TestLoadProgram(t *testing.T) {
+	dir := t.TempDir()
+	sources := map[string]string{
+		"go.mod":         "module example.com/app\n\ngo 1.19\n",
+		"main.go":        "package main\n\nimport (\n\t\"example.com/app/broken\"\n\t\"example.com/app/lib\"\n)\n\nfunc main() {\n\tlib.Hello()\n\tbroken.Run()\n}\n",
+		"lib/lib.go":     "package lib\n\nfunc Hello() {\n}\n",
+		"lib/extra.go":   "//go:build extra\n\npackage lib\n\nfunc Extra() {\n}\n",
+		"broken/run.go":  "package broken\n\nfunc Run() {\n\tundefined()\n}\n",
+		"unused/main.go": "package unused\n",
+	}
+	for name, src := range sources {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(src), 0644))
+	}
+	pkgPaths := func(pkgs []*packages.Package) []string {
+		var paths []string
+		for _, pkg := range pkgs {
+			paths = append(paths, pkg.PkgPath)
+		}
+		return paths
+	}
+	pkgs, err := LoadProgram(dir, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com/app", "example.com/app/broken", "example.com/app/lib"}, pkgPaths(pkgs))
+	assert.Len(t, pkgs[2].GoFiles, 1)
+	errs := loadErrors(pkgs)
+	require.Len(t, errs, 1)
+	assert.Contains(t, errs[0].Error(), "example.com/app/broken: ")
+	assert.Contains(t, errs[0].Error(), "undefined")
+	assert.NotNil(t, pkgs[0].TypesInfo)
+
+	pkgs, err = LoadProgram(dir, []string{"extra"})
+	require.NoError(t, err)
+	assert.Len(t, pkgs[2].GoFiles, 2)
+}
+
+func TestGoCommands(t *testing.T) {
+	dir := writeModule(t)
+	chdir(t, dir)
+	self, err := executable()
+	require.NoError(t, err)
+	overlayPath := filepath.Join(dir, overlayFile)
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"build", "--tags", "extra", "--", "-o", "bin/app", "-race", "./..."},
+			[]string{"go", "build", "-work", "-tags", "extra", "-overlay", overlayPath, "-toolexec", self, "-o", "bin/app", "-race", "./..."}},
+		{[]string{"build"},
+			[]string{"go", "build", "-work", "-overlay", overlayPath, "-toolexec", self}},
+		{[]string{"test", "--", "-run", "TestApp", "./..."},
+			[]string{"go", "test", "-work", "-overlay", overlayPath, "-toolexec", self, "-run", "TestApp", "./..."}},
+		{[]string{"run", "--", ".", "--port", "8080"},
+			[]string{"go", "run", "-work", "-overlay", overlayPath, "-toolexec", self, ".", "--port", "8080"}},
+	}
+	for _, test := range tests {
+		executor := &NullExecutor{}
+		require.NoError(t, driverMain(test.args, executor), test.args)
+		assert.Equal(t, test.want, executor.commands[len(executor.commands)-1])
+		content, err := os.ReadFile(cmdFile)
+		require.NoError(t, err)
+		var instrgenCfg InstrgenCmd
+		require.NoError(t, json.Unmarshal(content, &instrgenCfg))
+		assert.Equal(t, "inject", instrgenCfg.Cmd)
+	}
+
+	// import file is added through overlay, project sources stay untouched
+	assert.NoFileExists(t, filepath.Join(dir, importsFileName))
+	content, err := os.ReadFile(overlayFile)
+	require.NoError(t, err)
+	var imports overlay
+	require.NoError(t, json.Unmarshal(content, &imports))
+	importsPath := filepath.Join(dir, importsDir, importsFileName)
+	assert.Equal(t, map[string]string{filepath.Join(dir, importsFileName): importsPath}, imports.Replace)
+	assert.FileExists(t, importsPath)
+
+	require.NoError(t, driverMain([]string{"clean"}, &NullExecutor{}))
+	assert.NoDirExists(t, filepath.Join(dir, workDir))
+	require.NoError(t, driverMain([]string{"clean"}, &NullExecutor{}))
+
+	// modules needed by instrumentation are required already, only go test runs
+	_, mods := requiredDeps(defaultRewriters)
+	gomod := "module example.com/app\n\ngo 1.19\n\n"
+	for _, mod := range mods {
+		gomod += "require " + mod.Path + " v1.18.0\n"
+	}
+	require.NoError(t, os.WriteFile("go.mod", []byte(gomod), 0644))
+	goErr := exec.Command("sh", "-c", "exit 3").Run()
+	err = driverMain([]string{"test", "--", "./..."}, &FailingExecutor{err: goErr})
+	var exitErr *exitError
+	require.True(t, errors.As(err, &exitErr), err)
+	assert.Equal(t, 3, exitErr.code)
+	assert.EqualError(t, err, "test: go test failed")
+}
+
+// writeModule creates minimal go module with single main package.
+func writeModule(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	// the test binary is built with instrgen module replaced, its version is unknown
+	gomod := "module example.com/app\n\ngo 1.19\n\nrequire " + instrgenModule + " v0.0.0-00010101000000-000000000000\n\n" +
+		"replace " + instrgenModule + " => " + instrgenRoot + "\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte(gomod), 0644))
+	src := "package main\n\nimport \"fmt\"\n\nfunc main() {\n\tfmt.Println(\"app\")\n}\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "main.go"), []byte(src), 0644))
+	return dir
+}
+
 func TestDriverMain(t *testing.T) {
 	executor := &NullExecutor{}
 	{
-		err := os.Remove("instrgen_cmd.json")
-		_ = err
-		var args []string
-		args = append(args, "compile")
-		err = driverMain(args, executor)
+		chdir(t, t.TempDir())
+		err := driverMain([]string{"/usr/local/go/pkg/tool/compile"}, executor)
 		require.Error(t, err)
 	}
+	chdir(t, copyTestdata(t))
 	for k := range testcases {
 		var args []string
 		files := alib.SearchFiles(k, ".go")
-		args = append(args, []string{"-o", "/tmp/go-build", "-p", "main", "-pack", "-asmhdr", "go_asm.h"}...)
+		args = append(args, []string{"/usr/local/go/pkg/tool/asm", "-o", "/tmp/go-build", "-p", "main", "-pack", "-asmhdr", "go_asm.h"}...)
 		args = append(args, files...)
-		instrgenCfg := InstrgenCmd{FilePattern: k, Cmd: "prune", Replace: "yes",
-			EntryPoint: EntryPoint{Pkg: "main", FunName: "main"}}
 		err := driverMain(args, executor)
 		assert.NoError(t, err)
-		instrgenCfg.Cmd = "inject"
-		err = driverMain(args, executor)
-		assert.NoError(t, err)
 	}
 	{
-		var args []string
-		args = append(args, "compile")
-		instrgenCfg := InstrgenCmd{FilePattern: "/testdata/basic", Cmd: "inject", Replace: "yes",
-			EntryPoint: EntryPoint{Pkg: "main", FunName: "main"}}
+		cfg := patternConfig("testdata/basic")
+		cfg.Replace = true
+		version, err := driverVersion()
+		require.NoError(t, err)
+		instrgenCfg := InstrgenCmd{ProjectPath: ".", Cmd: "inject", Config: cfg, Version: version}
 		file, _ := json.MarshalIndent(instrgenCfg, "", " ")
-		err := os.WriteFile("instrgen_cmd.json", file, 0644)
+		require.NoError(t, makeWorkDir())
+		err = os.WriteFile(cmdFile, file, 0644)
 		require.NoError(t, err)
-		err = driverMain(args, executor)
+		err = driverMain([]string{"/usr/local/go/pkg/tool/compile"}, executor)
 		require.NoError(t, err)
+
+		// command written by another instrgen binary is rejected
+		instrgenCfg.Version = "v0.0.1+0123456789abcdef"
+		instrgenCfg.Toolexec = "/usr/local/bin/driver"
+		file, _ = json.MarshalIndent(instrgenCfg, "", " ")
+		require.NoError(t, os.WriteFile(cmdFile, file, 0644))
+		err = driverMain([]string{"/usr/local/go/pkg/tool/compile"}, executor)
+		assert.ErrorContains(t, err, "written by /usr/local/bin/driver (v0.0.1+0123456789abcdef)")
 	}
-	for k := range testcases {
-		var args []string
-		args = append(args, []string{"--inject", k, "yes", "main.main"}...)
-		err := driverMain(args, executor)
-		assert.NoError(t, err)
+	{
+		dir := writeModule(t)
+		err := driverMain([]string{"inject", "-C", dir, "--pattern", "app", "--replace", "--entry", "main.main"}, executor)
+		require.NoError(t, err)
+		content, err := os.ReadFile(filepath.Join(dir, cmdFile))
+		require.NoError(t, err)
+		var instrgenCfg InstrgenCmd
+		require.NoError(t, json.Unmarshal(content, &instrgenCfg))
+		projectPath, err := os.Getwd()
+		require.NoError(t, err)
+		cfg := defaultConfig()
+		cfg.Include = []string{"**app**"}
+		cfg.Replace = true
+		version, err := driverVersion()
+		require.NoError(t, err)
+		self, err := executable()
+		require.NoError(t, err)
+		assert.Equal(t, InstrgenCmd{ProjectPath: projectPath, Modules: []Module{{Path: "example.com/app", Dir: projectPath}},
+			Cmd: "inject", Config: cfg, Version: version, Toolexec: self}, instrgenCfg)
 	}
 	{
-		var args []string
-		args = append(args, "--inject")
-		err := driverMain(args, executor)
-		assert.Error(t, err)
+		dir := writeModule(t)
+		executor := &NullExecutor{}
+		err := driverMain([]string{"inject", "-C", dir, "--tags", "extra,netgo"}, executor)
+		require.NoError(t, err)
+		self, err := executable()
+		require.NoError(t, err)
+		assert.Equal(t, []string{"go", "build", "-work", "-tags", "extra,netgo", "-overlay", filepath.Join(dir, overlayFile), "-toolexec", self},
+			executor.commands[len(executor.commands)-1])
 	}
 	{
-		var args []string
-		err := driverMain(args, executor)
-		assert.NoError(t, err)
+		dir := writeModule(t)
+		err := driverMain([]string{"prune", "-C", dir, "--pattern", "app"}, executor)
+		require.NoError(t, err)
+	}
+	{
+		err := driverMain([]string{"inject", "--pattern", ""}, executor)
+		assert.ErrorContains(t, err, "--pattern")
+		err = driverMain([]string{"inject", "--pattern", "app", "--entry", "main.main,main"}, executor)
+		assert.ErrorContains(t, err, `--entry: invalid entry point "main"`)
+		err = driverMain([]string{"inject", "--pattern", "app", "--entry", ""}, executor)
+		assert.ErrorContains(t, err, "--entry")
+		err = driverMain([]string{"inject", "-C", "/nonexistent", "--pattern", "app"}, executor)
+		assert.ErrorContains(t, err, "-C")
+		err = driverMain([]string{"version", "extra"}, executor)
+		assert.ErrorContains(t, err, `"extra"`)
+		err = driverMain([]string{"prune", "--pattern", "app", "extra"}, executor)
+		assert.ErrorContains(t, err, `"extra"`)
+		err = driverMain([]string{"--inject"}, executor)
+		assert.ErrorContains(t, err, `"--inject"`)
 	}
+	{
+		assert.NoError(t, driverMain([]string{"help", "inject"}, executor))
+		assert.NoError(t, driverMain([]string{"prune", "-h"}, executor))
+		assert.Error(t, driverMain(nil, executor))
+	}
+}
+
+func TestReadLine(t *testing.T) {
+	dir := t.TempDir()
+	// work directory removed by clean holds no log calls
+	logcalls, err := readLine(filepath.Join(dir, "logcalls"))
+	require.NoError(t, err)
+	assert.Empty(t, logcalls)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "logcalls"), []byte("zap /src/main.go:7:2\n"), 0644))
+	logcalls, err = readLine(filepath.Join(dir, "logcalls"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"/src/main.go:7:2": "zap"}, logcalls)
+}
+
+const logCallsSource = `package main
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+)
+
+func handle(ctx context.Context, logger *zap.Logger) {
+	logger.Info("handled")
+}
+
+func plain(logger *zap.Logger) {
+	logger.Info("plain")
+}
+`
+
+func TestLogCtxWithoutBasic(t *testing.T) {
+	all := func(pkg string, filePath string) bool { return true }
+	logcalls := map[string]string{"main.go:10:2": "zap", "main.go:14:2": "zap"}
+	enricher := rewriters.LogCtxEnricher{Filter: all, Replace: "yes", LogCalls: logcalls}
+	fset := token.NewFileSet()
+	result := rewriteChain([]alib.PackageRewriter{enricher}, "main", "main.go", "main.go", fset, []byte(logCallsSource), nil)
+	require.True(t, result.ok())
+	content, err := result.format(fset)
+	require.NoError(t, err)
+	// span context comes from context parameter, functions without one are left as they are
+	enriched := `logger.Info("handled", zap.String("trace_id", __atel_spanCtx.TraceID().String()), ` +
+		`zap.String("span_id", __atel_spanCtx.SpanID().String()), zap.String("parent_span_id", __atel_parent_span_id))`
+	want := strings.NewReplacer(
+		"\t\"context\"\n\n", "\t\"context\"\n\n\t__atel_trace \"go.opentelemetry.io/otel/trace\"\n",
+		"\tlogger.Info(\"handled\")", "\t__atel_spanCtx := __atel_trace.SpanContextFromContext(ctx)\n\t_ = __atel_spanCtx\n"+
+			"\t__atel_parent_span_id := \"\"\n\t_ = __atel_parent_span_id\n\t"+enriched,
+	).Replace(logCallsSource)
+	assert.Equal(t, want, string(content))
+
+	// functions with span of basic refer to span context it declares
+	enricher.Spans = all
+	fset = token.NewFileSet()
+	result = rewriteChain([]alib.PackageRewriter{enricher}, "main", "main.go", "main.go", fset, []byte(logCallsSource), nil)
+	require.True(t, result.ok())
+	content, err = result.format(fset)
+	require.NoError(t, err)
+	assert.NotContains(t, string(content), "SpanContextFromContext")
+	assert.Contains(t, string(content), "\t"+enriched+"\n")
+	assert.Contains(t, string(content), `logger.Info("plain", zap.String("trace_id", __atel_spanCtx.TraceID().String())`)
 }
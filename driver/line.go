@@ -0,0 +1,149 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"reflect"
+	"strings"
+)
+
+// Files rewritten into compiler output directory carry //line directives,
+// so the compiler attributes their code to the original file and lines,
+// see go doc cmd/compile. Panics, pprof and runtime.Caller then report
+// positions in project sources. Statements, declarations and specs of the
+// original file map to their own lines, code added by rewriters maps to
+// the line of the enclosing original node, like the function it
+// instruments. Rewriters set arbitrary positions on added nodes, so nodes
+// are told apart by identity rather than by their positions. Files returned
+// by plugins are parsed anew, only their file name is mapped.
+
+// sourceNodes holds statements, declarations and specs of parsed file.
+type sourceNodes map[ast.Node]bool
+
+// isLineNode tells whether n starts line of code mapped by directives.
+func isLineNode(n ast.Node) bool {
+	switch n.(type) {
+	case ast.Stmt, ast.Decl, ast.Spec:
+		return true
+	}
+	return false
+}
+
+// collectSourceNodes returns line nodes of file as parsed.
+func collectSourceNodes(file *ast.File) sourceNodes {
+	nodes := make(sourceNodes)
+	ast.Inspect(file, func(n ast.Node) bool {
+		if n != nil && isLineNode(n) {
+			nodes[n] = true
+		}
+		return true
+	})
+	return nodes
+}
+
+// lineNode is line node along with line of original file it maps to,
+// zero when it has no original node enclosing it.
+type lineNode struct {
+	node ast.Node
+	line int
+}
+
+// mapLineNodes returns line nodes of rewritten file in depth first order.
+func mapLineNodes(fset *token.FileSet, file *ast.File, source sourceNodes) []lineNode {
+	var nodes []lineNode
+	var lines []int
+	ast.Inspect(file, func(n ast.Node) bool {
+		if n == nil {
+			lines = lines[:len(lines)-1]
+			return true
+		}
+		line := 0
+		if len(lines) > 0 {
+			line = lines[len(lines)-1]
+		}
+		if source[n] {
+			line = fset.Position(n.Pos()).Line
+		}
+		lines = append(lines, line)
+		if isLineNode(n) {
+			nodes = append(nodes, lineNode{node: n, line: line})
+		}
+		return true
+	})
+	return nodes
+}
+
+// addLineDirectives adds //line directives to printed source of file
+// rewritten from srcPath. Printed source is parsed again to find lines
+// line nodes were printed at, both trees have the same shape.
+func addLineDirectives(printed []byte, srcPath string, fset *token.FileSet, file *ast.File, source sourceNodes) ([]byte, error) {
+	printedFset := token.NewFileSet()
+	reparsed, err := parser.ParseFile(printedFset, srcPath, printed, parser.SkipObjectResolution)
+	if err != nil {
+		return nil, err
+	}
+	mapped := mapLineNodes(printedFset, reparsed, nil)
+	rewritten := mapLineNodes(fset, file, source)
+	if len(mapped) != len(rewritten) {
+		return nil, errors.New("printed file does not match its syntax tree")
+	}
+	lines := splitLines(printed)
+	// source lines of printed lines starting with line node
+	want := make(map[int]int)
+	for i, node := range rewritten {
+		if reflect.TypeOf(node.node) != reflect.TypeOf(mapped[i].node) {
+			return nil, errors.New("printed file does not match its syntax tree")
+		}
+		pos := printedFset.Position(mapped[i].node.Pos())
+		if node.line == 0 || want[pos.Line] != 0 {
+			continue
+		}
+		// directive goes on its own line, before the first token of the line
+		text := lines[pos.Line-1]
+		if pos.Column != len(text)-len(strings.TrimLeft(text, " \t"))+1 {
+			continue
+		}
+		want[pos.Line] = node.line
+	}
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "//line %s:1\n", srcPath)
+	next := 1
+	for i, text := range lines {
+		if line, ok := want[i+1]; ok && line != next {
+			fmt.Fprintf(&out, "//line %s:%d\n", srcPath, line)
+			next = line
+		}
+		out.WriteString(text)
+		next++
+	}
+	return out.Bytes(), nil
+}
+
+// lineDirectives returns content of file rewritten from srcPath with
+// //line directives, content as is when they cannot be added.
+func lineDirectives(content []byte, srcPath string, fset *token.FileSet, file *ast.File, source sourceNodes) []byte {
+	mapped, err := addLineDirectives(content, srcPath, fset, file, source)
+	if err != nil {
+		logger.Debug("no line directives", "file", srcPath, "error", err)
+		return content
+	}
+	return mapped
+}
@@ -0,0 +1,121 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+)
+
+// PrintingRewriter adds print statement at the beginning of every
+// function, with made up position like built-in rewriters set.
+type PrintingRewriter struct{}
+
+func (PrintingRewriter) Id() string { return "Printing" }
+
+func (PrintingRewriter) Inject(pkg string, filepath string) bool { return true }
+
+func (PrintingRewriter) ReplaceSource(pkg string, filePath string) bool { return false }
+
+func (PrintingRewriter) Rewrite(pkg string, file *ast.File, fset *token.FileSet, trace *os.File) {
+	ast.Inspect(file, func(n ast.Node) bool {
+		if funcDecl, ok := n.(*ast.FuncDecl); ok && funcDecl.Body != nil {
+			stmt := &ast.ExprStmt{X: &ast.CallExpr{Fun: ast.NewIdent("println"), Lparen: 27,
+				Args: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: `"instrumented"`}}}}
+			funcDecl.Body.List = append([]ast.Stmt{stmt}, funcDecl.Body.List...)
+		}
+		return true
+	})
+}
+
+func (PrintingRewriter) WriteExtraFiles(pkg string, destPath string) []string { return nil }
+
+const panickingSource = `package main
+
+import "fmt"
+
+// main panics on line 10.
+func main() {
+	values := []int{}
+	fmt.Println(len(values),
+		"values")
+	fmt.Println(values[1])
+}
+`
+
+func TestAddLineDirectives(t *testing.T) {
+	fset := token.NewFileSet()
+	result := rewriteChain([]alib.PackageRewriter{PrintingRewriter{}}, "main", "/src/main.go", "/src/main.go", fset, []byte(panickingSource), nil)
+	require.True(t, result.ok())
+	var printed bytes.Buffer
+	require.NoError(t, printer.Fprint(&printed, fset, result.file))
+
+	content, err := addLineDirectives(printed.Bytes(), "/src/main.go", fset, result.file, result.source)
+	require.NoError(t, err)
+	assert.Equal(t, `//line /src/main.go:1
+package main
+
+import "fmt"
+
+// main panics on line 10.
+func main() {
+//line /src/main.go:6
+	println("instrumented")
+
+//line /src/main.go:7
+	values := []int{}
+	fmt.Println(len(values),
+		"values")
+	fmt.Println(values[1])
+}
+`, string(content))
+
+	// nodes added by plugins have no original lines
+	content, err = addLineDirectives(printed.Bytes(), "/src/main.go", fset, result.file, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "//line /src/main.go:1\n"+printed.String(), string(content))
+}
+
+func TestLineDirectivesPanic(t *testing.T) {
+	dir := t.TempDir()
+	destPath := t.TempDir()
+	filePath := filepath.Join(dir, "main.go")
+	require.NoError(t, os.WriteFile(filePath, []byte(panickingSource), 0644))
+	args := []string{"/usr/local/go/pkg/tool/compile", "-o", filepath.Join(destPath, "_pkg_.a"), "-p", "main", "-pack", filePath}
+	args, errs := analyzePackage([]alib.PackageRewriter{PrintingRewriter{}}, "main", map[string]int{filePath: 6}, nil, nil, destPath, args, make(map[string]string))
+	require.Empty(t, errs)
+	require.Equal(t, filepath.Join(destPath, "main.go"), args[6])
+
+	cmd := exec.Command("go", "run", args[6])
+	cmd.Dir = destPath
+	cmd.Env = append(os.Environ(), "GOFLAGS=", "GO111MODULE=off")
+	out, err := cmd.CombinedOutput()
+	require.Error(t, err)
+	assert.Contains(t, string(out), "instrumented\n")
+	assert.Contains(t, string(out), "main.main()\n\t"+filePath+":10 ")
+}
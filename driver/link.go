@@ -0,0 +1,108 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Instrumented binaries are linked with build metadata set in rtlib
+// variables by -X flags, rtlib reports it as resource attributes. Link
+// tool ID is extended with fingerprint of the metadata like compiler ID
+// is, so binaries are linked again whenever the metadata changes, while
+// compiled packages stay cached across VCS revisions.
+
+const (
+	// linkFile holds metadata of the last inject build.
+	linkFile = workDir + "/link.json"
+	// rtlibPackage receives metadata.
+	rtlibPackage = instrgenModule + "/rtlib"
+)
+
+// linkMetadata holds values set in rtlib when linking instrumented binaries.
+type linkMetadata struct {
+	// Version of instrgen which instrumented the binary.
+	Version string `json:"version"`
+	// ConfigHash is fingerprint of command file, it identifies
+	// rewriter config and instrgen binary.
+	ConfigHash string `json:"config_hash"`
+	// Revision is VCS revision of the project, empty outside of git.
+	Revision string `json:"revision,omitempty"`
+}
+
+// vcsRevision returns git revision checked out in dir, empty string
+// when dir is not within git work tree.
+func vcsRevision(dir string) string {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// writeLinkMetadata writes metadata of inject build with given command file.
+func writeLinkMetadata(projectPath string, cmdContent []byte) error {
+	metadata := linkMetadata{Version: versionName(), ConfigHash: cmdFingerprint(cmdContent), Revision: vcsRevision(projectPath)}
+	content, err := json.MarshalIndent(metadata, "", " ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(linkFile, content, 0644)
+}
+
+// linkArgs returns linker arguments setting metadata, -X flags go
+// before the main package archive, which is the last argument.
+func linkArgs(args []string, metadata linkMetadata) []string {
+	values := []struct{ name, value string }{
+		{"instrgenVersion", metadata.Version},
+		{"instrgenConfigHash", metadata.ConfigHash},
+		{"vcsRevision", metadata.Revision},
+	}
+	var flags []string
+	for _, v := range values {
+		if v.value != "" {
+			flags = append(flags, "-X", rtlibPackage+"."+v.name+"="+v.value)
+		}
+	}
+	last := len(args) - 1
+	linked := append([]string(nil), args[:last]...)
+	linked = append(linked, flags...)
+	return append(linked, args[last])
+}
+
+// linkMain runs linker of inject build with metadata set.
+func linkMain(args []string, instrgenCfg InstrgenCmd, cmdContent []byte, executor CommandExecutor) error {
+	content, err := os.ReadFile(linkFile)
+	if instrgenCfg.Cmd != "inject" || errors.Is(err, os.ErrNotExist) {
+		return executePass(args, executor)
+	}
+	if err != nil {
+		return err
+	}
+	if isVersionQuery(args) {
+		return printToolID(os.Stdout, args, append(cmdContent, content...))
+	}
+	var metadata linkMetadata
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return fmt.Errorf("%s: %w", linkFile, err)
+	}
+	logger.Debug("link metadata", "version", metadata.Version, "config_hash", metadata.ConfigHash, "revision", metadata.Revision)
+	return executePass(linkArgs(args, metadata), executor)
+}
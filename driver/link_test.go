@@ -0,0 +1,67 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkArgs(t *testing.T) {
+	args := []string{"/go/pkg/tool/link", "-o", "a.out", "-buildmode=exe", "_pkg_.a"}
+	linked := linkArgs(args, linkMetadata{Version: "v0.1.0", ConfigHash: "0123456789abcdef"})
+	assert.Equal(t, []string{"/go/pkg/tool/link", "-o", "a.out", "-buildmode=exe",
+		"-X", rtlibPackage + ".instrgenVersion=v0.1.0",
+		"-X", rtlibPackage + ".instrgenConfigHash=0123456789abcdef",
+		"_pkg_.a"}, linked)
+	// arguments are not modified in place
+	assert.Equal(t, "_pkg_.a", args[4])
+}
+
+func TestLinkMain(t *testing.T) {
+	chdir(t, t.TempDir())
+	version, err := driverVersion()
+	require.NoError(t, err)
+	writeCmd := func(command string) []byte {
+		content, err := json.Marshal(InstrgenCmd{ProjectPath: ".", Cmd: command, Config: defaultConfig(), Version: version})
+		require.NoError(t, err)
+		require.NoError(t, makeWorkDir())
+		require.NoError(t, os.WriteFile(cmdFile, content, 0644))
+		return content
+	}
+	args := []string{"/go/pkg/tool/link", "-o", "a.out", "_pkg_.a"}
+
+	// metadata is written by inject only
+	content := writeCmd("inject")
+	require.NoError(t, writeLinkMetadata(".", content))
+	executor := &NullExecutor{}
+	require.NoError(t, driverMain(args, executor))
+	require.Len(t, executor.commands, 1)
+	assert.Equal(t, []string{"/go/pkg/tool/link", "-o", "a.out",
+		"-X", rtlibPackage + ".instrgenVersion=" + versionName(),
+		"-X", rtlibPackage + ".instrgenConfigHash=" + cmdFingerprint(content),
+		"_pkg_.a"}, executor.commands[0])
+
+	writeCmd("prune")
+	executor = &NullExecutor{}
+	require.NoError(t, driverMain(args, executor))
+	assert.Equal(t, [][]string{args}, executor.commands)
+}
@@ -0,0 +1,193 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// logEnv passes log settings of driver command to toolexec processes
+// started by go build, like "debug" or "warn,json".
+const logEnv = "INSTRGEN_LOG"
+
+// Log formats.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// logSettings selects level and format of driver log.
+type logSettings struct {
+	level  slog.Level
+	format string
+}
+
+// String returns settings in logEnv format.
+func (settings logSettings) String() string {
+	value := strings.ToLower(settings.level.String())
+	if settings.format == logFormatJSON {
+		value += "," + logFormatJSON
+	}
+	return value
+}
+
+// parseLogSettings parses settings in logEnv format,
+// missing parts keep their defaults.
+func parseLogSettings(value string) (logSettings, error) {
+	settings := logSettings{level: slog.LevelInfo, format: logFormatText}
+	for _, part := range strings.Split(value, ",") {
+		switch part = strings.TrimSpace(part); part {
+		case "":
+		case logFormatText, logFormatJSON:
+			settings.format = part
+		default:
+			if err := settings.level.UnmarshalText([]byte(part)); err != nil {
+				return settings, fmt.Errorf("invalid log setting %q", part)
+			}
+		}
+	}
+	return settings, nil
+}
+
+// logger prints driver messages to stderr, stdout is kept for
+// command output like diffs and reports.
+var logger = newLogger(os.Stderr, envLogSettings())
+
+// envLogSettings returns settings passed by driver command,
+// defaults when invalid.
+func envLogSettings() logSettings {
+	settings, _ := parseLogSettings(os.Getenv(logEnv))
+	return settings
+}
+
+// setupLogger replaces logger and passes settings on to toolexec processes.
+func setupLogger(settings logSettings) {
+	logger = newLogger(os.Stderr, settings)
+	os.Setenv(logEnv, settings.String())
+}
+
+func newLogger(w io.Writer, settings logSettings) *slog.Logger {
+	if settings.format == logFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: settings.level}))
+	}
+	return slog.New(&consoleHandler{w: w, level: settings.level, color: useColor(w), mu: &sync.Mutex{}})
+}
+
+// useColor tells whether w is terminal accepting colors,
+// NO_COLOR disables them, see https://no-color.org.
+func useColor(w io.Writer) bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Formats of messages colored by level.
+const (
+	InfoColor    = "\033[1;34m%s\033[0m"
+	WarningColor = "\033[1;33m%s\033[0m"
+	ErrorColor   = "\033[1;31m%s\033[0m"
+	DebugColor   = "\033[0;36m%s\033[0m"
+)
+
+// consoleHandler prints message followed by attributes in key=value
+// form, colored by level on terminals.
+type consoleHandler struct {
+	w     io.Writer
+	level slog.Level
+	color bool
+	attrs string
+	mu    *sync.Mutex
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *consoleHandler) Handle(_ context.Context, record slog.Record) error {
+	var line bytes.Buffer
+	line.WriteString(record.Message)
+	line.WriteString(h.attrs)
+	record.Attrs(func(attr slog.Attr) bool {
+		appendAttr(&line, "", attr)
+		return true
+	})
+	text := line.String()
+	if h.color {
+		text = fmt.Sprintf(levelColor(record.Level), text)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, text+"\n")
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	var line bytes.Buffer
+	for _, attr := range attrs {
+		appendAttr(&line, "", attr)
+	}
+	handler := *h
+	handler.attrs += line.String()
+	return &handler
+}
+
+// WithGroup is not used by driver, group attributes are printed flat.
+func (h *consoleHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+func appendAttr(line *bytes.Buffer, prefix string, attr slog.Attr) {
+	attr.Value = attr.Value.Resolve()
+	if attr.Equal(slog.Attr{}) {
+		return
+	}
+	if attr.Value.Kind() == slog.KindGroup {
+		for _, member := range attr.Value.Group() {
+			appendAttr(line, prefix+attr.Key+".", member)
+		}
+		return
+	}
+	value := attr.Value.String()
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		value = strconv.Quote(value)
+	}
+	line.WriteString(" " + prefix + attr.Key + "=" + value)
+}
+
+func levelColor(level slog.Level) string {
+	switch {
+	case level >= slog.LevelError:
+		return ErrorColor
+	case level >= slog.LevelWarn:
+		return WarningColor
+	case level >= slog.LevelInfo:
+		return InfoColor
+	}
+	return DebugColor
+}
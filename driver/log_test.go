@@ -0,0 +1,96 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLogSettings(t *testing.T) {
+	settings, err := parseLogSettings("")
+	require.NoError(t, err)
+	assert.Equal(t, logSettings{level: slog.LevelInfo, format: logFormatText}, settings)
+	settings, err = parseLogSettings("debug,json")
+	require.NoError(t, err)
+	assert.Equal(t, logSettings{level: slog.LevelDebug, format: logFormatJSON}, settings)
+	assert.Equal(t, "debug,json", settings.String())
+	settings, err = parseLogSettings(logSettings{level: slog.LevelWarn, format: logFormatText}.String())
+	require.NoError(t, err)
+	assert.Equal(t, slog.LevelWarn, settings.level)
+	_, err = parseLogSettings("loud")
+	assert.ErrorContains(t, err, `invalid log setting "loud"`)
+}
+
+func TestConsoleHandler(t *testing.T) {
+	var out bytes.Buffer
+	log := newLogger(&out, logSettings{level: slog.LevelInfo, format: logFormatText})
+	log.Debug("hidden")
+	log.Info("invoke : go build")
+	log.With("package", "example.com/app").Warn("slow", "took", 1500*time.Millisecond, "note", "two words")
+	assert.Equal(t, "invoke : go build\nslow package=example.com/app took=1.5s note=\"two words\"\n", out.String())
+
+	out.Reset()
+	log = newLogger(&out, logSettings{level: slog.LevelWarn, format: logFormatJSON})
+	log.Info("hidden")
+	log.Error("failed", "package", "main")
+	var record map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &record))
+	assert.Equal(t, "ERROR", record["level"])
+	assert.Equal(t, "failed", record["msg"])
+	assert.Equal(t, "main", record["package"])
+}
+
+func TestUseColor(t *testing.T) {
+	assert.False(t, useColor(&bytes.Buffer{}))
+	// regular file is no terminal
+	file, err := os.CreateTemp(t.TempDir(), "log")
+	require.NoError(t, err)
+	defer file.Close()
+	assert.False(t, useColor(file))
+	t.Setenv("NO_COLOR", "1")
+	assert.False(t, useColor(os.Stderr))
+}
+
+func TestLogFlags(t *testing.T) {
+	t.Setenv(logEnv, "")
+	previous := logger
+	defer func() { logger = previous }()
+
+	err := runCommand([]string{"version", "-v", "-q"}, &NullExecutor{})
+	assert.ErrorContains(t, err, "version: flags -v and -q are mutually exclusive")
+	err = runCommand([]string{"version", "--log-format=xml"}, &NullExecutor{})
+	assert.ErrorContains(t, err, `invalid value "xml" for flag -log-format`)
+
+	require.NoError(t, runCommand([]string{"version", "-v", "--log-format=json"}, &NullExecutor{}))
+	// toolexec processes inherit settings
+	assert.Equal(t, "debug,json", os.Getenv(logEnv))
+	assert.True(t, logger.Enabled(context.Background(), slog.LevelDebug))
+}
+
+func TestPackageArg(t *testing.T) {
+	assert.Equal(t, "example.com/app", packageArg([]string{"/go/pkg/tool/compile", "-o", "_pkg_.a", "-p", "example.com/app", "-pack"}))
+	assert.Equal(t, "", packageArg([]string{"/go/pkg/tool/link", "-o", "a.out", "-p"}))
+}
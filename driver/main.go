@@ -20,54 +20,35 @@ import (
 	"errors"
 	"fmt"
 	"go/ast"
-	"go/build"
 	"go/parser"
-	"go/printer"
 	"go/token"
-	"go/types"
-	"golang.org/x/tools/go/loader"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strings"
-	"sync"
+	"time"
+
+	"golang.org/x/tools/go/packages"
 
 	alib "go.opentelemetry.io/contrib/instrgen/lib"
 	"go.opentelemetry.io/contrib/instrgen/rewriters"
 )
 
-const (
-	InfoColor    = "\033[1;34m%s\033[0m"
-	NoticeColor  = "\033[1;36m%s\033[0m"
-	WarningColor = "\033[1;33m%s\033[0m"
-	ErrorColor   = "\033[1;31m%s\033[0m"
-	DebugColor   = "\033[0;36m%s\033[0m"
-)
-
-func usage() {
-	fmt.Printf(InfoColor, "\nusage driver --command [file pattern] replace entrypoint")
-	fmt.Println()
-	fmt.Printf(InfoColor, "\tcommand:")
-	fmt.Println()
-	fmt.Printf(InfoColor, "\t\tinject                                 (injects open telemetry calls into project code)")
-	fmt.Println()
-	fmt.Printf(InfoColor, "\t\tprune                                  (prune open telemetry calls")
-	fmt.Println()
-}
-
-// Entry point function.
-type EntryPoint struct {
-	Pkg     string
-	FunName string
-}
-
 // Command passed to the compiler toolchain.
 type InstrgenCmd struct {
+	// ProjectPath is absolute path of project directory.
 	ProjectPath string
-	FilePattern string
-	Cmd         string
-	Replace     string
-	EntryPoint  EntryPoint
+	// Modules lists modules of the project.
+	Modules []Module
+	Cmd     string
+	Config  Config
+	// Version identifies binary which wrote the command, see driverVersion.
+	Version string
+	// Toolexec is absolute path of binary which wrote the command.
+	Toolexec string
+	// Plugins holds resolved executables of plugins used by inject.
+	Plugins []pluginBinary `json:",omitempty"`
 }
 
 // CommandExecutor.
@@ -103,77 +84,201 @@ func isDirectory(path string) (bool, error) {
 	return fileInfo.IsDir(), err
 }
 
-func LoadProgram(projectPath string, ginfo *types.Info) (*loader.Program, error) {
-	cwd, err := os.Getwd()
+// LoadProgram loads and type checks packages of the project the same way
+// go build would, honoring build tags and GOFLAGS. Only packages of the
+// project modules are returned, load errors are reported per package
+// by loadErrors, so the caller can carry on with packages loaded fine.
+// In workspace mode all packages of workspace modules within projectPath
+// are loaded, otherwise the package in projectPath and its dependencies.
+func LoadProgram(projectPath string, tags []string) ([]*packages.Package, error) {
+	return loadProgram(projectPath, tags, nil)
+}
+
+// loadProgram loads project packages like LoadProgram, with content of
+// files given by absolute paths replaced by overlay.
+func loadProgram(projectPath string, tags []string, overlay map[string][]byte) ([]*packages.Package, error) {
+	patterns, err := modulePatterns(projectPath)
 	if err != nil {
 		return nil, err
 	}
-	conf := loader.Config{ParserMode: parser.ParseComments}
-	conf.Build = &build.Default
-	conf.Build.CgoEnabled = false
-	conf.Build.Dir = filepath.Join(cwd, projectPath)
-	conf.Import(projectPath)
-	var mutex = &sync.RWMutex{}
-	conf.AfterTypeCheck = func(info *loader.PackageInfo, files []*ast.File) {
-		for k, v := range info.Defs {
-			mutex.Lock()
-			ginfo.Defs[k] = v
-			mutex.Unlock()
-		}
-		for k, v := range info.Uses {
-			mutex.Lock()
-			ginfo.Uses[k] = v
-			mutex.Unlock()
-		}
-		for k, v := range info.Selections {
-			mutex.Lock()
-			ginfo.Selections[k] = v
-			mutex.Unlock()
-		}
-	}
-	return conf.Load()
+	if len(patterns) == 0 {
+		patterns = []string{"."}
+	}
+	roots, err := packages.Load(packagesConfig(projectPath, tags, overlay), patterns...)
+	if err != nil {
+		return nil, err
+	}
+	var pkgs []*packages.Package
+	packages.Visit(roots, nil, func(pkg *packages.Package) {
+		// packages that could not be resolved have no module, keep them for their errors
+		if pkg.Module != nil && pkg.Module.Main || pkg.Module == nil && len(pkg.Errors) > 0 {
+			pkgs = append(pkgs, pkg)
+		}
+	})
+	sort.Slice(pkgs, func(i, j int) bool {
+		return pkgs[i].PkgPath < pkgs[j].PkgPath
+	})
+	return pkgs, nil
+}
+
+// packagesConfig returns config loading packages in projectPath
+// with syntax and type information.
+func packagesConfig(projectPath string, tags []string, overlay map[string][]byte) *packages.Config {
+	var buildFlags []string
+	if len(tags) > 0 {
+		buildFlags = append(buildFlags, "-tags="+strings.Join(tags, ","))
+	}
+	// dependencies are type checked from source, export data
+	// format changes with every go release
+	return &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedCompiledGoFiles | packages.NeedImports |
+			packages.NeedDeps | packages.NeedSyntax | packages.NeedTypes | packages.NeedTypesInfo | packages.NeedModule |
+			packages.NeedEmbedFiles,
+		Dir:        projectPath,
+		BuildFlags: buildFlags,
+		Overlay:    overlay,
+		ParseFile: func(fset *token.FileSet, filename string, src []byte) (*ast.File, error) {
+			return parser.ParseFile(fset, filename, src, parser.ParseComments)
+		},
+	}
 }
 
-func executeCommand(command string, projectPath string, packagePattern string, replaceSource string, entryPoint string, executor CommandExecutor) error {
+// loadErrors returns load errors of packages prefixed with package path.
+func loadErrors(pkgs []*packages.Package) []error {
+	var errs []error
+	for _, pkg := range pkgs {
+		for _, err := range pkg.Errors {
+			errs = append(errs, fmt.Errorf("%s: %s", pkg.PkgPath, err))
+		}
+	}
+	return errs
+}
+
+// goCommandArgs returns arguments of go command running toolexec binary
+// as toolexec wrapper. goArgs holds go subcommand followed by its arguments.
+// Overlay file is passed unless empty. Sources are replaced while their
+// package compiles, so with Replace all packages are built again, packages
+// taken from go build cache would be left as they are.
+func goCommandArgs(cfg Config, toolexec string, overlay string, goArgs []string) []string {
+	args := []string{goArgs[0], "-work"}
+	if cfg.Replace {
+		args = append(args, "-a")
+	}
+	if len(cfg.Tags) > 0 {
+		args = append(args, "-tags", strings.Join(cfg.Tags, ","))
+	}
+	if overlay != "" {
+		args = append(args, "-overlay", overlay)
+	}
+	args = append(args, "-toolexec", toolexec)
+	return append(args, goArgs[1:]...)
+}
+
+// executeCommand runs go command given by goArgs with driver as toolexec
+// wrapper, so command is applied to every compiled package.
+func executeCommand(command string, projectPath string, cfg Config, goArgs []string, executor CommandExecutor) error {
 	isDir, err := isDirectory(projectPath)
+	if err != nil {
+		return err
+	}
 	if !isDir {
 		return errors.New("[path to go project] argument must be directory")
 	}
+	projectPath, err = filepath.Abs(projectPath)
 	if err != nil {
 		return err
 	}
-	if command == "--prune" {
-		replaceSource = "yes"
+	if command == "prune" {
+		cfg.Replace = true
 	}
 
 	switch command {
-	case "--inject", "--prune":
-		entry := strings.Split(entryPoint, ".")
-		data := InstrgenCmd{projectPath, packagePattern, command[2:], replaceSource,
-			EntryPoint{entry[0], entry[1]}}
+	case "inject", "prune":
+		modules, _, err := projectModules(projectPath)
+		if err != nil {
+			return err
+		}
+		// running binary wraps the toolchain, not whatever driver is on PATH
+		toolexec, err := executable()
+		if err != nil {
+			return err
+		}
+		version, err := driverVersion()
+		if err != nil {
+			return err
+		}
+		var plugins []pluginBinary
+		if command == "inject" {
+			if plugins, err = resolvePlugins(projectPath, cfg.Plugins); err != nil {
+				return err
+			}
+		}
+		data := InstrgenCmd{ProjectPath: projectPath, Modules: modules, Cmd: command, Config: cfg,
+			Version: version, Toolexec: toolexec, Plugins: plugins}
 		file, _ := json.MarshalIndent(data, "", " ")
-		err := os.WriteFile("instrgen_cmd.json", file, 0644)
+		if err := makeWorkDir(); err != nil {
+			return err
+		}
+		err = os.WriteFile(cmdFile, file, 0644)
+		if err != nil {
+			return err
+		}
+		// pruned binaries carry no metadata
+		if command == "inject" {
+			err = writeLinkMetadata(projectPath, file)
+		} else if err = os.Remove(linkFile); os.IsNotExist(err) {
+			err = nil
+		}
 		if err != nil {
 			return err
 		}
-		executor.Execute("go", []string{"build", "-work", "-a", "-toolexec", "driver"})
-		//fmt.Println("invoke : " + executor.cmd.String())
-		if err := executor.Run(); err != nil {
+		// start with fresh trace, previous report is merged with this build
+		for _, name := range []string{traceFile, reportRecordsFile} {
+			if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		// import files are added by inject only, pruned code imports nothing
+		var overlay string
+		if command == "inject" && alib.FileExists(overlayFile) {
+			if overlay, err = filepath.Abs(overlayFile); err != nil {
+				return err
+			}
+		}
+		// binaries run by go run and go test export spans to work directory
+		if os.Getenv(tracesFileEnv) == "" {
+			if traces, err := filepath.Abs(tracesFile); err == nil {
+				os.Setenv(tracesFileEnv, traces)
+			}
+		}
+		executor.Execute("go", goCommandArgs(cfg, toolexec, overlay, goArgs))
+		err = executor.Run()
+		// in replace mode all packages are compiled, none is cached
+		var built map[string]bool
+		if !cfg.Replace {
+			var listErr error
+			if built, listErr = buildPackages(cfg, overlay, goArgs); listErr != nil {
+				logger.Debug("no cached packages in report", "error", listErr)
+			}
+		}
+		// report failed builds too, they are the most interesting ones
+		report, reportErr := writeReport(command, built)
+		if reportErr != nil {
+			if err == nil {
+				err = reportErr
+			}
 			return err
 		}
-		return nil
+		if failed := report.Summary[statusFailed]; cfg.Strict && failed > 0 {
+			return &exitError{code: exitRewriteFailed,
+				err: fmt.Errorf("strict mode: %d files failed to rewrite, see %s", failed, reportFile)}
+		}
+		return err
 	default:
-		return errors.New("unknown command")
+		return fmt.Errorf("unknown command %q", command)
 	}
 }
 
-func checkArgs(args []string) error {
-	if len(args) != 4 {
-		return errors.New("wrong arguments")
-	}
-	return nil
-}
-
 func executePass(args []string, executor CommandExecutor) error {
 	path := args[0]
 	args = args[1:]
@@ -194,86 +299,125 @@ func GetCommandName(args []string) string {
 	return cmd
 }
 
-func analyzePackage(rewriter alib.PackageRewriter,
+// analyzePackage applies rewriter chain to files of compiled package given
+// by their index in args. Files are rewritten concurrently, each of them is
+// parsed once and shared by all rewriters. Reports, errors and arguments
+// follow the order of files in args, so the result does not depend on
+// scheduling.
+func analyzePackage(rewriterS []alib.PackageRewriter,
 	pkg string, filePaths map[string]int,
-	trace *os.File, destPath string,
+	trace *os.File, recorder *reportRecorder, destPath string,
 	args []string,
-	remappedFilePaths map[string]string) []string {
-	fset := token.NewFileSet()
-	// TODO handle trace
-	_ = trace
-	extraFilesWritten := false
-
-	removedFilePaths := make(map[string]int)
+	remappedFilePaths map[string]string) ([]string, []error) {
+	type fileArg struct {
+		path  string
+		index int
+	}
+	var files []fileArg
 	for filePath, index := range filePaths {
-		trace.WriteString(rewriter.Id() + ":" + filePath)
-		trace.WriteString("\n")
-		file, err := parser.ParseFile(fset, filePath, nil, parser.ParseComments)
-		if err != nil {
-			continue
+		files = append(files, fileArg{path: filePath, index: index})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].index < files[j].index
+	})
+	for _, file := range files {
+		for _, rewriter := range rewriterS {
+			trace.WriteString(rewriter.Id() + ":" + file.path + "\n")
 		}
-		if rewriter.Inject(pkg, filePath) {
-			rewriter.Rewrite(pkg, file, fset, trace)
-
-			if rewriter.ReplaceSource(pkg, filePath) {
-				var out *os.File
-				out, err = alib.CreateFile(fset.File(file.Pos()).Name() + "tmp")
-				if err != nil {
-					continue
-				}
-				err = printer.Fprint(out, fset, file)
-				if err != nil {
-					continue
-				}
-				oldFileName := fset.File(file.Pos()).Name() + "tmp"
-				newFileName := fset.File(file.Pos()).Name()
-				err = os.Rename(oldFileName, newFileName)
-				if err != nil {
-					continue
-				}
-			} else {
-				filename := filepath.Base(filePath)
-				out, err := alib.CreateFile(destPath + "/" + filename + "tmp")
+	}
 
-				if err != nil {
-					continue
-				}
-				err = printer.Fprint(out, fset, file)
-				if err != nil {
-					continue
-				}
-				oldFileName := destPath + "/" + filename + "tmp"
-				newFileName := destPath + "/" + filename
-				err = os.Rename(oldFileName, newFileName)
-				if err != nil {
-					continue
-				}
-				out.Close()
-				args[index] = destPath + "/" + filename
-				removedFilePaths[filePath] = index
-				remappedFilePaths[args[index]] = filePath
-			}
-			if !extraFilesWritten {
-				files := rewriter.WriteExtraFiles(pkg, destPath)
-				if len(files) > 0 {
-					args = append(args, files...)
+	// token.FileSet is safe for concurrent use
+	fset := token.NewFileSet()
+	results := make([]*fileRewrite, len(files))
+	newFileNames := make([]string, len(files))
+	forEachFile(len(files), func(i int) {
+		filePath := files[i].path
+		reportPath := filePath
+		if original, ok := remappedFilePaths[filePath]; ok {
+			reportPath = original
+		}
+		result := rewriteChain(rewriterS, pkg, filePath, reportPath, fset, nil, trace)
+		results[i] = result
+		if !result.ok() {
+			return
+		}
+		newFileName := filePath
+		content, err := result.format(fset)
+		if err == nil && !result.replace {
+			// positions of the rewritten copy are mapped back to the original
+			newFileName = destPath + "/" + filepath.Base(filePath)
+			content = lineDirectives(content, reportPath, fset, result.file, result.source)
+		}
+		if err == nil {
+			err = writeFile(newFileName+"tmp", content)
+		}
+		if err == nil {
+			err = os.Rename(newFileName+"tmp", newFileName)
+		}
+		if err != nil {
+			rewriteErr := newRewriteError(reportPath, result.reports[len(result.reports)-1].Rewriter, err)
+			result.errs = append(result.errs, rewriteErr)
+			for r := range result.reports {
+				if result.applied[r] {
+					result.reports[r].Status, result.reports[r].Reason, result.reports[r].Functions = statusFailed, rewriteErr.Error(), nil
 				}
-				extraFilesWritten = true
 			}
+			return
+		}
+		newFileNames[i] = newFileName
+	})
+
+	var errs []error
+	appliedRewriters := make([]bool, len(rewriterS))
+	for i, result := range results {
+		for _, report := range result.reports {
+			recorder.record(pkg, report)
+		}
+		errs = append(errs, result.errs...)
+		for r, applied := range result.applied {
+			appliedRewriters[r] = appliedRewriters[r] || applied && len(result.errs) == 0
+		}
+		if newFileName := newFileNames[i]; newFileName != "" && newFileName != files[i].path {
+			index := files[i].index
+			args[index] = newFileName
+			remappedFilePaths[newFileName] = result.reports[0].Path
+			delete(filePaths, files[i].path)
+			filePaths[newFileName] = index
 		}
 	}
-	for k, v := range removedFilePaths {
-		delete(filePaths, k)
-		filePaths[args[v]] = v
+	for r, rewriter := range rewriterS {
+		if appliedRewriters[r] {
+			args = append(args, rewriter.WriteExtraFiles(pkg, destPath)...)
+		}
+	}
+	return args, errs
+}
+
+// writeFile writes rewritten file content to path.
+func writeFile(path string, content []byte) error {
+	out, err := alib.CreateFile(path)
+	if err != nil {
+		return err
+	}
+	if _, err := out.Write(content); err != nil {
+		out.Close()
+		return err
 	}
-	return args
+	return out.Close()
 }
 
-func analyze(args []string, rewriterS []alib.PackageRewriter, remappedFilePaths map[string]string) []string {
-	trace, _ := os.OpenFile("args", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+// analyze runs rewriters on sources of compiled package and returns
+// compiler arguments pointing to rewritten sources along with errors
+// of rewriters that failed.
+func analyze(args []string, rewriterS []alib.PackageRewriter, remappedFilePaths map[string]string, modules []Module) ([]string, []error) {
+	trace, _ := os.OpenFile(traceFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	defer trace.Close()
+	recorder := newReportRecorder(modules)
+	defer recorder.Close()
 	argsLen := len(args)
 	var destPath string
 	var pkg string
+	var errs []error
 
 	for i, a := range args {
 		// output directory
@@ -292,34 +436,58 @@ func analyze(args []string, rewriterS []alib.PackageRewriter, remappedFilePaths
 				if string(args[j]) == "-asmhdr" {
 					j = j + 2
 				}
-				if !strings.HasSuffix(args[j], ".go") {
+				// import files added by driver through overlay
+				if !strings.HasSuffix(args[j], ".go") || inWorkDir(args[j]) {
 					continue
 				}
 				filePath := args[j]
 				files[filePath] = j
 			}
-			for _, rewriter := range rewriterS {
-				args = analyzePackage(rewriter, pkg, files, trace, destPath, args, remappedFilePaths)
-			}
+			pkg = resolveImportPath(pkg, files, modules)
+			var pkgErrs []error
+			args, pkgErrs = analyzePackage(rewriterS, pkg, files, trace, recorder, destPath, args, remappedFilePaths)
+			errs = append(errs, pkgErrs...)
 		}
 	}
-	return args
+	return args, errs
 }
 
-func toolExecMain(args []string, rewriterS []alib.PackageRewriter, executor CommandExecutor, remappedFilePaths map[string]string) error {
-	args = analyze(args, rewriterS, remappedFilePaths)
+// toolExecMain rewrites sources of compiled package and runs the tool.
+// In strict mode any rewriter failure aborts the compile.
+func toolExecMain(args []string, rewriterS []alib.PackageRewriter, executor CommandExecutor, remappedFilePaths map[string]string, modules []Module, strict bool) error {
+	start := time.Now()
+	args, errs := analyze(args, rewriterS, remappedFilePaths, modules)
 	if len(args) == 0 {
-		usage()
-		return errors.New("wrong command")
+		return errors.New("missing tool command")
+	}
+	if strict {
+		if err := strictError(errs); err != nil {
+			return err
+		}
 	}
 
+	compileStart := time.Now()
 	err := executePass(args[0:], executor)
+	logger.Debug("compiled package", "package", packageArg(args),
+		"rewrite", compileStart.Sub(start).Round(time.Microsecond),
+		"compile", time.Since(compileStart).Round(time.Microsecond))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// packageArg returns import path of package compiled by tool, empty
+// string when arguments name none.
+func packageArg(args []string) string {
+	for i, arg := range args {
+		if arg == "-p" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
 func printStack(stack []*ast.CallExpr) {
 	for len(stack) > 0 {
 		n := len(stack) - 1 // Top element
@@ -334,11 +502,15 @@ func printStack(stack []*ast.CallExpr) {
 	}
 }
 
-func readLine(path string) map[string]string {
+// readLine reads log calls found by sema, none when the file is missing.
+func readLine(path string) (map[string]string, error) {
 	logcalls := make(map[string]string)
 	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return logcalls, nil
+	}
 	if err != nil {
-		fmt.Println(err)
+		return logcalls, err
 	}
 	defer file.Close()
 
@@ -351,84 +523,117 @@ func readLine(path string) map[string]string {
 		call := strings.Split(line, " ")
 		logcalls[strings.TrimSpace(call[1])] = strings.TrimSpace(call[0])
 	}
-	return logcalls
+	return logcalls, nil
 }
 
 func makeRewriters(instrgenCfg InstrgenCmd, remappedFilePaths map[string]string) []alib.PackageRewriter {
 	var rewriterS []alib.PackageRewriter
-	logcalls := readLine("./logcalls")
-	_ = logcalls
+	cfg := instrgenCfg.Config
+	root := instrgenCfg.ProjectPath
+	replace := replaceValue(cfg.Replace)
+	// config has been validated by driver already
+	entryPoints, _ := parseEntryPoints(cfg.EntryPoints)
 	switch instrgenCfg.Cmd {
 	case "inject":
-		rewriterS = append(rewriterS, rewriters.RuntimeRewriter{
-			FilePattern: instrgenCfg.FilePattern})
-		rewriterS = append(rewriterS, rewriters.LogCtxEnricher{
-			FilePattern: instrgenCfg.FilePattern, Replace: instrgenCfg.Replace,
-			Pkg: instrgenCfg.EntryPoint.Pkg, Fun: instrgenCfg.EntryPoint.FunName, LogCalls: logcalls, RemappedFilePaths: remappedFilePaths})
-		rewriterS = append(rewriterS, rewriters.BasicRewriter{
-			FilePattern: instrgenCfg.FilePattern, Replace: instrgenCfg.Replace,
-			Pkg: instrgenCfg.EntryPoint.Pkg, Fun: instrgenCfg.EntryPoint.FunName, RemappedFilePaths: remappedFilePaths})
+		// log calls refer to span context of basic when it runs
+		var spans alib.FileFilter
+		if contains(cfg.rewriters(), basicRewriterName) {
+			spans = projectFilter(root, cfg, instrgenCfg.Modules, basicRewriterName)
+		}
+		for _, name := range cfg.rewriters() {
+			switch name {
+			case runtimeRewriterName:
+				rewriterS = append(rewriterS, rewriters.RuntimeRewriter{})
+			case logCtxRewriterName:
+				// log calls are found by sema run before the build
+				logcalls, err := readLine(logCallsFile)
+				if err != nil {
+					logger.Warn("log calls are not enriched", "error", err)
+				}
+				rewriterS = append(rewriterS, rewriters.LogCtxEnricher{
+					Filter: projectFilter(root, cfg, instrgenCfg.Modules, name), Spans: spans, Replace: replace,
+					LogCalls: logcalls, RemappedFilePaths: remappedFilePaths})
+			case basicRewriterName:
+				rewriterS = append(rewriterS, rewriters.BasicRewriter{
+					Filter: projectFilter(root, cfg, instrgenCfg.Modules, name), Replace: replace,
+					EntryPoints: entryPoints, RemappedFilePaths: remappedFilePaths,
+					Defaults: cfg.exporterDefaults()})
+			default:
+				for _, plugin := range instrgenCfg.Plugins {
+					if plugin.Name == name {
+						rewriterS = append(rewriterS, PluginRewriter{Plugin: plugin, Command: instrgenCfg.Cmd,
+							Filter: projectFilter(root, cfg, instrgenCfg.Modules, name), Replace: cfg.Replace})
+					}
+				}
+			}
+		}
 	case "prune":
 		rewriterS = append(rewriterS, rewriters.OtelPruner{
-			FilePattern: instrgenCfg.FilePattern, Replace: true})
+			Filter: projectFilter(root, cfg, instrgenCfg.Modules, "prune"), Replace: true})
 	}
 	return rewriterS
 }
 
 func updateLogCalls(lib string,
 	replace string,
-	prog *loader.Program,
+	fset *token.FileSet,
 	node ast.Node,
 	logCalls *os.File) {
 	if replace == "yes" {
-		logCalls.WriteString(lib + prog.Fset.Position(node.Pos()).String())
+		logCalls.WriteString(lib + fset.Position(node.Pos()).String())
 	} else {
-		p := strings.Split(prog.Fset.Position(node.Pos()).String(), ":")
+		p := strings.Split(fset.Position(node.Pos()).String(), ":")
 		logCalls.WriteString(lib + "./" + filepath.Base(p[0]) + ":" + p[1] + ":" + p[2])
 	}
 	logCalls.WriteString("\n")
 }
 
-func sema(projectPath string, replace string, prog *loader.Program, ginfo *types.Info) error {
-	logCalls, err := os.Create("logcalls")
+func sema(filter alib.FileFilter, replace string, pkgs []*packages.Package) error {
+	logCalls, err := createWorkFile(logCallsFile)
 	if err != nil {
-		fmt.Println(err)
 		return err
 	}
-	for _, pkg := range prog.AllPackages {
-		for _, file := range pkg.Files {
+	defer logCalls.Close()
+	for _, pkg := range pkgs {
+		if pkg.TypesInfo == nil {
+			continue
+		}
+		for _, file := range pkg.Syntax {
+			if !filter(pkg.PkgPath, pkg.Fset.File(file.Pos()).Name()) {
+				continue
+			}
 			ast.Inspect(file, func(n ast.Node) bool {
 				switch node := n.(type) {
 				case *ast.CallExpr:
 					if selExpr, ok := node.Fun.(*ast.SelectorExpr); ok {
-						obj := ginfo.Uses[selExpr.Sel]
-						var pkg string
+						obj := pkg.TypesInfo.Uses[selExpr.Sel]
+						var libPath string
 						if obj != nil && obj.Pkg() != nil {
-							pkg = obj.Pkg().Path()
+							libPath = obj.Pkg().Path()
 						}
-						if strings.Contains(pkg, "zerolog") == true && strings.Contains(prog.Fset.File(file.Pos()).Name(), projectPath) {
+						if strings.Contains(libPath, "zerolog") {
 							if selExpr.Sel.Name == "Msg" {
-								updateLogCalls("zerolog ", replace, prog, node, logCalls)
+								updateLogCalls("zerolog ", replace, pkg.Fset, node, logCalls)
 							}
 						}
-						if strings.Contains(pkg, "zap") == true && strings.Contains(prog.Fset.File(file.Pos()).Name(), projectPath) {
+						if strings.Contains(libPath, "zap") {
 							switch call := selExpr.Sel.Name; call {
 							case "Info", "Warn", "Error":
-								updateLogCalls("zap ", replace, prog, node, logCalls)
+								updateLogCalls("zap ", replace, pkg.Fset, node, logCalls)
 							}
 						}
-						if strings.Contains(pkg, "logrus") == true && strings.Contains(prog.Fset.File(file.Pos()).Name(), projectPath) {
+						if strings.Contains(libPath, "logrus") {
 							switch call := selExpr.Sel.Name; call {
 							case "Info":
-								updateLogCalls("logrus ", replace, prog, node, logCalls)
+								updateLogCalls("logrus ", replace, pkg.Fset, node, logCalls)
 							case "Warn":
-								updateLogCalls("logrus ", replace, prog, node, logCalls)
+								updateLogCalls("logrus ", replace, pkg.Fset, node, logCalls)
 							case "Error":
-								updateLogCalls("logrus ", replace, prog, node, logCalls)
+								updateLogCalls("logrus ", replace, pkg.Fset, node, logCalls)
 							case "Fatalf":
-								updateLogCalls("logrus ", replace, prog, node, logCalls)
+								updateLogCalls("logrus ", replace, pkg.Fset, node, logCalls)
 							case "Fatal":
-								updateLogCalls("logrus ", replace, prog, node, logCalls)
+								updateLogCalls("logrus ", replace, pkg.Fset, node, logCalls)
 							}
 						}
 					}
@@ -440,95 +645,22 @@ func sema(projectPath string, replace string, prog *loader.Program, ginfo *types
 	return nil
 }
 
-func goModTidy(projectPath string, replace string, prog *loader.Program, ginfo *types.Info) {
-	for _, pkg := range prog.AllPackages {
-		if len(pkg.Files) > 0 {
-			path := prog.Fset.File(pkg.Files[0].Pos()).Name()
-			if !strings.Contains(path, projectPath) {
-				continue
-			}
-			if !alib.FileExists(filepath.Dir(path) + "/instrgen_imports.go") {
-				f, err := alib.CreateFile(filepath.Dir(path) + "/instrgen_imports.go")
-				if err != nil {
-					fmt.Println(err)
-					return
-				}
-				imports :=
-					`package ` + pkg.Pkg.Name() + `
-import (
-	_ "go.opentelemetry.io/contrib/instrgen/rtlib"
-	_ "go.opentelemetry.io/otel"
-	_ "context"
-	_ "runtime"
-	_ "go.opentelemetry.io/otel/trace"
-	_ "go.opentelemetry.io/otel/sdk/trace"
-	_ "go.uber.org/zap"
-)
-`
-				_, err = f.WriteString(imports)
-				if err != nil {
-					fmt.Println(err)
-					return
-				}
-			}
-		}
-	}
-	executor := &ToolExecutor{}
-	executor.Execute("go", []string{"mod", "tidy"})
-	fmt.Printf(InfoColor, "invoke : "+executor.cmd.String()+"\n")
-	if err := executor.Run(); err != nil {
-		fmt.Println(err)
-	}
+// isToolInvocation tells whether driver was invoked by go build
+// as -toolexec wrapper. The go command always passes absolute tool path.
+func isToolInvocation(args []string) bool {
+	return len(args) > 0 && filepath.IsAbs(args[0])
 }
 
 func driverMain(args []string, executor CommandExecutor) error {
-	cmdName := GetCommandName(args)
-	if cmdName != "compile" {
-		// do semantic check before injecting
-		if cmdName == "--inject" {
-			ginfo := &types.Info{
-				Defs:       make(map[*ast.Ident]types.Object),
-				Uses:       make(map[*ast.Ident]types.Object),
-				Selections: make(map[*ast.SelectorExpr]*types.Selection),
-			}
-			fmt.Printf(InfoColor, "instrgen semantic analysis...\n")
-			prog, err := LoadProgram(".", ginfo)
-			if err != nil {
-				err = errors.New("Load failed : " + err.Error())
-				return err
-			}
-			sema(args[1], args[2], prog, ginfo)
-			goModTidy(args[1], args[2], prog, ginfo)
-		}
-		switch cmdName {
-		case "--inject", "--prune":
-			fmt.Printf(InfoColor, "instrgen compiler\n")
-			err := checkArgs(args)
-			if err != nil {
-				usage()
-				return err
-			}
-			replace := "no"
-			if len(args) > 2 {
-				replace = args[2]
-			}
-			err = executeCommand(args[0], ".", args[1], replace, args[3], executor)
-			if err != nil {
-				return err
-			}
-			return nil
-		}
-		if len(args) > 0 {
-			err := executePass(args[0:], executor)
-			if err != nil {
-				return err
-			}
-		} else {
-			usage()
-		}
-		return nil
+	if !isToolInvocation(args) {
+		return runCommand(args, executor)
 	}
-	content, err := os.ReadFile("./instrgen_cmd.json")
+	logger.Debug("toolexec", "tool", GetCommandName(args), "package", packageArg(args))
+	tool := GetCommandName(args)
+	if tool != "compile" && tool != "link" {
+		return executePass(args[0:], executor)
+	}
+	content, err := os.ReadFile(cmdFile)
 	if err != nil {
 		return err
 	}
@@ -538,17 +670,34 @@ func driverMain(args []string, executor CommandExecutor) error {
 	if err != nil {
 		return err
 	}
+	if err := checkHandshake(instrgenCfg); err != nil {
+		return err
+	}
+	if tool == "link" {
+		return linkMain(args, instrgenCfg, content, executor)
+	}
+	if isVersionQuery(args) {
+		return printToolID(os.Stdout, args, content)
+	}
 	remappedFilePaths := make(map[string]string)
 	rewriterS := makeRewriters(instrgenCfg, remappedFilePaths)
-	return toolExecMain(args, rewriterS, executor, remappedFilePaths)
+	return toolExecMain(args, rewriterS, executor, remappedFilePaths, instrgenCfg.Modules, instrgenCfg.Config.Strict)
 }
 
 func main() {
 	executor := &ToolExecutor{}
 	err := driverMain(os.Args[1:], executor)
 	if err != nil {
-		fmt.Println()
-		fmt.Printf(ErrorColor, err.Error())
-		fmt.Println()
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && isToolInvocation(os.Args[1:]) {
+			// tool already reported its failure
+			os.Exit(exitErr.ExitCode())
+		}
+		logger.Error(err.Error())
+		var codeErr *exitError
+		if errors.As(err, &codeErr) {
+			os.Exit(codeErr.code)
+		}
+		os.Exit(exitFailure)
 	}
 }
@@ -0,0 +1,226 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+)
+
+// Module describes go module taking part in the build.
+type Module struct {
+	// Path is module path declared in go.mod.
+	Path string
+	// Dir is absolute path of directory holding go.mod.
+	Dir string
+	// Config holds rules of config file found in module directory,
+	// project config applies to module files when nil.
+	Config *Config `json:",omitempty"`
+}
+
+// readModulePath returns module path declared in go.mod file.
+func readModulePath(gomod string) (string, error) {
+	content, err := os.ReadFile(gomod)
+	if err != nil {
+		return "", err
+	}
+	modulePath := modfile.ModulePath(content)
+	if modulePath == "" {
+		return "", fmt.Errorf("%s: missing module declaration", gomod)
+	}
+	return modulePath, nil
+}
+
+// findModule returns module enclosing dir. Zero Module is returned
+// when dir is not part of any module.
+func findModule(dir string) (Module, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return Module{}, err
+	}
+	for {
+		gomod := filepath.Join(dir, "go.mod")
+		if alib.FileExists(gomod) {
+			modulePath, err := readModulePath(gomod)
+			if err != nil {
+				return Module{}, err
+			}
+			return Module{Path: modulePath, Dir: dir}, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return Module{}, nil
+		}
+		dir = parent
+	}
+}
+
+// findWorkspace returns path of go.work file used by go command in dir,
+// empty string in single module mode. Like go command it honors GOWORK.
+func findWorkspace(dir string) (string, error) {
+	switch gowork := os.Getenv("GOWORK"); gowork {
+	case "off":
+		return "", nil
+	case "":
+	default:
+		return filepath.Abs(gowork)
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		gowork := filepath.Join(dir, "go.work")
+		if alib.FileExists(gowork) {
+			return gowork, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// workspaceModules returns modules listed by use directives of go.work file.
+func workspaceModules(gowork string) ([]Module, error) {
+	content, err := os.ReadFile(gowork)
+	if err != nil {
+		return nil, err
+	}
+	file, err := modfile.ParseWork(gowork, content, nil)
+	if err != nil {
+		return nil, err
+	}
+	var modules []Module
+	for _, use := range file.Use {
+		dir := filepath.FromSlash(use.Path)
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(filepath.Dir(gowork), dir)
+		}
+		modulePath, err := readModulePath(filepath.Join(dir, "go.mod"))
+		if err != nil {
+			return nil, err
+		}
+		modules = append(modules, Module{Path: modulePath, Dir: dir})
+	}
+	return modules, nil
+}
+
+// projectModules returns modules of the workspace dir belongs to or the
+// single module enclosing dir. Modules other than the one in dir itself
+// get file rules of their own config files. Workspace tells whether go.work
+// was found.
+func projectModules(dir string) (modules []Module, workspace bool, err error) {
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return nil, false, err
+	}
+	gowork, err := findWorkspace(dir)
+	if err != nil {
+		return nil, false, err
+	}
+	if gowork == "" {
+		module, err := findModule(dir)
+		return []Module{module}, false, err
+	}
+	if modules, err = workspaceModules(gowork); err != nil {
+		return nil, true, err
+	}
+	for i, module := range modules {
+		if module.Dir == dir {
+			continue
+		}
+		configPath, err := findConfig(module.Dir)
+		if err != nil || configPath == "" {
+			if err != nil {
+				return nil, true, err
+			}
+			continue
+		}
+		cfg, err := loadModuleConfig(configPath)
+		if err != nil {
+			return nil, true, err
+		}
+		modules[i].Config = &cfg
+	}
+	return modules, true, nil
+}
+
+// modulePatterns returns package patterns of workspace modules within
+// root, relative to root. Nil is returned outside of workspace mode,
+// go commands build the package in root then.
+func modulePatterns(root string) ([]string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	modules, workspace, err := projectModules(root)
+	if err != nil || !workspace {
+		return nil, err
+	}
+	var patterns []string
+	for _, module := range modules {
+		rel, err := filepath.Rel(root, module.Dir)
+		if err != nil || rel != "." && !filepath.IsLocal(rel) {
+			continue
+		}
+		patterns = append(patterns, "./"+path.Join(filepath.ToSlash(rel), "..."))
+	}
+	return patterns, nil
+}
+
+// enclosingModule returns innermost module holding filePath.
+func enclosingModule(filePath string, modules []Module) (Module, bool) {
+	var found Module
+	for _, module := range modules {
+		if module.Dir == "" || len(module.Dir) < len(found.Dir) {
+			continue
+		}
+		if filePath == module.Dir || strings.HasPrefix(filePath, module.Dir+string(filepath.Separator)) {
+			found = module
+		}
+	}
+	return found, found.Dir != ""
+}
+
+// resolveImportPath returns import path of compiled package. The compiler
+// gets "main" instead of import path of main packages, in that case it is
+// derived from directory of package files within enclosing module.
+func resolveImportPath(pkg string, files map[string]int, modules []Module) string {
+	if pkg != "main" {
+		return pkg
+	}
+	for filePath := range files {
+		dir := filepath.Dir(filePath)
+		found, ok := enclosingModule(dir, modules)
+		if !ok {
+			return pkg
+		}
+		rel, err := filepath.Rel(found.Dir, dir)
+		if err != nil {
+			return pkg
+		}
+		return path.Join(found.Path, filepath.ToSlash(rel))
+	}
+	return pkg
+}
@@ -0,0 +1,177 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+)
+
+func TestFindModule(t *testing.T) {
+	dir := t.TempDir()
+	gomod := "// comment\nmodulefoo bar\nmodule \"example.com/app\" // trailing\n\ngo 1.19\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte(gomod), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "cmd", "server"), 0755))
+	module, err := findModule(filepath.Join(dir, "cmd", "server"))
+	require.NoError(t, err)
+	assert.Equal(t, Module{Path: "example.com/app", Dir: dir}, module)
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte("go 1.19\n"), 0644))
+	_, err = findModule(dir)
+	assert.ErrorContains(t, err, "missing module declaration")
+}
+
+func TestResolveImportPath(t *testing.T) {
+	modules := []Module{{Path: "example.com/app", Dir: "/src/app"}, {Path: "example.com/app/tools", Dir: "/src/app/tools"}}
+	files := func(name string) map[string]int {
+		return map[string]int{name: 0}
+	}
+	assert.Equal(t, "example.com/app/lib", resolveImportPath("example.com/app/lib", files("/src/app/lib/lib.go"), modules))
+	assert.Equal(t, "example.com/app", resolveImportPath("main", files("/src/app/main.go"), modules))
+	assert.Equal(t, "example.com/app/cmd/server", resolveImportPath("main", files("/src/app/cmd/server/main.go"), modules))
+	assert.Equal(t, "example.com/app/tools/gen", resolveImportPath("main", files("/src/app/tools/gen/main.go"), modules))
+	assert.Equal(t, "main", resolveImportPath("main", files("/elsewhere/main.go"), modules))
+	assert.Equal(t, "main", resolveImportPath("main", files("/src/app/main.go"), nil))
+}
+
+func TestEntryPointMatches(t *testing.T) {
+	tests := []struct {
+		entry   alib.EntryPoint
+		pkgPath string
+		pkgName string
+		fun     string
+		matches bool
+	}{
+		{alib.EntryPoint{Pkg: "main", FunName: "main"}, "example.com/app/cmd/server", "main", "main", true},
+		{alib.EntryPoint{Pkg: "main", FunName: "main"}, "example.com/app/lib", "lib", "main", false},
+		{alib.EntryPoint{Pkg: "*/cmd/*", FunName: "main"}, "example.com/app/cmd/server", "main", "main", true},
+		{alib.EntryPoint{Pkg: "*/cmd/*", FunName: "main"}, "example.com/app/worker", "main", "main", false},
+		{alib.EntryPoint{Pkg: "example.com/app/worker", FunName: "Run*"}, "example.com/app/worker", "worker", "RunLoop", true},
+		{alib.EntryPoint{Pkg: "example.com/app/worker", FunName: "Run"}, "example.com/app/worker", "worker", "RunLoop", false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.matches, test.entry.Matches(test.pkgPath, test.pkgName, test.fun), test.entry.String())
+	}
+}
+
+// writeWorkspace creates workspace of app module calling lib module,
+// lib has config file of its own.
+func writeWorkspace(t *testing.T) string {
+	dir := t.TempDir()
+	files := map[string]string{
+		"go.work":            "go 1.20\n\nuse (\n\t./app\n\t./lib\n)\n",
+		"app/go.mod":         "module example.com/app\n\ngo 1.20\n\nrequire example.com/lib v0.0.0\n",
+		"app/main.go":        "package main\n\nimport \"example.com/lib\"\n\nfunc main() {\n\tlib.Hello()\n}\n",
+		"lib/go.mod":         "module example.com/lib\n\ngo 1.20\n",
+		"lib/lib.go":         "package lib\n\nfunc Hello() {}\n",
+		"lib/gen_lib.go":     "package lib\n\nfunc generated() {}\n",
+		"lib/instrgen.yaml":  "version: 1\nexclude:\n  - \"**/gen_*.go\"\n",
+		"other/go.mod":       "module example.com/other\n\ngo 1.20\n",
+		"other/instrgen.yml": "version: 1\n",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	}
+	return dir
+}
+
+func TestProjectModules(t *testing.T) {
+	t.Setenv("GOWORK", "")
+	dir := writeWorkspace(t)
+	modules, workspace, err := projectModules(dir)
+	require.NoError(t, err)
+	assert.True(t, workspace)
+	require.Len(t, modules, 2)
+	assert.Equal(t, Module{Path: "example.com/app", Dir: filepath.Join(dir, "app")}, modules[0])
+	assert.Equal(t, "example.com/lib", modules[1].Path)
+	require.NotNil(t, modules[1].Config)
+
+	// module in project directory uses project config
+	modules, _, err = projectModules(filepath.Join(dir, "lib"))
+	require.NoError(t, err)
+	assert.Nil(t, modules[1].Config)
+
+	// settings of the whole build are not accepted from module config
+	for _, content := range []string{"version: 1\nentry_points: [lib.Run]\n", "version: 1\nrewriters: [runtime]\n"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "lib", "instrgen.yaml"), []byte(content), 0644))
+		_, _, err = projectModules(dir)
+		assert.ErrorContains(t, err, "is not supported in module config, set it in project config", content)
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "lib", "instrgen.yaml"),
+		[]byte("version: 1\nexclude:\n  - \"**/gen_*.go\"\npackages:\n  - package: example.com/lib\n    rewriters: [basic]\n"), 0644))
+	modules, _, err = projectModules(dir)
+	require.NoError(t, err)
+	require.NotNil(t, modules[1].Config)
+
+	patterns, err := modulePatterns(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"./app/...", "./lib/..."}, patterns)
+	patterns, err = modulePatterns(filepath.Join(dir, "app"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"./..."}, patterns)
+
+	t.Setenv("GOWORK", "off")
+	modules, workspace, err = projectModules(filepath.Join(dir, "lib"))
+	require.NoError(t, err)
+	assert.False(t, workspace)
+	assert.Equal(t, []Module{{Path: "example.com/lib", Dir: filepath.Join(dir, "lib")}}, modules)
+	patterns, err = modulePatterns(filepath.Join(dir, "lib"))
+	require.NoError(t, err)
+	assert.Nil(t, patterns)
+}
+
+func TestProjectFilter(t *testing.T) {
+	t.Setenv("GOWORK", "")
+	dir := writeWorkspace(t)
+	modules, _, err := projectModules(dir)
+	require.NoError(t, err)
+	cfg := defaultConfig()
+	cfg.Exclude = []string{"app/skipped.go"}
+	basic := projectFilter(dir, cfg, modules, basicRewriterName)
+	assert.True(t, basic("example.com/app", filepath.Join(dir, "app", "main.go")))
+	assert.False(t, basic("example.com/app", filepath.Join(dir, "app", "skipped.go")))
+	assert.True(t, basic("example.com/lib", filepath.Join(dir, "lib", "lib.go")))
+	assert.True(t, basic("example.com/lib", filepath.Join("lib", "lib.go")))
+	assert.False(t, basic("example.com/lib", filepath.Join(dir, "lib", "gen_lib.go")))
+
+	// module config never selects files outside of the project
+	basic = projectFilter(filepath.Join(dir, "app"), cfg, modules, basicRewriterName)
+	assert.False(t, basic("example.com/lib", filepath.Join(dir, "lib", "lib.go")))
+}
+
+func TestLoadWorkspace(t *testing.T) {
+	t.Setenv("GOWORK", "")
+	// -mod=mod is refused in workspace mode
+	t.Setenv("GOFLAGS", "")
+	dir := writeWorkspace(t)
+	chdir(t, dir)
+	pkgs, err := LoadProgram(".", nil)
+	require.NoError(t, err)
+	var paths []string
+	for _, pkg := range pkgs {
+		paths = append(paths, pkg.PkgPath)
+	}
+	assert.ElementsMatch(t, []string{"example.com/app", "example.com/lib"}, paths)
+}
@@ -0,0 +1,201 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+)
+
+// Plugins are external executables rewriting one file per invocation.
+// The driver writes pluginRequest as JSON to plugin stdin and reads
+// pluginResponse as JSON from its stdout. Anything written to stderr
+// is reported when plugin fails. Plugin exiting with non zero status
+// or returning error fails the file like any other rewriter does.
+
+// pluginProtocolVersion is increased on incompatible protocol changes.
+const pluginProtocolVersion = 1
+
+// pluginRequest is sent to plugin for every file it rewrites.
+type pluginRequest struct {
+	Version int `json:"version"`
+	// Rewriter is plugin name from project config.
+	Rewriter string `json:"rewriter"`
+	// Command is driver command, inject.
+	Command string `json:"command"`
+	// Package is import path of package the file belongs to.
+	Package string `json:"package"`
+	// Path is absolute path of the file.
+	Path string `json:"path"`
+	// Source holds file content, including changes
+	// of rewriters run before the plugin.
+	Source string `json:"source"`
+}
+
+// pluginResponse is returned by plugin.
+type pluginResponse struct {
+	// Source holds rewritten file, empty when file is left unchanged.
+	Source string `json:"source,omitempty"`
+	// Error fails rewriting of the file.
+	Error string `json:"error,omitempty"`
+}
+
+// pluginBinary is plugin with executable resolved by driver. Hash of
+// executable is part of command file, so changed plugins invalidate
+// packages cached by go build.
+type pluginBinary struct {
+	Name string
+	// Args holds absolute path of executable followed by its arguments.
+	Args []string
+	Hash string
+}
+
+// resolvePlugins resolves executables of plugins configured for root.
+func resolvePlugins(root string, plugins []Plugin) ([]pluginBinary, error) {
+	var binaries []pluginBinary
+	for _, plugin := range plugins {
+		path := plugin.Command[0]
+		if strings.ContainsRune(path, '/') || strings.ContainsRune(path, filepath.Separator) {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(root, path)
+			}
+		} else {
+			var err error
+			if path, err = exec.LookPath(path); err != nil {
+				return nil, fmt.Errorf("plugin %s: %w", plugin.Name, err)
+			}
+		}
+		path, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		hash, err := hashFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("plugin %s: %w", plugin.Name, err)
+		}
+		args := append([]string{path}, plugin.Command[1:]...)
+		binaries = append(binaries, pluginBinary{Name: plugin.Name, Args: args, Hash: hash})
+	}
+	return binaries, nil
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16], nil
+}
+
+// PluginRewriter runs plugin executable on files selected by Filter.
+type PluginRewriter struct {
+	Plugin  pluginBinary
+	Command string
+	Filter  alib.FileFilter
+	Replace bool
+}
+
+// Id returns plugin name.
+func (p PluginRewriter) Id() string {
+	return p.Plugin.Name
+}
+
+// Inject tells whether plugin rewrites file.
+func (p PluginRewriter) Inject(pkg string, filePath string) bool {
+	return p.Filter(pkg, filePath)
+}
+
+// ReplaceSource tells whether rewritten file replaces the original.
+func (p PluginRewriter) ReplaceSource(pkg string, filePath string) bool {
+	return p.Replace
+}
+
+// Rewrite runs plugin on file. Failures are logged and leave file
+// unchanged, the driver calls RewriteFile to report them instead.
+func (p PluginRewriter) Rewrite(pkg string, file *ast.File, fset *token.FileSet, trace *os.File) {
+	if err := p.RewriteFile(pkg, file, fset, trace); err != nil {
+		logger.Warn("plugin "+p.Plugin.Name+" failed, file is left unchanged",
+			"file", fset.Position(file.Package).Filename, "error", err)
+	}
+}
+
+// RewriteFile runs plugin on file and replaces file with the result.
+func (p PluginRewriter) RewriteFile(pkg string, file *ast.File, fset *token.FileSet, trace *os.File) error {
+	var src bytes.Buffer
+	if err := printer.Fprint(&src, fset, file); err != nil {
+		return err
+	}
+	filePath := fset.Position(file.Package).Filename
+	request, err := json.Marshal(pluginRequest{Version: pluginProtocolVersion, Rewriter: p.Plugin.Name,
+		Command: p.Command, Package: pkg, Path: filePath, Source: src.String()})
+	if err != nil {
+		return err
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(p.Plugin.Args[0], p.Plugin.Args[1:]...)
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("plugin failed: %w: %s", err, msg)
+		}
+		return fmt.Errorf("plugin failed: %w", err)
+	}
+	var response pluginResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return fmt.Errorf("invalid plugin response: %w", err)
+	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+	if response.Source == "" || response.Source == src.String() {
+		return nil
+	}
+	rewritten, err := parser.ParseFile(fset, filePath, response.Source, parser.ParseComments)
+	if err != nil {
+		return fmt.Errorf("plugin returned invalid source: %v", err)
+	}
+	*file = *rewritten
+	return nil
+}
+
+// rewritesSource marks plugins as sourceRewriter.
+func (p PluginRewriter) rewritesSource() {}
+
+// WriteExtraFiles adds no files.
+func (p PluginRewriter) WriteExtraFiles(pkg string, destPath string) []string {
+	return nil
+}
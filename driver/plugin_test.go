@@ -0,0 +1,186 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/parser"
+	"go/printer"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+)
+
+// pluginModeEnv makes test binary act as plugin, see TestMain.
+const pluginModeEnv = "INSTRGEN_TEST_PLUGIN"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(pluginModeEnv); mode != "" {
+		os.Exit(runTestPlugin(mode))
+	}
+	os.Exit(m.Run())
+}
+
+// runTestPlugin answers single plugin request the way mode tells.
+func runTestPlugin(mode string) int {
+	var request pluginRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&request); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	var response pluginResponse
+	switch mode {
+	case "append":
+		response.Source = request.Source + "\nfunc " + request.Rewriter + "() {\n}\n"
+	case "unchanged":
+	case "error":
+		response.Error = "forbidden in " + request.Package
+	case "exit":
+		fmt.Fprintln(os.Stderr, "boom")
+		return 2
+	case "invalid":
+		response.Source = "package"
+	}
+	json.NewEncoder(os.Stdout).Encode(response)
+	return 0
+}
+
+func testPlugin(t *testing.T, mode string) PluginRewriter {
+	t.Setenv(pluginModeEnv, mode)
+	self, err := os.Executable()
+	require.NoError(t, err)
+	return PluginRewriter{Plugin: pluginBinary{Name: "audit", Args: []string{self}}, Command: "inject",
+		Filter: func(string, string) bool { return true }}
+}
+
+func TestPluginRewriter(t *testing.T) {
+	src := []byte("package main\n\n// f is kept.\nfunc f() {\n}\n")
+	rewriterS := []alib.PackageRewriter{testPlugin(t, "append"), RenamingRewriter{suffix: "_b"}}
+	out, err := rewriteSource(rewriterS, "main", "f.go", src)
+	require.NoError(t, err)
+	assert.Equal(t, "package main\n\n// f is kept.\nfunc f_b() {\n}\n\nfunc audit_b() {\n}\n", string(out))
+
+	result := rewriteChain(rewriterS[:1], "main", "f.go", "f.go", token.NewFileSet(), src, nil)
+	require.True(t, result.ok())
+	assert.Equal(t, []FileReport{{Path: "f.go", Rewriter: "audit", Status: statusInstrumented, Functions: []string{"audit"}}}, result.reports)
+
+	rewriterS = []alib.PackageRewriter{testPlugin(t, "unchanged")}
+	result = rewriteChain(rewriterS, "main", "f.go", "f.go", token.NewFileSet(), src, nil)
+	assert.Empty(t, result.errs)
+	assert.False(t, result.changed)
+
+	for mode, msg := range map[string]string{
+		"error":   "f.go:1: instrgen audit: forbidden in main",
+		"exit":    "f.go:1: instrgen audit: plugin failed: exit status 2: boom",
+		"invalid": "f.go:1: instrgen audit: plugin returned invalid source: f.go:1:8: expected 'IDENT', found 'EOF'",
+	} {
+		rewriterS = []alib.PackageRewriter{testPlugin(t, mode)}
+		result = rewriteChain(rewriterS, "main", "f.go", "f.go", token.NewFileSet(), src, nil)
+		require.Len(t, result.errs, 1, mode)
+		assert.Equal(t, msg, result.errs[0].Error(), mode)
+
+		// Rewrite of PackageRewriter leaves file unchanged
+		fset := token.NewFileSet()
+		file, err := parser.ParseFile(fset, "f.go", src, parser.ParseComments)
+		require.NoError(t, err)
+		testPlugin(t, mode).Rewrite("main", file, fset, nil)
+		var out bytes.Buffer
+		require.NoError(t, printer.Fprint(&out, fset, file))
+		assert.Equal(t, string(src), out.String(), mode)
+	}
+}
+
+func TestResolvePlugins(t *testing.T) {
+	root := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "tools"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(root, "tools", "audit"), []byte("#!/bin/sh\n"), 0755))
+	plugins, err := resolvePlugins(root, []Plugin{{Name: "audit", Command: []string{"./tools/audit", "-v"}}})
+	require.NoError(t, err)
+	require.Len(t, plugins, 1)
+	assert.Equal(t, []string{filepath.Join(root, "tools", "audit"), "-v"}, plugins[0].Args)
+	assert.NotEmpty(t, plugins[0].Hash)
+
+	// changed executable changes command file fingerprint
+	require.NoError(t, os.WriteFile(filepath.Join(root, "tools", "audit"), []byte("#!/bin/sh\nexit 0\n"), 0755))
+	changed, err := resolvePlugins(root, []Plugin{{Name: "audit", Command: []string{"./tools/audit", "-v"}}})
+	require.NoError(t, err)
+	assert.NotEqual(t, plugins[0].Hash, changed[0].Hash)
+
+	_, err = resolvePlugins(root, []Plugin{{Name: "missing", Command: []string{"instrgen-missing-plugin"}}})
+	assert.ErrorContains(t, err, "plugin missing:")
+}
+
+func TestMakePluginRewriters(t *testing.T) {
+	cfg, err := parseConfig("instrgen.yaml", []byte("version: 1\nrewriters: [runtime, audit, basic]\nplugins:\n  - name: audit\n    command: [audit]\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{runtimeRewriterName, "audit", basicRewriterName}, cfg.rewriters())
+	plugins := []pluginBinary{{Name: "audit", Args: []string{"/bin/audit"}}}
+	rewriterS := makeRewriters(InstrgenCmd{ProjectPath: "/src/app", Cmd: "inject", Config: cfg, Plugins: plugins}, make(map[string]string))
+	require.Len(t, rewriterS, 3)
+	assert.Equal(t, "audit", rewriterS[1].Id())
+	assert.True(t, rewriterS[1].Inject("example.com/app", "/src/app/main.go"))
+	assert.False(t, rewriterS[1].Inject("example.com/lib", "/src/lib/lib.go"))
+}
+
+// buildDriver builds driver binary into temporary directory.
+func buildDriver(t *testing.T) string {
+	t.Helper()
+	bin := filepath.Join(t.TempDir(), programName)
+	out, err := exec.Command("go", "build", "-o", bin, ".").CombinedOutput()
+	require.NoError(t, err, string(out))
+	return bin
+}
+
+func TestReplaceRebuilds(t *testing.T) {
+	bin := buildDriver(t)
+	self, err := os.Executable()
+	require.NoError(t, err)
+	t.Setenv(pluginModeEnv, "append")
+	dir := writeModule(t)
+	config := "version: 1\nreplace: true\nrewriters: [audit]\nplugins:\n  - name: audit\n    command: [" + self + "]\n"
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "instrgen.yaml"), []byte(config), 0644))
+	mainPath := filepath.Join(dir, "main.go")
+	src, err := os.ReadFile(mainPath)
+	require.NoError(t, err)
+	run := func(args ...string) {
+		cmd := exec.Command(bin, args...)
+		cmd.Dir = dir
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	run("inject")
+	content, err := os.ReadFile(mainPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "func audit() {")
+
+	// sources are rewritten again though compiled package is cached
+	require.NoError(t, os.WriteFile(mainPath, src, 0644))
+	run("inject")
+	content, err = os.ReadFile(mainPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(content), "func audit() {")
+}
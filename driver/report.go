@@ -0,0 +1,418 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/ast"
+	"go/printer"
+	"go/token"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// reportRecordsFile collects records appended by toolexec processes.
+	reportRecordsFile = workDir + "/records.jsonl"
+	// reportFile holds report of the last inject or prune build.
+	reportFile = workDir + "/report.json"
+)
+
+// Statuses of rewritten files.
+const (
+	statusInstrumented = "instrumented"
+	statusEnriched     = "enriched"
+	statusPruned       = "pruned"
+	statusSkipped      = "skipped"
+	statusFailed       = "failed"
+)
+
+// Skip reasons.
+const (
+	reasonExcluded  = "excluded by config"
+	reasonUnchanged = "nothing to rewrite"
+)
+
+// FileReport describes what single rewriter did with a file.
+type FileReport struct {
+	Path     string `json:"path"`
+	Rewriter string `json:"rewriter"`
+	Status   string `json:"status"`
+	// Reason tells why file was skipped or failed.
+	Reason string `json:"reason,omitempty"`
+	// Functions lists functions changed by rewriter.
+	Functions []string `json:"functions,omitempty"`
+}
+
+// PackageReport holds reports of files of single package.
+type PackageReport struct {
+	Path  string       `json:"path"`
+	Files []FileReport `json:"files"`
+	// Cached packages were not compiled by the last build,
+	// their files are reported as rewritten by an earlier one.
+	Cached bool `json:"cached,omitempty"`
+}
+
+// Report of inject or prune build.
+type Report struct {
+	Command  string          `json:"command"`
+	Packages []PackageReport `json:"packages"`
+	// Summary counts file reports by status.
+	Summary map[string]int `json:"summary"`
+}
+
+// reportRecord is single line of records file.
+type reportRecord struct {
+	Package string `json:"package"`
+	FileReport
+}
+
+// reportRecorder appends records of rewritten files. Every compiled
+// package is handled by separate toolexec process, records are appended
+// one line per write, so concurrent processes do not interleave them.
+// Methods of nil recorder do nothing.
+type reportRecorder struct {
+	file    *os.File
+	modules []Module
+}
+
+func newReportRecorder(modules []Module) *reportRecorder {
+	file, err := os.OpenFile(reportRecordsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil
+	}
+	return &reportRecorder{file: file, modules: modules}
+}
+
+func (r *reportRecorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	return r.file.Close()
+}
+
+// inProject tells whether file belongs to one of project modules.
+func (r *reportRecorder) inProject(filePath string) bool {
+	for _, module := range r.modules {
+		if module.Dir != "" && strings.HasPrefix(filePath, module.Dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *reportRecorder) record(pkg string, report FileReport) {
+	if r == nil {
+		return
+	}
+	// files outside of the project are reported only when touched
+	if report.Status == statusSkipped && report.Reason == reasonExcluded && !r.inProject(report.Path) {
+		return
+	}
+	line, err := json.Marshal(reportRecord{Package: pkg, FileReport: report})
+	if err != nil {
+		return
+	}
+	r.file.Write(append(line, '\n'))
+}
+
+// rewriterStatus returns status of file changed by rewriter with given id.
+func rewriterStatus(id string) string {
+	switch id {
+	case "Zerolog":
+		return statusEnriched
+	case "Pruner":
+		return statusPruned
+	}
+	return statusInstrumented
+}
+
+// funcName returns name of function declaration, methods are
+// prefixed with receiver type.
+func funcName(decl *ast.FuncDecl) string {
+	if decl.Recv == nil || len(decl.Recv.List) == 0 {
+		return decl.Name.Name
+	}
+	recv := decl.Recv.List[0].Type
+	if star, ok := recv.(*ast.StarExpr); ok {
+		recv = star.X
+	}
+	switch t := recv.(type) {
+	case *ast.IndexExpr:
+		recv = t.X
+	case *ast.IndexListExpr:
+		recv = t.X
+	}
+	if ident, ok := recv.(*ast.Ident); ok {
+		return ident.Name + "." + decl.Name.Name
+	}
+	return decl.Name.Name
+}
+
+// declSnapshot prints top level declarations of file, comparing
+// snapshots taken before and after rewriting tells what was changed.
+// Functions are keyed by name, other declarations by position in file.
+// Declarations are printed without positions and doc comments, so code
+// laid out anew, like prologue refreshed by BasicRewriter, is not a change.
+func declSnapshot(file *ast.File) map[string]string {
+	noPositions := token.NewFileSet()
+	snapshot := make(map[string]string)
+	for i, decl := range file.Decls {
+		key := "#" + strconv.Itoa(i)
+		if funcDecl, ok := decl.(*ast.FuncDecl); ok {
+			key = funcName(funcDecl)
+			// init may be declared many times
+			for n := 2; snapshot[key] != ""; n++ {
+				key = funcName(funcDecl) + "#" + strconv.Itoa(n)
+			}
+		}
+		// without positions doc comments are printed anywhere
+		switch d := decl.(type) {
+		case *ast.FuncDecl:
+			undocumented := *d
+			undocumented.Doc = nil
+			decl = &undocumented
+		case *ast.GenDecl:
+			undocumented := *d
+			undocumented.Doc = nil
+			decl = &undocumented
+		}
+		var out bytes.Buffer
+		printer.Fprint(&out, noPositions, decl)
+		snapshot[key] = out.String()
+	}
+	return snapshot
+}
+
+// compareSnapshots returns sorted names of changed functions and tells
+// whether anything changed at all.
+func compareSnapshots(before, after map[string]string) ([]string, bool) {
+	changed := len(before) != len(after)
+	var functions []string
+	for key, decl := range after {
+		if before[key] == decl {
+			continue
+		}
+		changed = true
+		if !strings.HasPrefix(key, "#") {
+			name, _, _ := strings.Cut(key, "#")
+			functions = append(functions, name)
+		}
+	}
+	sort.Strings(functions)
+	return functions, changed
+}
+
+// buildReport aggregates records appended during the build.
+func buildReport(command string, recordsPath string) (Report, error) {
+	report := Report{Command: command, Packages: []PackageReport{}, Summary: make(map[string]int)}
+	file, err := os.Open(recordsPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return report, nil
+		}
+		return report, err
+	}
+	defer file.Close()
+	packages := make(map[string]*PackageReport)
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// the same package may be compiled more than once, e.g. by go test
+		if line == "" || seen[line] {
+			continue
+		}
+		seen[line] = true
+		var record reportRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return report, fmt.Errorf("%s: %w", recordsPath, err)
+		}
+		pkg := packages[record.Package]
+		if pkg == nil {
+			pkg = &PackageReport{Path: record.Package}
+			packages[record.Package] = pkg
+		}
+		pkg.Files = append(pkg.Files, record.FileReport)
+	}
+	if err := scanner.Err(); err != nil {
+		return report, err
+	}
+	for _, pkg := range packages {
+		sort.SliceStable(pkg.Files, func(i, j int) bool {
+			if pkg.Files[i].Path != pkg.Files[j].Path {
+				return pkg.Files[i].Path < pkg.Files[j].Path
+			}
+			return pkg.Files[i].Rewriter < pkg.Files[j].Rewriter
+		})
+		report.Packages = append(report.Packages, *pkg)
+	}
+	sort.Slice(report.Packages, func(i, j int) bool {
+		return report.Packages[i].Path < report.Packages[j].Path
+	})
+	report.summarize()
+	return report, nil
+}
+
+// summarize counts file reports by status.
+func (report *Report) summarize() {
+	report.Summary = make(map[string]int)
+	for _, pkg := range report.Packages {
+		for _, file := range pkg.Files {
+			report.Summary[file.Status]++
+		}
+	}
+}
+
+// mergeCached adds packages of previous report which belong to the last
+// build but were not compiled by it, go build took them from its cache.
+// built holds import paths of packages of the last build.
+func (report *Report) mergeCached(previous Report, built map[string]bool) {
+	if previous.Command != report.Command {
+		return
+	}
+	compiled := make(map[string]bool)
+	for _, pkg := range report.Packages {
+		compiled[pkg.Path] = true
+	}
+	for _, pkg := range previous.Packages {
+		if built[pkg.Path] && !compiled[pkg.Path] {
+			pkg.Cached = true
+			report.Packages = append(report.Packages, pkg)
+		}
+	}
+	sort.Slice(report.Packages, func(i, j int) bool {
+		return report.Packages[i].Path < report.Packages[j].Path
+	})
+	report.summarize()
+}
+
+// goValueFlags are flags of go build, go test and go run followed by
+// their value, unless given as -flag=value.
+var goValueFlags = map[string]bool{
+	"C": true, "o": true, "p": true, "asmflags": true, "buildmode": true, "compiler": true,
+	"gccgoflags": true, "gcflags": true, "installsuffix": true, "ldflags": true, "mod": true,
+	"modfile": true, "overlay": true, "pgo": true, "pkgdir": true, "tags": true, "toolexec": true,
+	"covermode": true, "coverpkg": true, "exec": true, "bench": true, "benchtime": true,
+	"blockprofile": true, "blockprofilerate": true, "count": true, "coverprofile": true,
+	"cpu": true, "cpuprofile": true, "fuzz": true, "fuzztime": true, "fuzzminimizetime": true,
+	"list": true, "memprofile": true, "memprofilerate": true, "mutexprofile": true,
+	"mutexprofilefraction": true, "outputdir": true, "parallel": true, "run": true,
+	"shuffle": true, "skip": true, "timeout": true, "trace": true, "vet": true,
+}
+
+// packagePatterns returns package patterns and -C directory given in
+// goArgs, go subcommand followed by its arguments. Arguments following
+// packages of go test and go run belong to the test or program.
+func packagePatterns(goArgs []string) (patterns []string, dir string) {
+	args := goArgs[1:]
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if strings.HasPrefix(arg, "-") {
+			if len(patterns) > 0 {
+				break
+			}
+			name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+			if !hasValue && goValueFlags[name] && i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+			if name == "C" {
+				dir = value
+			}
+			continue
+		}
+		if goArgs[0] == "run" && len(patterns) > 0 && !strings.HasSuffix(arg, ".go") {
+			break
+		}
+		patterns = append(patterns, arg)
+		if goArgs[0] == "run" && !strings.HasSuffix(arg, ".go") {
+			break
+		}
+	}
+	return patterns, dir
+}
+
+// buildPackages returns import paths of packages built by go command
+// given by goArgs, along with their dependencies.
+func buildPackages(cfg Config, overlay string, goArgs []string) (map[string]bool, error) {
+	patterns, dir := packagePatterns(goArgs)
+	args := []string{"list", "-deps", "-f", "{{.ImportPath}}"}
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	if goArgs[0] == "test" {
+		args = append(args, "-test")
+	}
+	if len(cfg.Tags) > 0 {
+		args = append(args, "-tags", strings.Join(cfg.Tags, ","))
+	}
+	if overlay != "" {
+		args = append(args, "-overlay", overlay)
+	}
+	out, err := exec.Command("go", append(args, patterns...)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list: %w", err)
+	}
+	built := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		// test variants are listed as "path [path.test]"
+		path, _, _ := strings.Cut(line, " ")
+		built[path] = true
+	}
+	return built, nil
+}
+
+// writeReport turns records appended during the build into report file.
+// Packages of the previous report found in built are kept as cached.
+func writeReport(command string, built map[string]bool) (Report, error) {
+	report, err := buildReport(command, reportRecordsFile)
+	if err != nil {
+		return report, err
+	}
+	if previous, err := readReport(reportFile); err == nil {
+		report.mergeCached(previous, built)
+	}
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return report, err
+	}
+	if err := os.WriteFile(reportFile, append(content, '\n'), 0644); err != nil {
+		return report, err
+	}
+	if err := os.Remove(reportRecordsFile); err != nil && !os.IsNotExist(err) {
+		return report, err
+	}
+	return report, nil
+}
+
+// readReport reads report of the last build.
+func readReport(path string) (Report, error) {
+	var report Report
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return report, err
+	}
+	err = json.Unmarshal(content, &report)
+	return report, err
+}
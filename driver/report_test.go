@@ -0,0 +1,184 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+	"go.opentelemetry.io/contrib/instrgen/rewriters"
+)
+
+func TestAnalyzeReport(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+	sources := map[string]string{
+		"main.go":   "package main\n\nfunc main() {\n\thelper()\n}\n\nfunc helper() {\n}\n",
+		"types.go":  "package main\n\ntype T struct{}\n\nfunc (t *T) Run() {\n}\n\nvar x = 1\n",
+		"consts.go": "package main\n\nconst c = 1\n",
+		"gen.go":    "package main\n\nfunc generated() {\n}\n",
+		"broken.go": "package main\n\nfunc broken( {\n",
+	}
+	var args []string
+	args = append(args, "/usr/local/go/pkg/tool/compile", "-o", filepath.Join(dir, "_pkg_.a"), "-p", "main", "-pack")
+	for name, src := range sources {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(src), 0644))
+		args = append(args, filepath.Join(dir, name))
+	}
+	cfg := defaultConfig()
+	cfg.Exclude = []string{"gen.go"}
+	rewriterS := []alib.PackageRewriter{rewriters.BasicRewriter{Filter: cfg.filter(dir, basicRewriterName), Replace: "yes",
+		EntryPoints: []alib.EntryPoint{{Pkg: "main", FunName: "main"}}}}
+	modules := []Module{{Path: "example.com/app", Dir: dir}}
+	require.NoError(t, makeWorkDir())
+	analyze(args, rewriterS, make(map[string]string), modules)
+
+	report, err := buildReport("inject", reportRecordsFile)
+	require.NoError(t, err)
+	require.Len(t, report.Packages, 1)
+	assert.Equal(t, "example.com/app", report.Packages[0].Path)
+	files := make(map[string]FileReport)
+	for _, file := range report.Packages[0].Files {
+		assert.Equal(t, "Basic", file.Rewriter)
+		files[filepath.Base(file.Path)] = file
+	}
+	assert.Equal(t, FileReport{Path: filepath.Join(dir, "main.go"), Rewriter: "Basic", Status: statusInstrumented,
+		Functions: []string{"helper", "main"}}, files["main.go"])
+	assert.Equal(t, []string{"T.Run"}, files["types.go"].Functions)
+	assert.Equal(t, statusSkipped, files["consts.go"].Status)
+	assert.Equal(t, reasonUnchanged, files["consts.go"].Reason)
+	assert.Equal(t, statusSkipped, files["gen.go"].Status)
+	assert.Equal(t, reasonExcluded, files["gen.go"].Reason)
+	assert.Equal(t, statusFailed, files["broken.go"].Status)
+	assert.Contains(t, files["broken.go"].Reason, "broken.go:3")
+	assert.Equal(t, map[string]int{statusInstrumented: 2, statusSkipped: 2, statusFailed: 1}, report.Summary)
+
+	// cached packages of the previous build are kept
+	built := map[string]bool{"example.com/app": true}
+	_, err = writeReport("inject", built)
+	require.NoError(t, err)
+	_, err = writeReport("inject", built)
+	require.NoError(t, err)
+	cached, err := readReport(reportFile)
+	require.NoError(t, err)
+	require.Len(t, cached.Packages, 1)
+	assert.True(t, cached.Packages[0].Cached)
+	assert.Equal(t, report.Summary, cached.Summary)
+	// packages outside of the build are not
+	_, err = writeReport("inject", map[string]bool{"example.com/app/cmd/b": true})
+	require.NoError(t, err)
+	other, err := readReport(reportFile)
+	require.NoError(t, err)
+	assert.Empty(t, other.Packages)
+	_, err = writeReport("prune", built)
+	require.NoError(t, err)
+	pruned, err := readReport(reportFile)
+	require.NoError(t, err)
+	assert.Empty(t, pruned.Packages)
+}
+
+func TestReportCommand(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+	executor := &NullExecutor{}
+	err := driverMain([]string{"report"}, executor)
+	assert.ErrorContains(t, err, "no report found")
+
+	report := Report{Command: "inject", Packages: []PackageReport{{Path: "example.com/app", Files: []FileReport{
+		{Path: "main.go", Rewriter: "Basic", Status: statusInstrumented, Functions: []string{"main"}},
+	}}}}
+	report.summarize()
+	content, err := json.Marshal(report)
+	require.NoError(t, err)
+	require.NoError(t, makeWorkDir())
+	require.NoError(t, os.WriteFile(reportFile, content, 0644))
+	require.NoError(t, driverMain([]string{"report"}, executor))
+	require.NoError(t, driverMain([]string{"report", "--json"}, executor))
+
+	report.Packages[0].Files = append(report.Packages[0].Files, FileReport{Path: "gen.go", Rewriter: "Basic", Status: statusFailed, Reason: "gen.go:1:1: expected 'package'"})
+	report.summarize()
+	content, err = json.Marshal(report)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(reportFile, content, 0644))
+	err = driverMain([]string{"report"}, executor)
+	var exitErr *exitError
+	require.True(t, errors.As(err, &exitErr), err)
+	assert.EqualError(t, err, "report: 1 files failed")
+}
+
+func TestDeclSnapshot(t *testing.T) {
+	src := "package p\n\nfunc init() {}\n\nfunc init() {}\n\ntype G[T any] struct{}\n\nfunc (g G[T]) M() {}\n\nfunc (g *G[T]) P() {}\n"
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "p.go", src, 0)
+	require.NoError(t, err)
+	snapshot := declSnapshot(file)
+	assert.Contains(t, snapshot, "init")
+	assert.Contains(t, snapshot, "init#2")
+	assert.Contains(t, snapshot, "G.M")
+	assert.Contains(t, snapshot, "G.P")
+
+	after := make(map[string]string)
+	for k, v := range snapshot {
+		after[k] = v
+	}
+	after["init#2"] = "func init() { x() }"
+	functions, changed := compareSnapshots(snapshot, after)
+	assert.True(t, changed)
+	assert.Equal(t, []string{"init"}, functions)
+	functions, changed = compareSnapshots(snapshot, snapshot)
+	assert.False(t, changed)
+	assert.Empty(t, functions)
+}
+
+func TestPackagePatterns(t *testing.T) {
+	tests := []struct {
+		goArgs   []string
+		patterns []string
+		dir      string
+	}{
+		{[]string{"build"}, nil, ""},
+		{[]string{"build", "-o", "bin/app", "-race", "-ldflags=-s", "./cmd/a", "./cmd/b"}, []string{"./cmd/a", "./cmd/b"}, ""},
+		{[]string{"build", "-C", "app", "-tags", "netgo", "."}, []string{"."}, "app"},
+		{[]string{"test", "-run", "TestApp", "./...", "-count", "1"}, []string{"./..."}, ""},
+		{[]string{"test", "./a", "./b", "-args", "x"}, []string{"./a", "./b"}, ""},
+		{[]string{"run", ".", "--port", "8080"}, []string{"."}, ""},
+		{[]string{"run", "main.go", "util.go", "serve"}, []string{"main.go", "util.go"}, ""},
+	}
+	for _, test := range tests {
+		patterns, dir := packagePatterns(test.goArgs)
+		assert.Equal(t, test.patterns, patterns, test.goArgs)
+		assert.Equal(t, test.dir, dir, test.goArgs)
+	}
+}
+
+func TestBuildPackages(t *testing.T) {
+	chdir(t, writeModule(t))
+	built, err := buildPackages(defaultConfig(), "", []string{"build", "-o", "bin/app", "."})
+	require.NoError(t, err)
+	assert.True(t, built["example.com/app"])
+	assert.True(t, built["fmt"])
+	assert.False(t, built["net/http"])
+}
@@ -0,0 +1,170 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"runtime"
+	"sync"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+)
+
+// reasonPreviousFailed tells that rewriter did not run on a file
+// because rewriter before it in the chain failed.
+const reasonPreviousFailed = "previous rewriter failed"
+
+// fileRewrite holds result of rewriter chain applied to single file.
+type fileRewrite struct {
+	file *ast.File
+	// reports hold one entry per rewriter of the chain.
+	reports []FileReport
+	errs    []error
+	// applied tells which rewriters of the chain rewrote the file.
+	applied []bool
+	// changed is set when any rewriter changed the file.
+	changed bool
+	// replace is set when every rewriter applied replaces sources.
+	replace bool
+	// source holds line nodes of the file as parsed.
+	source sourceNodes
+	// parsed holds nodes having positions of parsed source.
+	parsed parsedNodes
+}
+
+// ok tells whether file was rewritten without errors and has to be written.
+func (r *fileRewrite) ok() bool {
+	return r.changed && len(r.errs) == 0
+}
+
+// rewriteChain parses file once and applies rewriters to the same AST in
+// order, each rewriter sees changes of the previous ones. When src is nil
+// the file is read from filePath. reportPath is path reported for the file.
+// The chain stops at the first failure and the file is left unchanged.
+func rewriteChain(rewriterS []alib.PackageRewriter, pkg string, filePath string, reportPath string,
+	fset *token.FileSet, src []byte, trace *os.File) *fileRewrite {
+	result := &fileRewrite{applied: make([]bool, len(rewriterS)), replace: true}
+	var parseErr error
+	parsed := false
+	for i, rewriter := range rewriterS {
+		report := FileReport{Path: reportPath, Rewriter: rewriter.Id()}
+		switch {
+		case len(result.errs) > 0:
+			report.Status, report.Reason = statusSkipped, reasonPreviousFailed
+		case !rewriter.Inject(pkg, filePath):
+			report.Status, report.Reason = statusSkipped, reasonExcluded
+		default:
+			if !parsed {
+				// nil slice would be parsed as empty source
+				var source any
+				if src != nil {
+					source = src
+				}
+				result.file, parseErr = parser.ParseFile(fset, filePath, source, parser.ParseComments)
+				parsed = true
+				if parseErr == nil {
+					result.source = collectSourceNodes(result.file)
+					result.parsed = collectParsedNodes(result.file)
+				}
+			}
+			err := parseErr
+			var functions []string
+			var changed bool
+			// plugins print the file and parse their output again,
+			// they get changes of previous rewriters formatted
+			_, reparsed := rewriter.(sourceRewriter)
+			if err == nil && reparsed && result.changed {
+				err = result.reformat(fset, filePath)
+			}
+			if err == nil {
+				before := declSnapshot(result.file)
+				if err = rewriteFile(rewriter, pkg, result.file, fset, trace); err == nil {
+					functions, changed = compareSnapshots(before, declSnapshot(result.file))
+					if reparsed {
+						result.parsed = collectParsedNodes(result.file)
+					}
+				}
+			}
+			if err != nil {
+				rewriteErr := newRewriteError(reportPath, report.Rewriter, err)
+				result.errs = append(result.errs, rewriteErr)
+				report.Status, report.Reason = statusFailed, rewriteErr.Error()
+				break
+			}
+			result.applied[i] = true
+			result.replace = result.replace && rewriter.ReplaceSource(pkg, filePath)
+			report.Status, report.Functions = rewriterStatus(rewriter.Id()), functions
+			if !changed {
+				report.Status, report.Reason = statusSkipped, reasonUnchanged
+			}
+			result.changed = result.changed || changed
+		}
+		result.reports = append(result.reports, report)
+	}
+	return result
+}
+
+// format prints rewritten file, see formatFile.
+func (r *fileRewrite) format(fset *token.FileSet) ([]byte, error) {
+	return formatFile(fset, r.file, r.parsed)
+}
+
+// reformat replaces rewritten file with its formatted source parsed again.
+func (r *fileRewrite) reformat(fset *token.FileSet, filePath string) error {
+	content, err := r.format(fset)
+	if err != nil {
+		return err
+	}
+	file, err := parser.ParseFile(fset, filePath, content, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+	*r.file = *file
+	r.parsed = collectParsedNodes(r.file)
+	return nil
+}
+
+// rewriteJobs returns number of files rewritten concurrently.
+func rewriteJobs(files int) int {
+	jobs := runtime.GOMAXPROCS(0)
+	if files < jobs {
+		jobs = files
+	}
+	return jobs
+}
+
+// forEachFile calls fn for indexes of n files on bounded number
+// of goroutines and waits for all of them.
+func forEachFile(n int, fn func(i int)) {
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for j := 0; j < rewriteJobs(n); j++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
@@ -0,0 +1,110 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+)
+
+// RenamingRewriter appends suffix to names of all functions.
+type RenamingRewriter struct {
+	suffix  string
+	replace bool
+}
+
+func (r RenamingRewriter) Id() string { return "Renaming" + r.suffix }
+
+func (RenamingRewriter) Inject(pkg string, filepath string) bool { return true }
+
+func (r RenamingRewriter) ReplaceSource(pkg string, filePath string) bool { return r.replace }
+
+func (r RenamingRewriter) Rewrite(pkg string, file *ast.File, fset *token.FileSet, trace *os.File) {
+	for _, decl := range file.Decls {
+		if funcDecl, ok := decl.(*ast.FuncDecl); ok {
+			funcDecl.Name.Name += r.suffix
+		}
+	}
+}
+
+func (RenamingRewriter) WriteExtraFiles(pkg string, destPath string) []string { return nil }
+
+func TestRewriteChain(t *testing.T) {
+	src := []byte("package main\n\nfunc f() {\n}\n")
+	rewriterS := []alib.PackageRewriter{RenamingRewriter{suffix: "_a"}, PanickingRewriter{}, RenamingRewriter{suffix: "_b"}}
+
+	result := rewriteChain(rewriterS[:1], "main", "f.go", "f.go", token.NewFileSet(), src, nil)
+	require.True(t, result.ok())
+	assert.False(t, result.replace)
+	assert.Equal(t, []FileReport{{Path: "f.go", Rewriter: "Renaming_a", Status: statusInstrumented, Functions: []string{"f_a"}}}, result.reports)
+
+	// every rewriter gets the AST changed by the previous one
+	out, err := rewriteSource([]alib.PackageRewriter{rewriterS[0], rewriterS[2]}, "main", "f.go", src)
+	require.NoError(t, err)
+	assert.Equal(t, "package main\n\nfunc f_a_b() {\n}\n", string(out))
+
+	// chain stops at the first failure
+	result = rewriteChain(rewriterS, "main", "f.go", "f.go", token.NewFileSet(), src, nil)
+	assert.False(t, result.ok())
+	require.Len(t, result.errs, 1)
+	assert.Equal(t, []bool{true, false, false}, result.applied)
+	assert.Equal(t, statusFailed, result.reports[1].Status)
+	assert.Equal(t, FileReport{Path: "f.go", Rewriter: "Renaming_b", Status: statusSkipped, Reason: reasonPreviousFailed}, result.reports[2])
+}
+
+func TestAnalyzePackageOrder(t *testing.T) {
+	dir := t.TempDir()
+	destPath := t.TempDir()
+	args := []string{"/usr/local/go/pkg/tool/compile", "-o", filepath.Join(destPath, "_pkg_.a"), "-p", "main", "-pack"}
+	filePaths := make(map[string]int)
+	for i := 0; i < 64; i++ {
+		filePath := filepath.Join(dir, fmt.Sprintf("f%02d.go", i))
+		src := fmt.Sprintf("package main\n\nfunc f%02d() {\n}\n", i)
+		require.NoError(t, os.WriteFile(filePath, []byte(src), 0644))
+		filePaths[filePath] = len(args)
+		args = append(args, filePath)
+	}
+	rewriterS := []alib.PackageRewriter{RenamingRewriter{suffix: "_a"}, RenamingRewriter{suffix: "_b"}}
+	remappedFilePaths := make(map[string]string)
+	args, errs := analyzePackage(rewriterS, "main", filePaths, nil, nil, destPath, args, remappedFilePaths)
+	require.Empty(t, errs)
+	for i := 0; i < 64; i++ {
+		newFileName := args[6+i]
+		assert.Equal(t, filepath.Join(destPath, fmt.Sprintf("f%02d.go", i)), newFileName)
+		assert.Equal(t, filepath.Join(dir, fmt.Sprintf("f%02d.go", i)), remappedFilePaths[newFileName])
+		content, err := os.ReadFile(newFileName)
+		require.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("//line %s:1\npackage main\n\nfunc f%02d_a_b() {\n}\n", remappedFilePaths[newFileName], i), string(content))
+	}
+	assert.Len(t, filePaths, 64)
+
+	// errors follow order of files too
+	_, errs = analyzePackage([]alib.PackageRewriter{PanickingRewriter{}}, "main", filePaths, nil, nil, destPath, args, remappedFilePaths)
+	require.Len(t, errs, 64)
+	for i, err := range errs {
+		assert.Contains(t, err.Error(), filepath.Join(dir, fmt.Sprintf("f%02d.go", i))+":1: ")
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"go/ast"
+	"go/scanner"
+	"go/token"
+	"os"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+)
+
+// rewriteError describes failure of rewriter on a file.
+type rewriteError struct {
+	Pos      token.Position
+	Rewriter string
+	Err      error
+}
+
+// newRewriteError returns error of rewriter failing on file. Position
+// is taken from parser errors, other errors point to the file itself.
+func newRewriteError(filePath string, rewriter string, err error) *rewriteError {
+	pos := token.Position{Filename: filePath, Line: 1}
+	var list scanner.ErrorList
+	if errors.As(err, &list) && len(list) > 0 {
+		pos = list[0].Pos
+		err = errors.New(list[0].Msg)
+	}
+	return &rewriteError{Pos: pos, Rewriter: rewriter, Err: err}
+}
+
+// Error returns diagnostic in file:line:column form, understood by editors.
+func (e *rewriteError) Error() string {
+	return fmt.Sprintf("%s: instrgen %s: %v", e.Pos, e.Rewriter, e.Err)
+}
+
+func (e *rewriteError) Unwrap() error {
+	return e.Err
+}
+
+// fileRewriter is implemented by rewriters reporting failures as errors.
+type fileRewriter interface {
+	RewriteFile(pkg string, file *ast.File, fset *token.FileSet, trace *os.File) error
+}
+
+// sourceRewriter is implemented by rewriters printing the file and parsing
+// their output again, all nodes of the file are replaced then.
+type sourceRewriter interface {
+	rewritesSource()
+}
+
+// rewriteFile runs rewriter on file, turning its panic into error.
+func rewriteFile(rewriter alib.PackageRewriter, pkg string, file *ast.File, fset *token.FileSet, trace *os.File) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("rewriter panicked: %v", r)
+		}
+	}()
+	if rewriter, ok := rewriter.(fileRewriter); ok {
+		return rewriter.RewriteFile(pkg, file, fset, trace)
+	}
+	rewriter.Rewrite(pkg, file, fset, trace)
+	return nil
+}
+
+// strictError returns error aborting toolexec compile when any
+// rewriter failed in strict mode, nil otherwise.
+func strictError(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	return &exitError{code: exitRewriteFailed, err: fmt.Errorf("strict mode: %d files failed to rewrite", len(errs))}
+}
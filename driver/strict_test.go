@@ -0,0 +1,117 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"go/ast"
+	"go/token"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+	"go.opentelemetry.io/contrib/instrgen/rewriters"
+)
+
+// PanickingRewriter fails on every file it rewrites.
+type PanickingRewriter struct{}
+
+func (PanickingRewriter) Id() string { return "Panicking" }
+
+func (PanickingRewriter) Inject(pkg string, filepath string) bool { return true }
+
+func (PanickingRewriter) ReplaceSource(pkg string, filePath string) bool { return false }
+
+func (PanickingRewriter) Rewrite(pkg string, file *ast.File, fset *token.FileSet, trace *os.File) {
+	panic("unexpected node")
+}
+
+func (PanickingRewriter) WriteExtraFiles(pkg string, destPath string) []string { return nil }
+
+func TestStrictToolExecMain(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+	mainPath := filepath.Join(dir, "main.go")
+	brokenPath := filepath.Join(dir, "broken.go")
+	require.NoError(t, os.WriteFile(mainPath, []byte("package main\n\nfunc main() {\n}\n"), 0644))
+	require.NoError(t, os.WriteFile(brokenPath, []byte("package main\n\nfunc broken( {\n"), 0644))
+	args := func() []string {
+		return []string{"/usr/local/go/pkg/tool/compile", "-o", filepath.Join(dir, "_pkg_.a"), "-p", "main", "-pack", mainPath, brokenPath}
+	}
+	rewriterS := []alib.PackageRewriter{rewriters.BasicRewriter{Filter: defaultConfig().filter(dir, basicRewriterName), Replace: "yes",
+		EntryPoints: []alib.EntryPoint{{Pkg: "main", FunName: "main"}}}}
+
+	executor := &NullExecutor{}
+	err := toolExecMain(args(), rewriterS, executor, make(map[string]string), nil, false)
+	require.NoError(t, err)
+	assert.Len(t, executor.commands, 1)
+
+	executor = &NullExecutor{}
+	err = toolExecMain(args(), rewriterS, executor, make(map[string]string), nil, true)
+	var exitErr *exitError
+	require.ErrorAs(t, err, &exitErr)
+	assert.Equal(t, exitRewriteFailed, exitErr.code)
+	assert.Empty(t, executor.commands)
+
+	_, errs := analyze(args(), []alib.PackageRewriter{PanickingRewriter{}}, make(map[string]string), nil)
+	require.Len(t, errs, 2)
+	// errors follow order of files in compiler arguments
+	assert.EqualError(t, errs[0], mainPath+":1: instrgen Panicking: rewriter panicked: unexpected node")
+	assert.EqualError(t, errs[1], brokenPath+":3:14: instrgen Panicking: expected ')', found '{'")
+}
+
+// RecordingExecutor appends given record to records file when run,
+// as toolexec process would.
+type RecordingExecutor struct {
+	NullExecutor
+	record reportRecord
+	err    error
+}
+
+func (executor *RecordingExecutor) Run() error {
+	recorder := newReportRecorder(nil)
+	defer recorder.Close()
+	recorder.record(executor.record.Package, executor.record.FileReport)
+	return executor.err
+}
+
+func TestStrictExecuteCommand(t *testing.T) {
+	dir := t.TempDir()
+	chdir(t, dir)
+	require.NoError(t, os.WriteFile("go.mod", []byte("module example.com/app\n"), 0644))
+	failed := reportRecord{Package: "example.com/app", FileReport: FileReport{Path: filepath.Join(dir, "broken.go"),
+		Rewriter: "Basic", Status: statusFailed, Reason: "broken.go:3:14: instrgen Basic: expected ')'"}}
+
+	cfg := defaultConfig()
+	err := executeCommand("inject", ".", cfg, []string{"build"}, &RecordingExecutor{record: failed})
+	require.NoError(t, err)
+
+	cfg.Strict = true
+	err = executeCommand("inject", ".", cfg, []string{"build"}, &RecordingExecutor{record: failed, err: errors.New("exit status 1")})
+	var exitErr *exitError
+	require.ErrorAs(t, err, &exitErr)
+	assert.Equal(t, exitRewriteFailed, exitErr.code)
+	assert.Contains(t, err.Error(), reportFile)
+
+	failed.Status = statusInstrumented
+	err = executeCommand("inject", ".", cfg, []string{"build"}, &RecordingExecutor{record: failed})
+	require.NoError(t, err)
+}
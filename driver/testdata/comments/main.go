@@ -0,0 +1,45 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//nolint:all // Linter is executed at the same time as tests which leads to race conditions and failures.
+package main
+
+import (
+	"fmt"
+  _ "go.opentelemetry.io/otel"
+	_ "context"
+)
+
+// greeting   is used by greet.
+const greeting="hello"
+
+func greet(name string)string{ // called by welcome only
+	// names are trimmed by callers
+	return greeting+", "+name
+}
+
+// welcome prints greeting
+// of every name.
+func welcome(names ...string) {
+
+    for _, name := range names {
+		fmt.Println(greet(name)) // one per line
+	}
+	// done
+}
+
+func main() {
+	welcome("instrgen",
+		"gofmt") // two names
+}
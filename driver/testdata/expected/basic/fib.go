@@ -16,30 +16,52 @@
 package main
 
 import (
-	"fmt"
-	__atel_runtime "runtime"
+	_ "context"
 	__atel_context "context"
+	"fmt"
 	_ "go.opentelemetry.io/otel"
 	__atel_otel "go.opentelemetry.io/otel"
-	_ "context"
+	__atel_sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	__atel_trace "go.opentelemetry.io/otel/trace"
+	__atel_runtime "runtime"
 )
 
 func foo() {
-	__atel_tracing_ctx := __atel_runtime.InstrgenGetTls().(__atel_context.Context)
+	__atel_tracing_ctx := __atel_context.Background()
+	if __atel_tracing_ctx_runtime, ok := __atel_runtime.InstrgenGetTls().(__atel_context.Context); ok {
+		__atel_tracing_ctx = __atel_tracing_ctx_runtime
+	}
 	defer __atel_runtime.InstrgenSetTls(__atel_tracing_ctx)
 	__atel_child_tracing_ctx, __atel_span := __atel_otel.Tracer("foo").Start(__atel_tracing_ctx, "foo")
 	__atel_runtime.InstrgenSetTls(__atel_child_tracing_ctx)
 	defer __atel_span.End()
+	__atel_spanCtx := __atel_trace.SpanContextFromContext(__atel_child_tracing_ctx)
+	_ = __atel_spanCtx
+	__atel_parent_span_id := ""
+	if __atel_rdspan, ok := __atel_span.(__atel_sdktrace.ReadOnlySpan); ok {
+		__atel_parent_span_id = __atel_rdspan.Parent().SpanID().String()
+	}
+	_ = __atel_parent_span_id
 
 	fmt.Println("foo")
 }
 
 func FibonacciHelper(n uint) (uint64, error) {
-	__atel_tracing_ctx := __atel_runtime.InstrgenGetTls().(__atel_context.Context)
+	__atel_tracing_ctx := __atel_context.Background()
+	if __atel_tracing_ctx_runtime, ok := __atel_runtime.InstrgenGetTls().(__atel_context.Context); ok {
+		__atel_tracing_ctx = __atel_tracing_ctx_runtime
+	}
 	defer __atel_runtime.InstrgenSetTls(__atel_tracing_ctx)
 	__atel_child_tracing_ctx, __atel_span := __atel_otel.Tracer("FibonacciHelper").Start(__atel_tracing_ctx, "FibonacciHelper")
 	__atel_runtime.InstrgenSetTls(__atel_child_tracing_ctx)
 	defer __atel_span.End()
+	__atel_spanCtx := __atel_trace.SpanContextFromContext(__atel_child_tracing_ctx)
+	_ = __atel_spanCtx
+	__atel_parent_span_id := ""
+	if __atel_rdspan, ok := __atel_span.(__atel_sdktrace.ReadOnlySpan); ok {
+		__atel_parent_span_id = __atel_rdspan.Parent().SpanID().String()
+	}
+	_ = __atel_parent_span_id
 
 	func() {
 
@@ -49,11 +71,21 @@ func FibonacciHelper(n uint) (uint64, error) {
 }
 
 func Fibonacci(n uint) (uint64, error) {
-	__atel_tracing_ctx := __atel_runtime.InstrgenGetTls().(__atel_context.Context)
+	__atel_tracing_ctx := __atel_context.Background()
+	if __atel_tracing_ctx_runtime, ok := __atel_runtime.InstrgenGetTls().(__atel_context.Context); ok {
+		__atel_tracing_ctx = __atel_tracing_ctx_runtime
+	}
 	defer __atel_runtime.InstrgenSetTls(__atel_tracing_ctx)
 	__atel_child_tracing_ctx, __atel_span := __atel_otel.Tracer("Fibonacci").Start(__atel_tracing_ctx, "Fibonacci")
 	__atel_runtime.InstrgenSetTls(__atel_child_tracing_ctx)
 	defer __atel_span.End()
+	__atel_spanCtx := __atel_trace.SpanContextFromContext(__atel_child_tracing_ctx)
+	_ = __atel_spanCtx
+	__atel_parent_span_id := ""
+	if __atel_rdspan, ok := __atel_span.(__atel_sdktrace.ReadOnlySpan); ok {
+		__atel_parent_span_id = __atel_rdspan.Parent().SpanID().String()
+	}
+	_ = __atel_parent_span_id
 
 	if n <= 1 {
 		return uint64(n), nil
@@ -16,21 +16,33 @@
 package main
 
 import (
-	"fmt"
-	__atel_runtime "runtime"
+	_ "context"
 	__atel_context "context"
+	"fmt"
 	"go.opentelemetry.io/contrib/instrgen/rtlib"
-	__atel_otel "go.opentelemetry.io/otel"
 	_ "go.opentelemetry.io/otel"
-	_ "context"
+	__atel_otel "go.opentelemetry.io/otel"
+	__atel_sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	__atel_trace "go.opentelemetry.io/otel/trace"
+	__atel_runtime "runtime"
 )
 
 func recur(n int) {
-	__atel_tracing_ctx := __atel_runtime.InstrgenGetTls().(__atel_context.Context)
+	__atel_tracing_ctx := __atel_context.Background()
+	if __atel_tracing_ctx_runtime, ok := __atel_runtime.InstrgenGetTls().(__atel_context.Context); ok {
+		__atel_tracing_ctx = __atel_tracing_ctx_runtime
+	}
 	defer __atel_runtime.InstrgenSetTls(__atel_tracing_ctx)
 	__atel_child_tracing_ctx, __atel_span := __atel_otel.Tracer("recur").Start(__atel_tracing_ctx, "recur")
 	__atel_runtime.InstrgenSetTls(__atel_child_tracing_ctx)
 	defer __atel_span.End()
+	__atel_spanCtx := __atel_trace.SpanContextFromContext(__atel_child_tracing_ctx)
+	_ = __atel_spanCtx
+	__atel_parent_span_id := ""
+	if __atel_rdspan, ok := __atel_span.(__atel_sdktrace.ReadOnlySpan); ok {
+		__atel_parent_span_id = __atel_rdspan.Parent().SpanID().String()
+	}
+	_ = __atel_parent_span_id
 
 	if n > 0 {
 		recur(n - 1)
@@ -46,6 +58,13 @@ func main() {
 	_ = __atel_child_tracing_ctx
 	defer __atel_span.End()
 	__atel_runtime.InstrgenSetTls(__atel_child_tracing_ctx)
+	__atel_spanCtx := __atel_trace.SpanContextFromContext(__atel_child_tracing_ctx)
+	_ = __atel_spanCtx
+	__atel_parent_span_id := ""
+	if __atel_rdspan, ok := __atel_span.(__atel_sdktrace.ReadOnlySpan); ok {
+		__atel_parent_span_id = __atel_rdspan.Parent().SpanID().String()
+	}
+	_ = __atel_parent_span_id
 
 	rtlib.AutotelEntryPoint()
 	fmt.Println(FibonacciHelper(10))
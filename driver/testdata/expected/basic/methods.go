@@ -16,11 +16,13 @@
 package main
 
 import (
+	_ "context"
+	__atel_context "context"
 	_ "go.opentelemetry.io/otel"
-	__atel_runtime "runtime"
 	__atel_otel "go.opentelemetry.io/otel"
-	__atel_context "context"
-	_ "context"
+	__atel_sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	__atel_trace "go.opentelemetry.io/otel/trace"
+	__atel_runtime "runtime"
 )
 
 type element struct {
@@ -38,49 +40,99 @@ type impl struct {
 }
 
 func (i impl) anotherfoo(p int) int {
-	__atel_tracing_ctx := __atel_runtime.InstrgenGetTls().(__atel_context.Context)
+	__atel_tracing_ctx := __atel_context.Background()
+	if __atel_tracing_ctx_runtime, ok := __atel_runtime.InstrgenGetTls().(__atel_context.Context); ok {
+		__atel_tracing_ctx = __atel_tracing_ctx_runtime
+	}
 	defer __atel_runtime.InstrgenSetTls(__atel_tracing_ctx)
 	__atel_child_tracing_ctx, __atel_span := __atel_otel.Tracer("anotherfoo").Start(__atel_tracing_ctx, "anotherfoo")
 	__atel_runtime.InstrgenSetTls(__atel_child_tracing_ctx)
 	defer __atel_span.End()
+	__atel_spanCtx := __atel_trace.SpanContextFromContext(__atel_child_tracing_ctx)
+	_ = __atel_spanCtx
+	__atel_parent_span_id := ""
+	if __atel_rdspan, ok := __atel_span.(__atel_sdktrace.ReadOnlySpan); ok {
+		__atel_parent_span_id = __atel_rdspan.Parent().SpanID().String()
+	}
+	_ = __atel_parent_span_id
 
 	return 5
 }
 
 func anotherfoo(p int) int {
-	__atel_tracing_ctx := __atel_runtime.InstrgenGetTls().(__atel_context.Context)
+	__atel_tracing_ctx := __atel_context.Background()
+	if __atel_tracing_ctx_runtime, ok := __atel_runtime.InstrgenGetTls().(__atel_context.Context); ok {
+		__atel_tracing_ctx = __atel_tracing_ctx_runtime
+	}
 	defer __atel_runtime.InstrgenSetTls(__atel_tracing_ctx)
 	__atel_child_tracing_ctx, __atel_span := __atel_otel.Tracer("anotherfoo").Start(__atel_tracing_ctx, "anotherfoo")
 	__atel_runtime.InstrgenSetTls(__atel_child_tracing_ctx)
 	defer __atel_span.End()
+	__atel_spanCtx := __atel_trace.SpanContextFromContext(__atel_child_tracing_ctx)
+	_ = __atel_spanCtx
+	__atel_parent_span_id := ""
+	if __atel_rdspan, ok := __atel_span.(__atel_sdktrace.ReadOnlySpan); ok {
+		__atel_parent_span_id = __atel_rdspan.Parent().SpanID().String()
+	}
+	_ = __atel_parent_span_id
 
 	return 1
 }
 
 func (d driver) process(a int) {
-	__atel_tracing_ctx := __atel_runtime.InstrgenGetTls().(__atel_context.Context)
+	__atel_tracing_ctx := __atel_context.Background()
+	if __atel_tracing_ctx_runtime, ok := __atel_runtime.InstrgenGetTls().(__atel_context.Context); ok {
+		__atel_tracing_ctx = __atel_tracing_ctx_runtime
+	}
 	defer __atel_runtime.InstrgenSetTls(__atel_tracing_ctx)
 	__atel_child_tracing_ctx, __atel_span := __atel_otel.Tracer("process").Start(__atel_tracing_ctx, "process")
 	__atel_runtime.InstrgenSetTls(__atel_child_tracing_ctx)
 	defer __atel_span.End()
+	__atel_spanCtx := __atel_trace.SpanContextFromContext(__atel_child_tracing_ctx)
+	_ = __atel_spanCtx
+	__atel_parent_span_id := ""
+	if __atel_rdspan, ok := __atel_span.(__atel_sdktrace.ReadOnlySpan); ok {
+		__atel_parent_span_id = __atel_rdspan.Parent().SpanID().String()
+	}
+	_ = __atel_parent_span_id
 
 }
 
 func (e element) get(a int) {
-	__atel_tracing_ctx := __atel_runtime.InstrgenGetTls().(__atel_context.Context)
+	__atel_tracing_ctx := __atel_context.Background()
+	if __atel_tracing_ctx_runtime, ok := __atel_runtime.InstrgenGetTls().(__atel_context.Context); ok {
+		__atel_tracing_ctx = __atel_tracing_ctx_runtime
+	}
 	defer __atel_runtime.InstrgenSetTls(__atel_tracing_ctx)
 	__atel_child_tracing_ctx, __atel_span := __atel_otel.Tracer("get").Start(__atel_tracing_ctx, "get")
 	__atel_runtime.InstrgenSetTls(__atel_child_tracing_ctx)
 	defer __atel_span.End()
+	__atel_spanCtx := __atel_trace.SpanContextFromContext(__atel_child_tracing_ctx)
+	_ = __atel_spanCtx
+	__atel_parent_span_id := ""
+	if __atel_rdspan, ok := __atel_span.(__atel_sdktrace.ReadOnlySpan); ok {
+		__atel_parent_span_id = __atel_rdspan.Parent().SpanID().String()
+	}
+	_ = __atel_parent_span_id
 
 }
 
 func methods() {
-	__atel_tracing_ctx := __atel_runtime.InstrgenGetTls().(__atel_context.Context)
+	__atel_tracing_ctx := __atel_context.Background()
+	if __atel_tracing_ctx_runtime, ok := __atel_runtime.InstrgenGetTls().(__atel_context.Context); ok {
+		__atel_tracing_ctx = __atel_tracing_ctx_runtime
+	}
 	defer __atel_runtime.InstrgenSetTls(__atel_tracing_ctx)
 	__atel_child_tracing_ctx, __atel_span := __atel_otel.Tracer("methods").Start(__atel_tracing_ctx, "methods")
 	__atel_runtime.InstrgenSetTls(__atel_child_tracing_ctx)
 	defer __atel_span.End()
+	__atel_spanCtx := __atel_trace.SpanContextFromContext(__atel_child_tracing_ctx)
+	_ = __atel_spanCtx
+	__atel_parent_span_id := ""
+	if __atel_rdspan, ok := __atel_span.(__atel_sdktrace.ReadOnlySpan); ok {
+		__atel_parent_span_id = __atel_rdspan.Parent().SpanID().String()
+	}
+	_ = __atel_parent_span_id
 
 	d := driver{}
 	d.process(10)
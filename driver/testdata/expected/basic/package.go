@@ -16,30 +16,52 @@
 package main
 
 import (
-	"os"
-	__atel_runtime "runtime"
+	_ "context"
 	__atel_context "context"
 	_ "go.opentelemetry.io/otel"
 	__atel_otel "go.opentelemetry.io/otel"
-	_ "context"
+	__atel_sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	__atel_trace "go.opentelemetry.io/otel/trace"
+	"os"
+	__atel_runtime "runtime"
 )
 
 func Close() error {
-	__atel_tracing_ctx := __atel_runtime.InstrgenGetTls().(__atel_context.Context)
+	__atel_tracing_ctx := __atel_context.Background()
+	if __atel_tracing_ctx_runtime, ok := __atel_runtime.InstrgenGetTls().(__atel_context.Context); ok {
+		__atel_tracing_ctx = __atel_tracing_ctx_runtime
+	}
 	defer __atel_runtime.InstrgenSetTls(__atel_tracing_ctx)
 	__atel_child_tracing_ctx, __atel_span := __atel_otel.Tracer("Close").Start(__atel_tracing_ctx, "Close")
 	__atel_runtime.InstrgenSetTls(__atel_child_tracing_ctx)
 	defer __atel_span.End()
+	__atel_spanCtx := __atel_trace.SpanContextFromContext(__atel_child_tracing_ctx)
+	_ = __atel_spanCtx
+	__atel_parent_span_id := ""
+	if __atel_rdspan, ok := __atel_span.(__atel_sdktrace.ReadOnlySpan); ok {
+		__atel_parent_span_id = __atel_rdspan.Parent().SpanID().String()
+	}
+	_ = __atel_parent_span_id
 
 	return nil
 }
 
 func pack() {
-	__atel_tracing_ctx := __atel_runtime.InstrgenGetTls().(__atel_context.Context)
+	__atel_tracing_ctx := __atel_context.Background()
+	if __atel_tracing_ctx_runtime, ok := __atel_runtime.InstrgenGetTls().(__atel_context.Context); ok {
+		__atel_tracing_ctx = __atel_tracing_ctx_runtime
+	}
 	defer __atel_runtime.InstrgenSetTls(__atel_tracing_ctx)
 	__atel_child_tracing_ctx, __atel_span := __atel_otel.Tracer("pack").Start(__atel_tracing_ctx, "pack")
 	__atel_runtime.InstrgenSetTls(__atel_child_tracing_ctx)
 	defer __atel_span.End()
+	__atel_spanCtx := __atel_trace.SpanContextFromContext(__atel_child_tracing_ctx)
+	_ = __atel_spanCtx
+	__atel_parent_span_id := ""
+	if __atel_rdspan, ok := __atel_span.(__atel_sdktrace.ReadOnlySpan); ok {
+		__atel_parent_span_id = __atel_rdspan.Parent().SpanID().String()
+	}
+	_ = __atel_parent_span_id
 
 	f, e := os.Create("temp")
 	defer f.Close()
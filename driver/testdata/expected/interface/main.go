@@ -16,12 +16,14 @@
 package main
 
 import (
-	. "go.opentelemetry.io/contrib/instrgen/testdata/interface/app"
-	__atel_runtime "runtime"
-	__atel_otel "go.opentelemetry.io/otel"
 	__atel_context "context"
-	. "go.opentelemetry.io/contrib/instrgen/testdata/interface/serializer"
 	"go.opentelemetry.io/contrib/instrgen/rtlib"
+	. "go.opentelemetry.io/contrib/instrgen/testdata/interface/app"
+	. "go.opentelemetry.io/contrib/instrgen/testdata/interface/serializer"
+	__atel_otel "go.opentelemetry.io/otel"
+	__atel_sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	__atel_trace "go.opentelemetry.io/otel/trace"
+	__atel_runtime "runtime"
 )
 
 func main() {
@@ -33,6 +35,13 @@ func main() {
 	_ = __atel_child_tracing_ctx
 	defer __atel_span.End()
 	__atel_runtime.InstrgenSetTls(__atel_child_tracing_ctx)
+	__atel_spanCtx := __atel_trace.SpanContextFromContext(__atel_child_tracing_ctx)
+	_ = __atel_spanCtx
+	__atel_parent_span_id := ""
+	if __atel_rdspan, ok := __atel_span.(__atel_sdktrace.ReadOnlySpan); ok {
+		__atel_parent_span_id = __atel_rdspan.Parent().SpanID().String()
+	}
+	_ = __atel_parent_span_id
 
 	rtlib.AutotelEntryPoint()
 	bs := BasicSerializer{}
@@ -0,0 +1,442 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"golang.org/x/mod/modfile"
+	"golang.org/x/mod/module"
+	"golang.org/x/mod/semver"
+	"golang.org/x/tools/go/packages"
+
+	alib "go.opentelemetry.io/contrib/instrgen/lib"
+)
+
+// Vendored modules are built from their vendor directory only. Inject
+// adds modules needed by instrumented code to go.mod with go get run
+// against module cache, never network, and copies the packages into
+// vendor directory itself the way go mod vendor would. Go mod vendor is
+// not used, it needs every dependency of the module in module cache.
+
+// offlineEnv makes go commands resolve modules from module cache only.
+// Vendor directory is ignored with -mod=mod, other flags of GOFLAGS are
+// kept.
+func offlineEnv() []string {
+	goflags := []string{"-mod=mod"}
+	for _, flag := range strings.Fields(os.Getenv("GOFLAGS")) {
+		if name, _, _ := strings.Cut(strings.TrimLeft(flag, "-"), "="); name != "mod" {
+			goflags = append(goflags, flag)
+		}
+	}
+	return []string{"GOFLAGS=" + strings.Join(goflags, " "), "GOPROXY=off"}
+}
+
+// vendorEdit records files added to vendor directory by inject.
+type vendorEdit struct {
+	// Files lists added files relative to module directory.
+	Files      []string `json:"files"`
+	ModulesTxt fileEdit `json:"modules_txt"`
+}
+
+// modFlag returns value of -mod flag set by GOFLAGS.
+func modFlag() string {
+	value := ""
+	for _, flag := range strings.Fields(os.Getenv("GOFLAGS")) {
+		if name, v, ok := strings.Cut(strings.TrimLeft(flag, "-"), "="); ok && name == "mod" {
+			value = v
+		}
+	}
+	return value
+}
+
+// vendorMode tells whether go command builds module in dir from
+// its vendor directory, see go help modules.
+func vendorMode(dir string) (bool, error) {
+	switch modFlag() {
+	case "vendor":
+		return true, nil
+	case "mod", "readonly":
+		return false, nil
+	}
+	// vendor directories of workspace modules are ignored
+	if gowork, err := findWorkspace(dir); err != nil || gowork != "" {
+		return false, err
+	}
+	if _, err := os.Stat(filepath.Join(dir, "vendor", "modules.txt")); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	content, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return false, err
+	}
+	file, err := modfile.ParseLax("go.mod", content, nil)
+	if err != nil {
+		return false, err
+	}
+	return file.Go != nil && semver.Compare("v"+file.Go.Version, "v1.14") >= 0, nil
+}
+
+// withEnv runs f with environment variables set, commands started
+// by executors inherit them.
+func withEnv(env []string, f func() error) error {
+	for _, kv := range env {
+		key, value, _ := strings.Cut(kv, "=")
+		previous, ok := os.LookupEnv(key)
+		os.Setenv(key, value)
+		if ok {
+			defer os.Setenv(key, previous)
+		} else {
+			defer os.Unsetenv(key)
+		}
+	}
+	return f()
+}
+
+// isStandard tells whether package belongs to standard library.
+func isStandard(pkgPath string) bool {
+	first, _, _ := strings.Cut(pkgPath, "/")
+	return !strings.Contains(first, ".")
+}
+
+// vendorBlock is module section of vendor/modules.txt.
+type vendorBlock struct {
+	path        string
+	header      string
+	annotations []string
+	pkgs        []string
+}
+
+func (block *vendorBlock) version() string {
+	fields := strings.Fields(block.header)
+	if len(fields) < 3 {
+		return ""
+	}
+	return fields[2]
+}
+
+func (block *vendorBlock) explicit() bool {
+	for _, annotation := range block.annotations {
+		for _, field := range strings.Split(strings.TrimPrefix(annotation, "##"), ";") {
+			if strings.TrimSpace(field) == "explicit" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// modulesTxt holds blocks of vendor/modules.txt by module path.
+type modulesTxt map[string]*vendorBlock
+
+func parseModulesTxt(content []byte) modulesTxt {
+	blocks := make(modulesTxt)
+	var block *vendorBlock
+	for _, line := range strings.Split(string(content), "\n") {
+		switch {
+		case strings.HasPrefix(line, "## "):
+			if block != nil {
+				block.annotations = append(block.annotations, line)
+			}
+		case strings.HasPrefix(line, "# "):
+			fields := strings.Fields(line)
+			block = &vendorBlock{path: fields[1], header: line}
+			blocks[block.path] = block
+		case line != "" && block != nil:
+			block.pkgs = append(block.pkgs, line)
+		}
+	}
+	return blocks
+}
+
+func (blocks modulesTxt) hasPackage(pkgPath string) bool {
+	for _, block := range blocks {
+		for _, pkg := range block.pkgs {
+			if pkg == pkgPath {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// format prints blocks sorted by module path, like go mod vendor does.
+func (blocks modulesTxt) format() []byte {
+	paths := make([]string, 0, len(blocks))
+	for path := range blocks {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var out bytes.Buffer
+	for _, path := range paths {
+		block := blocks[path]
+		out.WriteString(block.header + "\n")
+		for _, line := range block.annotations {
+			out.WriteString(line + "\n")
+		}
+		for _, line := range block.pkgs {
+			out.WriteString(line + "\n")
+		}
+	}
+	return out.Bytes()
+}
+
+// isVendored tells whether all non standard packages are vendored in dir.
+func isVendored(dir string, pkgs []string) (bool, error) {
+	content, err := readOptional(filepath.Join(dir, "vendor", "modules.txt"))
+	if err != nil {
+		return false, err
+	}
+	blocks := parseModulesTxt(content)
+	for _, pkg := range pkgs {
+		if !isStandard(pkg) && !blocks.hasPackage(pkg) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// moduleGoVersion returns go version declared by go.mod of module
+// in module cache, empty string when unknown.
+func moduleGoVersion(mod module.Version) string {
+	cache := os.Getenv("GOMODCACHE")
+	if cache == "" {
+		cache = filepath.Join(filepath.SplitList(build.Default.GOPATH)[0], "pkg", "mod")
+	}
+	path, err := module.EscapePath(mod.Path)
+	if err != nil {
+		return ""
+	}
+	version, err := module.EscapeVersion(mod.Version)
+	if err != nil {
+		return ""
+	}
+	content, err := os.ReadFile(filepath.Join(cache, "cache", "download", path, "@v", version+".mod"))
+	if err != nil {
+		return ""
+	}
+	file, err := modfile.ParseLax("go.mod", content, nil)
+	if err != nil || file.Go == nil {
+		return ""
+	}
+	return file.Go.Version
+}
+
+// isVendorFile tells whether go mod vendor copies file of package directory.
+func isVendorFile(entry os.DirEntry) bool {
+	name := entry.Name()
+	return entry.Type().IsRegular() && !strings.HasSuffix(name, "_test.go") &&
+		!strings.HasPrefix(name, ".") && !strings.HasPrefix(name, "_") &&
+		name != "go.mod" && name != "go.sum"
+}
+
+// isLicenseFile tells whether file of module root is license
+// or notice, go mod vendor keeps them with vendored modules.
+func isLicenseFile(entry os.DirEntry) bool {
+	name := strings.ToUpper(entry.Name())
+	for _, prefix := range []string{"LICENSE", "LICENCE", "COPYING", "NOTICE", "PATENTS"} {
+		if strings.HasPrefix(name, prefix) {
+			return entry.Type().IsRegular()
+		}
+	}
+	return false
+}
+
+// copyFiles copies files of srcDir selected by keep into dstDir, existing
+// files are left alone. It returns paths of copied files.
+func copyFiles(srcDir string, dstDir string, keep func(os.DirEntry) bool) ([]string, error) {
+	entries, err := os.ReadDir(srcDir)
+	if err != nil {
+		return nil, err
+	}
+	var copied []string
+	for _, entry := range entries {
+		dst := filepath.Join(dstDir, entry.Name())
+		if !keep(entry) || alib.FileExists(dst) {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(srcDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dstDir, 0755); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(dst, content, 0644); err != nil {
+			return nil, err
+		}
+		copied = append(copied, dst)
+	}
+	return copied, nil
+}
+
+// vendorPackages copies packages and their dependencies missing in vendor
+// directory of module in dir from module cache and lists them in
+// vendor/modules.txt. Modules required by go.mod are marked explicit.
+func vendorPackages(dir string, pkgPaths []string) (*vendorEdit, error) {
+	modulesPath := filepath.Join(dir, "vendor", "modules.txt")
+	before, err := readOptional(modulesPath)
+	if err != nil {
+		return nil, err
+	}
+	edit := &vendorEdit{ModulesTxt: fileEdit{Before: before}}
+	blocks := parseModulesTxt(before)
+
+	conf := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedImports | packages.NeedDeps | packages.NeedModule,
+		Dir:  dir,
+		Env:  append(os.Environ(), offlineEnv()...),
+	}
+	roots, err := packages.Load(conf, pkgPaths...)
+	if err != nil {
+		return nil, err
+	}
+	var loadErr error
+	var pkgs []*packages.Package
+	packages.Visit(roots, nil, func(pkg *packages.Package) {
+		if len(pkg.Errors) > 0 && loadErr == nil {
+			loadErr = fmt.Errorf("%s: %s", pkg.PkgPath, pkg.Errors[0].Msg)
+		}
+		if pkg.Module != nil && !pkg.Module.Main && !blocks.hasPackage(pkg.PkgPath) {
+			pkgs = append(pkgs, pkg)
+		}
+	})
+	if loadErr != nil {
+		return nil, loadErr
+	}
+
+	for _, pkg := range pkgs {
+		mod := pkg.Module
+		block := blocks[mod.Path]
+		if block == nil {
+			header := "# " + mod.Path + " " + mod.Version
+			if mod.Replace != nil {
+				header += " => " + strings.TrimSpace(mod.Replace.Path+" "+mod.Replace.Version)
+			}
+			block = &vendorBlock{path: mod.Path, header: header}
+			if mod.GoVersion != "" {
+				block.annotations = []string{"## go " + mod.GoVersion}
+			}
+			blocks[mod.Path] = block
+		} else if block.version() != mod.Version {
+			return nil, fmt.Errorf("%s is vendored at %s, instrumented code needs %s, update vendor directory with go mod vendor",
+				mod.Path, block.version(), mod.Version)
+		}
+		block.pkgs = append(block.pkgs, pkg.PkgPath)
+		sort.Strings(block.pkgs)
+
+		srcDir := pkg.Dir
+		if srcDir == "" && len(pkg.GoFiles) > 0 {
+			srcDir = filepath.Dir(pkg.GoFiles[0])
+		}
+		moduleDir := mod.Dir
+		if mod.Replace != nil {
+			moduleDir = mod.Replace.Dir
+		}
+		copied, err := copyFiles(srcDir, filepath.Join(dir, "vendor", filepath.FromSlash(pkg.PkgPath)), isVendorFile)
+		if err != nil {
+			return nil, err
+		}
+		licenses, err := copyFiles(moduleDir, filepath.Join(dir, "vendor", filepath.FromSlash(mod.Path)), isLicenseFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range append(copied, licenses...) {
+			rel, err := filepath.Rel(dir, path)
+			if err != nil {
+				return nil, err
+			}
+			edit.Files = append(edit.Files, filepath.ToSlash(rel))
+		}
+	}
+
+	// every requirement of go.mod has to be marked explicit
+	gomod, err := os.ReadFile(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		return nil, err
+	}
+	file, err := modfile.ParseLax("go.mod", gomod, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, req := range file.Require {
+		block := blocks[req.Mod.Path]
+		if block == nil {
+			block = &vendorBlock{path: req.Mod.Path, header: "# " + req.Mod.String()}
+			if goVersion := moduleGoVersion(req.Mod); goVersion != "" {
+				block.annotations = []string{"## go " + goVersion}
+			}
+			blocks[req.Mod.Path] = block
+		}
+		if block.explicit() {
+			continue
+		}
+		if len(block.annotations) > 0 {
+			block.annotations[0] = "## explicit; " + strings.TrimPrefix(block.annotations[0], "## ")
+		} else {
+			block.annotations = []string{"## explicit"}
+		}
+	}
+
+	edit.ModulesTxt.After = blocks.format()
+	if err := os.MkdirAll(filepath.Dir(modulesPath), 0755); err != nil {
+		return nil, err
+	}
+	return edit, os.WriteFile(modulesPath, edit.ModulesTxt.After, 0644)
+}
+
+// unvendor removes files added to vendor directory of module in dir by inject.
+func unvendor(dir string, edit *vendorEdit) error {
+	modulesPath := filepath.Join(dir, "vendor", "modules.txt")
+	content, err := readOptional(modulesPath)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(content, edit.ModulesTxt.After) {
+		return fmt.Errorf("%s changed since inject, update vendor directory with go mod vendor", modulesPath)
+	}
+	vendorDir := filepath.Join(dir, "vendor")
+	for _, file := range edit.Files {
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		// drop directories left empty, up to vendor directory
+		for parent := filepath.Dir(path); parent != vendorDir && strings.HasPrefix(parent, vendorDir); parent = filepath.Dir(parent) {
+			if os.Remove(parent) != nil {
+				break
+			}
+		}
+	}
+	if edit.ModulesTxt.Before == nil {
+		if err := os.Remove(modulesPath); err != nil {
+			return err
+		}
+		// vendor directory created by inject
+		os.Remove(vendorDir)
+		return nil
+	}
+	return os.WriteFile(modulesPath, edit.ModulesTxt.Before, 0644)
+}
@@ -0,0 +1,117 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/mod/module"
+)
+
+func TestVendorMode(t *testing.T) {
+	t.Setenv("GOFLAGS", "")
+	t.Setenv("GOWORK", "")
+	chdir(t, t.TempDir())
+	require.NoError(t, os.WriteFile("go.mod", []byte("module example.com/app\n\ngo 1.20\n"), 0644))
+	vendored, err := vendorMode(".")
+	require.NoError(t, err)
+	assert.False(t, vendored)
+
+	require.NoError(t, os.MkdirAll("vendor", 0755))
+	require.NoError(t, os.WriteFile(filepath.Join("vendor", "modules.txt"), nil, 0644))
+	vendored, err = vendorMode(".")
+	require.NoError(t, err)
+	assert.True(t, vendored)
+
+	t.Setenv("GOFLAGS", "-mod=mod")
+	vendored, err = vendorMode(".")
+	require.NoError(t, err)
+	assert.False(t, vendored)
+
+	require.NoError(t, os.WriteFile("go.mod", []byte("module example.com/app\n\ngo 1.13\n"), 0644))
+	t.Setenv("GOFLAGS", "")
+	vendored, err = vendorMode(".")
+	require.NoError(t, err)
+	assert.False(t, vendored)
+	t.Setenv("GOFLAGS", "-tags=x -mod=vendor")
+	vendored, err = vendorMode(".")
+	require.NoError(t, err)
+	assert.True(t, vendored)
+}
+
+func TestOfflineEnv(t *testing.T) {
+	t.Setenv("GOFLAGS", "")
+	assert.Equal(t, []string{"GOFLAGS=-mod=mod", "GOPROXY=off"}, offlineEnv())
+	t.Setenv("GOFLAGS", "-tags=extra -mod=vendor -modcacherw")
+	assert.Equal(t, []string{"GOFLAGS=-mod=mod -tags=extra -modcacherw", "GOPROXY=off"}, offlineEnv())
+}
+
+func TestModulesTxt(t *testing.T) {
+	content := "# example.com/a v1.0.0\n## explicit; go 1.20\nexample.com/a\nexample.com/a/b\n" +
+		"# example.com/c v1.1.0 => ../c\n## go 1.16\n"
+	blocks := parseModulesTxt([]byte(content))
+	assert.Equal(t, content, string(blocks.format()))
+	assert.True(t, blocks.hasPackage("example.com/a/b"))
+	assert.False(t, blocks.hasPackage("example.com/c"))
+	assert.True(t, blocks["example.com/a"].explicit())
+	assert.False(t, blocks["example.com/c"].explicit())
+	assert.Equal(t, "v1.1.0", blocks["example.com/c"].version())
+}
+
+// TestVendorDeps vendors OpenTelemetry modules from module cache, those
+// are dependencies of instrgen module, so the cache holds them.
+func TestVendorDeps(t *testing.T) {
+	t.Setenv("GOFLAGS", "")
+	t.Setenv("GOWORK", "")
+	chdir(t, t.TempDir())
+	gomod := "module example.com/app\n\ngo 1.20\n"
+	require.NoError(t, os.WriteFile("go.mod", []byte(gomod), 0644))
+	require.NoError(t, os.MkdirAll("vendor", 0755))
+	require.NoError(t, os.WriteFile(filepath.Join("vendor", "modules.txt"), nil, 0644))
+	src := "package main\n\nimport \"go.opentelemetry.io/otel/trace\"\n\nvar _ trace.SpanKind\n\nfunc main() {}\n"
+	require.NoError(t, os.WriteFile("main.go", []byte(src), 0644))
+
+	imports := []string{"context", "go.opentelemetry.io/otel/trace"}
+	mods := []module.Version{{Path: "go.opentelemetry.io/otel/trace", Version: otelVersion}}
+	require.NoError(t, addDeps(".", imports, mods, &ToolExecutor{}))
+	assert.FileExists(t, filepath.Join("vendor", "go.opentelemetry.io", "otel", "trace", "trace.go"))
+	assert.FileExists(t, filepath.Join("vendor", "go.opentelemetry.io", "otel", "trace", "LICENSE"))
+	assert.NoFileExists(t, filepath.Join("vendor", "go.opentelemetry.io", "otel", "trace", "trace_test.go"))
+	vendored, err := isVendored(".", imports)
+	require.NoError(t, err)
+	assert.True(t, vendored)
+
+	// vendor directory is consistent with go.mod, build needs no network
+	build := exec.Command("go", "build", "-mod=vendor", "./...")
+	build.Env = append(os.Environ(), "GOPROXY=off")
+	out, err := build.CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	require.NoError(t, removeDeps(&ToolExecutor{}))
+	content, err := os.ReadFile("go.mod")
+	require.NoError(t, err)
+	assert.Equal(t, gomod, string(content))
+	content, err = os.ReadFile(filepath.Join("vendor", "modules.txt"))
+	require.NoError(t, err)
+	assert.Empty(t, content)
+	assert.NoDirExists(t, filepath.Join("vendor", "go.opentelemetry.io"))
+}
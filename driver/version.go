@@ -0,0 +1,95 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+)
+
+// version of instrgen, set at link time with
+// -ldflags "-X main.version=v0.1.0".
+var version = ""
+
+// executable returns absolute path of running binary with symlinks
+// resolved, passed to -toolexec so the wrapper is the very same binary.
+func executable() (string, error) {
+	path, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(path)
+}
+
+var (
+	buildIDOnce sync.Once
+	buildID     string
+	buildIDErr  error
+)
+
+// driverVersion returns version of instrgen followed by content hash
+// of the running binary. Two binaries report the same version only when
+// they are identical, which makes it usable for toolexec handshake.
+func driverVersion() (string, error) {
+	buildIDOnce.Do(func() {
+		buildID, buildIDErr = hashExecutable()
+	})
+	if buildIDErr != nil {
+		return "", buildIDErr
+	}
+	return versionName() + "+" + buildID, nil
+}
+
+// versionName returns human readable version of instrgen.
+func versionName() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
+
+func hashExecutable() (string, error) {
+	path, err := executable()
+	if err != nil {
+		return "", err
+	}
+	return hashFile(path)
+}
+
+// checkHandshake verifies that command file has been written
+// by the same binary that runs as toolexec wrapper.
+func checkHandshake(instrgenCfg InstrgenCmd) error {
+	current, err := driverVersion()
+	if err != nil {
+		return err
+	}
+	if instrgenCfg.Version == current {
+		return nil
+	}
+	self, _ := executable()
+	written := instrgenCfg.Version
+	if written == "" {
+		written = "unknown version"
+	}
+	return fmt.Errorf("%s was written by %s (%s), but toolexec runs %s (%s): "+
+		"build through %s commands instead of invoking go build -toolexec directly, or reinstall instrgen",
+		cmdFile, instrgenCfg.Toolexec, written, self, current, programName)
+}
@@ -0,0 +1,74 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Intermediate state of the driver lives in work directory of the project,
+// the directory go command runs in. Toolexec processes are started by go
+// command in the same directory, so they find it by relative path too.
+const (
+	workDir = ".instrgen"
+	// cmdFile passes command and config to toolexec processes.
+	cmdFile = workDir + "/cmd.json"
+	// traceFile collects arguments of tools invoked by go command.
+	traceFile = workDir + "/args"
+	// logCallsFile lists log calls found by semantic analysis.
+	logCallsFile = workDir + "/logcalls"
+	// overlayFile adds import files to packages, see go help build.
+	overlayFile = workDir + "/overlay.json"
+	// importsDir holds import files added through overlay.
+	importsDir = workDir + "/imports"
+	// tracesFile is written by instrumented binaries run by driver.
+	tracesFile = workDir + "/traces.txt"
+)
+
+// tracesFileEnv overrides file the instrumented binary exports spans to,
+// see rtlib.
+const tracesFileEnv = "INSTRGEN_TRACES_FILE"
+
+// makeWorkDir creates work directory ignored by git.
+func makeWorkDir() error {
+	if err := os.MkdirAll(workDir, 0755); err != nil {
+		return err
+	}
+	gitignore := filepath.Join(workDir, ".gitignore")
+	if _, err := os.Stat(gitignore); err == nil {
+		return nil
+	}
+	return os.WriteFile(gitignore, []byte("*\n"), 0644)
+}
+
+// createWorkFile creates file in work directory.
+func createWorkFile(path string) (*os.File, error) {
+	if err := makeWorkDir(); err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+// inWorkDir tells whether absolute filePath belongs to work directory
+// of the project the go command runs in.
+func inWorkDir(filePath string) bool {
+	dir, err := filepath.Abs(workDir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, filePath)
+	return err == nil && filepath.IsLocal(rel)
+}
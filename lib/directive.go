@@ -0,0 +1,177 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib // import "go.opentelemetry.io/contrib/instrgen/lib"
+
+import (
+	"fmt"
+	"go/ast"
+	"go/scanner"
+	"go/token"
+	"strconv"
+	"strings"
+)
+
+// Directives are comments controlling instrumentation of sources they
+// are written in, like //go: directives they have no space after //.
+const (
+	// IgnoreFileDirective before package clause excludes the file.
+	IgnoreFileDirective = "//instrgen:ignore-file"
+	// IgnoreDirective in doc comment of function excludes the function.
+	IgnoreDirective = "//instrgen:ignore"
+	// SpanDirective in doc comment of function sets options of its span,
+	// like //instrgen:span name="GET /users" kind=server.
+	SpanDirective = "//instrgen:span"
+)
+
+const directivePrefix = "//instrgen:"
+
+// spanKinds are values of kind option of SpanDirective.
+var spanKinds = []string{"internal", "server", "client", "producer", "consumer"}
+
+// SpanOptions holds options of SpanDirective.
+type SpanOptions struct {
+	// Name of span, name of function when empty.
+	Name string
+	// Kind of span, one of spanKinds, internal when empty.
+	Kind string
+}
+
+// FuncDirectives holds directives of function.
+type FuncDirectives struct {
+	Ignore bool
+	Span   SpanOptions
+}
+
+// IgnoredFile tells whether file has IgnoreFileDirective.
+func IgnoredFile(file *ast.File) bool {
+	for _, group := range file.Comments {
+		if group.Pos() > file.Package {
+			break
+		}
+		for _, comment := range group.List {
+			if comment.Text == IgnoreFileDirective {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ParseFuncDirectives returns directives of function declaration. Error
+// tells which directive is malformed, *ast.Comment holding it is returned
+// too, so callers can report its position.
+func ParseFuncDirectives(decl *ast.FuncDecl) (FuncDirectives, *ast.Comment, error) {
+	var directives FuncDirectives
+	if decl.Doc == nil {
+		return directives, nil, nil
+	}
+	for _, comment := range decl.Doc.List {
+		if !strings.HasPrefix(comment.Text, directivePrefix) {
+			continue
+		}
+		name, args, _ := strings.Cut(comment.Text, " ")
+		switch name {
+		case IgnoreDirective:
+			if strings.TrimSpace(args) != "" {
+				return directives, comment, fmt.Errorf("%s takes no options", IgnoreDirective)
+			}
+			directives.Ignore = true
+		case SpanDirective:
+			span, err := parseSpanOptions(args)
+			if err != nil {
+				return directives, comment, fmt.Errorf("%s: %w", SpanDirective, err)
+			}
+			directives.Span = span
+		default:
+			return directives, comment, fmt.Errorf("unknown directive %s", name)
+		}
+	}
+	return directives, nil, nil
+}
+
+// ParseFileDirectives returns directives of functions declared in file.
+// Functions with malformed directives are left out, error lists them
+// with positions of directives.
+func ParseFileDirectives(file *ast.File, fset *token.FileSet) (map[*ast.FuncDecl]FuncDirectives, error) {
+	directives := make(map[*ast.FuncDecl]FuncDirectives)
+	var errs scanner.ErrorList
+	for _, decl := range file.Decls {
+		funcDecl, ok := decl.(*ast.FuncDecl)
+		if !ok {
+			continue
+		}
+		funcDirectives, comment, err := ParseFuncDirectives(funcDecl)
+		if err != nil {
+			errs.Add(fset.Position(comment.Pos()), err.Error())
+			continue
+		}
+		directives[funcDecl] = funcDirectives
+	}
+	return directives, errs.Err()
+}
+
+// parseSpanOptions parses key=value options separated by spaces,
+// values may be quoted.
+func parseSpanOptions(args string) (SpanOptions, error) {
+	var span SpanOptions
+	for args = strings.TrimSpace(args); args != ""; args = strings.TrimSpace(args) {
+		key, rest, ok := strings.Cut(args, "=")
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return span, fmt.Errorf("option %q is not key=value", strings.Fields(args)[0])
+		}
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				return span, fmt.Errorf("option %s: unterminated string", key)
+			}
+			value, _ = strconv.Unquote(quoted)
+			args = rest[len(quoted):]
+			if args != "" && !strings.ContainsAny(args[:1], " \t") {
+				return span, fmt.Errorf("option %s: space expected after value", key)
+			}
+		} else {
+			end := strings.IndexAny(rest, " \t")
+			if end < 0 {
+				end = len(rest)
+			}
+			value, args = rest[:end], rest[end:]
+		}
+		switch key {
+		case "name":
+			if value == "" {
+				return span, fmt.Errorf("option name is empty")
+			}
+			span.Name = value
+		case "kind":
+			if !isSpanKind(value) {
+				return span, fmt.Errorf("unknown span kind %q, expected one of %s", value, strings.Join(spanKinds, ", "))
+			}
+			span.Kind = value
+		default:
+			return span, fmt.Errorf("unknown option %s", key)
+		}
+	}
+	return span, nil
+}
+
+func isSpanKind(kind string) bool {
+	for _, k := range spanKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,66 @@
+// Copyright The OpenTelemetry Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib // import "go.opentelemetry.io/contrib/instrgen/lib"
+
+import (
+	"regexp"
+	"strings"
+)
+
+// EntryPoint identifies function that bootstraps tracer provider.
+// Both Pkg and FunName may contain "*" wildcards matching any string.
+type EntryPoint struct {
+	Pkg     string
+	FunName string
+}
+
+// String returns entry point in package.function form.
+func (e EntryPoint) String() string {
+	return e.Pkg + "." + e.FunName
+}
+
+// Matches tells whether function fun of package with given import path
+// and name is the entry point. Pkg "main" matches every main package.
+func (e EntryPoint) Matches(pkgPath string, pkgName string, fun string) bool {
+	if !matchWildcard(e.FunName, fun) {
+		return false
+	}
+	if e.Pkg == "main" && pkgName == "main" {
+		return true
+	}
+	return matchWildcard(e.Pkg, pkgPath)
+}
+
+// MatchesAny tells whether function matches any of entry points.
+func MatchesAny(entryPoints []EntryPoint, pkgPath string, pkgName string, fun string) bool {
+	for _, e := range entryPoints {
+		if e.Matches(pkgPath, pkgName, fun) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchWildcard(pattern string, s string) bool {
+	if !strings.Contains(pattern, "*") {
+		return pattern == s
+	}
+	parts := strings.Split(pattern, "*")
+	for i := range parts {
+		parts[i] = regexp.QuoteMeta(parts[i])
+	}
+	matched, err := regexp.MatchString("^"+strings.Join(parts, ".*")+"$", s)
+	return err == nil && matched
+}
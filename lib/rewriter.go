@@ -37,3 +37,7 @@ type PackageRewriter interface {
 	// Additional files have to be returned as array of file names.
 	WriteExtraFiles(pkg string, destPath string) []string
 }
+
+// FileFilter tells whether file of given package
+// should be rewritten.
+type FileFilter func(pkg string, filePath string) bool
@@ -19,10 +19,88 @@ import (
 	"go/token"
 	"golang.org/x/tools/go/ast/astutil"
 	"os"
+	"sort"
+	"strconv"
 	"strings"
+
+	"go.opentelemetry.io/contrib/instrgen/lib"
 )
 
-func makeInitStmts(name string) []ast.Stmt {
+// makeDefaultsArgs creates rtlib.WithDefault options passed to
+// rtlib.NewTracingState, sorted by key to keep output stable.
+func makeDefaultsArgs(defaults map[string]string) []ast.Expr {
+	keys := make([]string, 0, len(defaults))
+	for key := range defaults {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var args []ast.Expr
+	for _, key := range keys {
+		args = append(args, &ast.CallExpr{
+			Fun: &ast.SelectorExpr{
+				X: &ast.Ident{
+					Name: "rtlib",
+				},
+				Sel: &ast.Ident{
+					Name: "WithDefault",
+				},
+			},
+			Args: []ast.Expr{
+				&ast.BasicLit{
+					Kind:  token.STRING,
+					Value: strconv.Quote(key),
+				},
+				&ast.BasicLit{
+					Kind:  token.STRING,
+					Value: strconv.Quote(defaults[key]),
+				},
+			},
+		})
+	}
+	return args
+}
+
+// makeStartArgs creates arguments of Tracer.Start call starting span
+// of function name in context ctx, span sets its name and kind.
+func makeStartArgs(ctx string, name string, span lib.SpanOptions) []ast.Expr {
+	spanName := &ast.Ident{
+		Name: `"` + name + `"`,
+	}
+	if span.Name != "" {
+		spanName.Name = strconv.Quote(span.Name)
+	}
+	args := []ast.Expr{
+		&ast.Ident{
+			Name: ctx,
+		},
+		spanName,
+	}
+	if span.Kind != "" {
+		args = append(args, &ast.CallExpr{
+			Fun: &ast.SelectorExpr{
+				X: &ast.Ident{
+					Name: "__atel_trace",
+				},
+				Sel: &ast.Ident{
+					Name: "WithSpanKind",
+				},
+			},
+			Args: []ast.Expr{
+				&ast.SelectorExpr{
+					X: &ast.Ident{
+						Name: "__atel_trace",
+					},
+					Sel: &ast.Ident{
+						Name: "SpanKind" + strings.ToUpper(span.Kind[:1]) + span.Kind[1:],
+					},
+				},
+			},
+		})
+	}
+	return args
+}
+
+func makeInitStmts(name string, defaults map[string]string, span lib.SpanOptions) []ast.Stmt {
 	childTracingSupress := &ast.AssignStmt{
 		Lhs: []ast.Expr{
 			&ast.Ident{
@@ -56,6 +134,7 @@ func makeInitStmts(name string) []ast.Stmt {
 						},
 					},
 					Lparen:   54,
+					Args:     makeDefaultsArgs(defaults),
 					Ellipsis: 0,
 				},
 			},
@@ -161,15 +240,8 @@ func makeInitStmts(name string) []ast.Stmt {
 						Name: "Start",
 					},
 				},
-				Lparen: 62,
-				Args: []ast.Expr{
-					&ast.Ident{
-						Name: "__atel_ctx",
-					},
-					&ast.Ident{
-						Name: `"` + name + `"`,
-					},
-				},
+				Lparen:   62,
+				Args:     makeStartArgs("__atel_ctx", name, span),
 				Ellipsis: 0,
 			},
 		},
@@ -362,7 +434,7 @@ func makeInitStmts(name string) []ast.Stmt {
 	return stmts
 }
 
-func makeSpanStmts(name string, paramName string) []ast.Stmt {
+func makeSpanStmts(name string, paramName string, span lib.SpanOptions) []ast.Stmt {
 	s0 := &ast.AssignStmt{
 		Lhs: []ast.Expr{
 			&ast.Ident{
@@ -500,15 +572,8 @@ func makeSpanStmts(name string, paramName string) []ast.Stmt {
 						Name: "Start",
 					},
 				},
-				Lparen: 62,
-				Args: []ast.Expr{
-					&ast.Ident{
-						Name: paramName,
-					},
-					&ast.Ident{
-						Name: `"` + name + `"`,
-					},
-				},
+				Lparen:   62,
+				Args:     makeStartArgs(paramName, name, span),
 				Ellipsis: 0,
 			},
 		},
@@ -703,13 +768,16 @@ func makeSpanStmts(name string, paramName string) []ast.Stmt {
 	return stmts
 }
 
-// BasicRewriter rewrites all functions according to FilePattern.
+// BasicRewriter rewrites all functions of files selected by Filter.
 type BasicRewriter struct {
-	FilePattern       string
+	Filter            lib.FileFilter
 	Replace           string
-	Pkg               string
-	Fun               string
 	RemappedFilePaths map[string]string
+	// EntryPoints get tracer provider bootstrap instead of regular span.
+	EntryPoints []lib.EntryPoint
+	// Defaults are exporter settings used by instrumented binary
+	// when OTEL_* environment variables are not set.
+	Defaults map[string]string
 }
 
 // Id.
@@ -719,7 +787,7 @@ func (BasicRewriter) Id() string {
 
 // Inject.
 func (b BasicRewriter) Inject(pkg string, filepath string) bool {
-	return strings.Contains(filepath, b.FilePattern) || strings.Contains(b.RemappedFilePaths[filepath], b.FilePattern)
+	return b.Filter(pkg, filepath) || b.Filter(pkg, b.RemappedFilePaths[filepath])
 }
 
 // ReplaceSource.
@@ -727,19 +795,49 @@ func (b BasicRewriter) ReplaceSource(pkg string, filePath string) bool {
 	return b.Replace == "yes"
 }
 
-// Rewrite.
+// Rewrite adds spans to functions of file. Functions with malformed
+// directives are left as they are.
 func (b BasicRewriter) Rewrite(pkg string, file *ast.File, fset *token.FileSet, trace *os.File) {
+	if lib.IgnoredFile(file) {
+		return
+	}
+	directives, _ := lib.ParseFileDirectives(file, fset)
+	b.rewrite(pkg, file, fset, directives)
+}
+
+// RewriteFile adds spans to functions of file. Malformed directive
+// fails the file with scanner.ErrorList pointing to the directive,
+// file is left unchanged then.
+func (b BasicRewriter) RewriteFile(pkg string, file *ast.File, fset *token.FileSet, trace *os.File) error {
+	if lib.IgnoredFile(file) {
+		return nil
+	}
+	directives, err := lib.ParseFileDirectives(file, fset)
+	if err != nil {
+		return err
+	}
+	b.rewrite(pkg, file, fset, directives)
+	return nil
+}
+
+func (b BasicRewriter) rewrite(pkg string, file *ast.File, fset *token.FileSet, directives map[*ast.FuncDecl]lib.FuncDirectives) {
 	visited := make(map[string]bool, 0)
 	ast.Inspect(file, func(n ast.Node) bool {
 		if funDeclNode, ok := n.(*ast.FuncDecl); ok {
+			// functions with malformed directives are left as they are
+			if funcDirectives, ok := directives[funDeclNode]; !ok || funcDirectives.Ignore {
+				return false
+			}
 			// check if functions has been already instrumented
-
 			if _, ok := visited[fset.Position(file.Pos()).String()+":"+funDeclNode.Name.Name+fset.Position(funDeclNode.Pos()).String()]; !ok {
-				if pkg == b.Pkg && funDeclNode.Name.Name == b.Fun {
+				// prologue added by previous runs is replaced, so
+				// sources rewritten in place can be injected again
+				funDeclNode.Body.List = trimPrologue(funDeclNode.Body.List)
+				if funDeclNode.Recv == nil && lib.MatchesAny(b.EntryPoints, pkg, file.Name.Name, funDeclNode.Name.Name) {
 					astutil.AddImport(fset, file, "go.opentelemetry.io/contrib/instrgen/rtlib")
-					funDeclNode.Body.List = append(makeInitStmts(funDeclNode.Name.Name), funDeclNode.Body.List...)
+					funDeclNode.Body.List = append(makeInitStmts(funDeclNode.Name.Name, b.Defaults, directives[funDeclNode].Span), funDeclNode.Body.List...)
 				} else {
-					funDeclNode.Body.List = append(makeSpanStmts(funDeclNode.Name.Name, "__atel_tracing_ctx"), funDeclNode.Body.List...)
+					funDeclNode.Body.List = append(makeSpanStmts(funDeclNode.Name.Name, "__atel_tracing_ctx", directives[funDeclNode].Span), funDeclNode.Body.List...)
 				}
 				astutil.AddNamedImport(fset, file, "__atel_trace", "go.opentelemetry.io/otel/trace")
 				astutil.AddNamedImport(fset, file, "__atel_sdktrace", "go.opentelemetry.io/otel/sdk/trace")
@@ -20,15 +20,20 @@ import (
 	"golang.org/x/tools/go/ast/astutil"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+
+	"go.opentelemetry.io/contrib/instrgen/lib"
 )
 
-// ZerologRewriter rewrites all functions according to FilePattern.
+// LogCtxEnricher adds tracing context to log calls of files selected by Filter.
 type LogCtxEnricher struct {
-	FilePattern       string
+	Filter lib.FileFilter
+	// Spans selects files BasicRewriter adds spans to, log calls of their
+	// functions refer to span context it declares. Nil when BasicRewriter
+	// does not run.
+	Spans             lib.FileFilter
 	Replace           string
-	Pkg               string
-	Fun               string
 	LogCalls          map[string]string
 	RemappedFilePaths map[string]string
 }
@@ -40,7 +45,7 @@ func (LogCtxEnricher) Id() string {
 
 // Inject.
 func (b LogCtxEnricher) Inject(pkg string, filepath string) bool {
-	return strings.Contains(filepath, b.FilePattern)
+	return b.Filter(pkg, filepath)
 }
 
 // ReplaceSource.
@@ -48,7 +53,7 @@ func (b LogCtxEnricher) ReplaceSource(pkg string, filePath string) bool {
 	return b.Replace == "yes"
 }
 
-func injectZeroLogTracingCtx(call *ast.CallExpr) {
+func injectZeroLogTracingCtx(call *ast.CallExpr) bool {
 	var stack []*ast.CallExpr
 	stack = append(stack, call)
 	for {
@@ -65,7 +70,7 @@ func injectZeroLogTracingCtx(call *ast.CallExpr) {
 	}
 	if last, ok := stack[0].Fun.(*ast.SelectorExpr); ok {
 		if last.Sel.Name != "Msg" {
-			return
+			return false
 		}
 	}
 	selExpr := &ast.SelectorExpr{
@@ -163,9 +168,10 @@ func injectZeroLogTracingCtx(call *ast.CallExpr) {
 	}
 
 	stack[len(stack)-2].Fun.(*ast.SelectorExpr).X = parentSpanIdCallExpr
+	return true
 }
 
-func injectZapTracingCtx(call *ast.CallExpr) {
+func injectZapTracingCtx(call *ast.CallExpr) bool {
 	var stack []*ast.CallExpr
 	stack = append(stack, call)
 	for {
@@ -185,7 +191,7 @@ func injectZapTracingCtx(call *ast.CallExpr) {
 		if val.Sel.Name == "Error" {
 			if val, ok := val.X.(*ast.Ident); ok {
 				if val.Name == "zap" {
-					return
+					return false
 				}
 			}
 		}
@@ -193,7 +199,7 @@ func injectZapTracingCtx(call *ast.CallExpr) {
 	if last, ok := stack[0].Fun.(*ast.SelectorExpr); ok {
 		if last.Sel.Name != "Info" && last.Sel.Name != "Warn" &&
 			last.Sel.Name != "Error" {
-			return
+			return false
 		}
 	}
 	ctxcalls := []ast.Expr{
@@ -301,9 +307,10 @@ func injectZapTracingCtx(call *ast.CallExpr) {
 		},
 	}
 	call.Args = append(call.Args, ctxcalls...)
+	return true
 }
 
-func injectLogrusTracingCtx(call *ast.CallExpr, logrusPkg string) {
+func injectLogrusTracingCtx(call *ast.CallExpr, logrusPkg string) bool {
 	var stack []*ast.CallExpr
 	stack = append(stack, call)
 	for {
@@ -321,7 +328,7 @@ func injectLogrusTracingCtx(call *ast.CallExpr, logrusPkg string) {
 	if last, ok := stack[0].Fun.(*ast.SelectorExpr); ok {
 		if last.Sel.Name != "Info" && last.Sel.Name != "Warn" &&
 			last.Sel.Name != "Error" && last.Sel.Name != "Fatalf" && last.Sel.Name != "Fatal" {
-			return
+			return false
 		}
 	}
 
@@ -423,42 +430,179 @@ func injectLogrusTracingCtx(call *ast.CallExpr, logrusPkg string) {
 	}
 
 	stack[len(stack)-1].Fun.(*ast.SelectorExpr).X = traceIdCallExpr
+	return true
 }
 
-// Rewrite.
-func (b LogCtxEnricher) Rewrite(pkg string, file *ast.File, fset *token.FileSet, trace *os.File) {
-	logrusPkg := "logrus"
-
-	ast.Inspect(file, func(n ast.Node) bool {
-		switch node := n.(type) {
-		case *ast.ImportSpec:
-			if node.Name != nil && strings.Contains(node.Path.Value, "logrus") {
-				logrusPkg = node.Name.Name
+// importName returns name file refers to imported package by,
+// empty when the package is not imported.
+func importName(file *ast.File, importPath string) string {
+	for _, spec := range file.Imports {
+		if path, err := strconv.Unquote(spec.Path.Value); err != nil || path != importPath {
+			continue
+		}
+		if spec.Name != nil {
+			if spec.Name.Name == "_" || spec.Name.Name == "." {
+				continue
 			}
-		case *ast.CallExpr:
-			key := strings.TrimSpace(fset.Position(node.Pos()).String())
-			if b.Replace == "no" {
-				p := strings.Split(key, ":")
-				if len(p) == 3 {
-					key = "./" + filepath.Base(p[0]) + ":" + p[1] + ":" + p[2]
-				}
+			return spec.Name.Name
+		}
+		return importPath[strings.LastIndex(importPath, "/")+1:]
+	}
+	return ""
+}
+
+// contextParam returns name of context.Context parameter of function,
+// empty when there is none.
+func contextParam(fType *ast.FuncType, contextPkg string) string {
+	if contextPkg == "" {
+		return ""
+	}
+	for _, field := range fType.Params.List {
+		sel, ok := field.Type.(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "Context" {
+			continue
+		}
+		if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != contextPkg {
+			continue
+		}
+		for _, name := range field.Names {
+			if name.Name != "_" {
+				return name.Name
 			}
-			if val, ok := b.LogCalls[key]; ok {
-				if val == "zerolog" {
-					injectZeroLogTracingCtx(node)
-				}
-				if val == "zap" {
-					injectZapTracingCtx(node)
-					astutil.AddImport(fset, file, "go.uber.org/zap")
+		}
+	}
+	return ""
+}
 
-				}
-				if val == "logrus" {
-					injectLogrusTracingCtx(node, logrusPkg)
-				}
+// makeSpanContextStmts declares span context of enriched log calls
+// taken from ctx, for functions without span added by BasicRewriter.
+func makeSpanContextStmts(ctx string) []ast.Stmt {
+	used := func(name string) ast.Stmt {
+		return &ast.AssignStmt{
+			Lhs: []ast.Expr{&ast.Ident{Name: "_"}},
+			Tok: token.ASSIGN,
+			Rhs: []ast.Expr{&ast.Ident{Name: name}},
+		}
+	}
+	return []ast.Stmt{
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{&ast.Ident{Name: "__atel_spanCtx"}},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{&ast.CallExpr{
+				Fun: &ast.SelectorExpr{
+					X:   &ast.Ident{Name: "__atel_trace"},
+					Sel: &ast.Ident{Name: "SpanContextFromContext"},
+				},
+				Args: []ast.Expr{&ast.Ident{Name: ctx}},
+			}},
+		},
+		used("__atel_spanCtx"),
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{&ast.Ident{Name: "__atel_parent_span_id"}},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{&ast.BasicLit{Kind: token.STRING, Value: `""`}},
+		},
+		used("__atel_parent_span_id"),
+	}
+}
+
+// spansAdded tells whether BasicRewriter adds spans to functions of file.
+func (b LogCtxEnricher) spansAdded(pkg string, filePath string) bool {
+	return b.Spans != nil && (b.Spans(pkg, filePath) || b.Spans(pkg, b.RemappedFilePaths[filePath]))
+}
+
+// enrichCalls adds tracing context to log calls found by sema within node
+// and tells whether any was enriched.
+func (b LogCtxEnricher) enrichCalls(node ast.Node, file *ast.File, fset *token.FileSet, logrusPkg string) bool {
+	enriched := false
+	ast.Inspect(node, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok {
+			return true
+		}
+		key := strings.TrimSpace(fset.Position(call.Pos()).String())
+		if b.Replace == "no" {
+			p := strings.Split(key, ":")
+			if len(p) == 3 {
+				key = "./" + filepath.Base(p[0]) + ":" + p[1] + ":" + p[2]
 			}
 		}
+		switch b.LogCalls[key] {
+		case "zerolog":
+			enriched = injectZeroLogTracingCtx(call) || enriched
+		case "zap":
+			if injectZapTracingCtx(call) {
+				astutil.AddImport(fset, file, "go.uber.org/zap")
+				enriched = true
+			}
+		case "logrus":
+			enriched = injectLogrusTracingCtx(call, logrusPkg) || enriched
+		}
 		return true
 	})
+	return enriched
+}
+
+// Rewrite adds tracing context to log calls of functions. Functions
+// without span added by BasicRewriter take span context from their
+// context.Context parameter, those without one and functions with
+// malformed directives are left as they are.
+func (b LogCtxEnricher) Rewrite(pkg string, file *ast.File, fset *token.FileSet, trace *os.File) {
+	if lib.IgnoredFile(file) {
+		return
+	}
+	directives, _ := lib.ParseFileDirectives(file, fset)
+	b.rewrite(pkg, file, fset, directives)
+}
+
+// RewriteFile adds tracing context to log calls like Rewrite. Malformed
+// directive fails the file with scanner.ErrorList pointing to the
+// directive, file is left unchanged then.
+func (b LogCtxEnricher) RewriteFile(pkg string, file *ast.File, fset *token.FileSet, trace *os.File) error {
+	if lib.IgnoredFile(file) {
+		return nil
+	}
+	directives, err := lib.ParseFileDirectives(file, fset)
+	if err != nil {
+		return err
+	}
+	b.rewrite(pkg, file, fset, directives)
+	return nil
+}
+
+func (b LogCtxEnricher) rewrite(pkg string, file *ast.File, fset *token.FileSet, directives map[*ast.FuncDecl]lib.FuncDirectives) {
+	logrusPkg := "logrus"
+	for _, spec := range file.Imports {
+		if spec.Name != nil && strings.Contains(spec.Path.Value, "logrus") {
+			logrusPkg = spec.Name.Name
+		}
+	}
+	spans := b.spansAdded(pkg, fset.PositionFor(file.Package, false).Filename)
+	contextPkg := importName(file, "context")
+	for _, decl := range file.Decls {
+		funDeclNode, ok := decl.(*ast.FuncDecl)
+		if !ok || funDeclNode.Body == nil {
+			continue
+		}
+		// BasicRewriter adds no span context to ignored functions
+		if funcDirectives, ok := directives[funDeclNode]; !ok || funcDirectives.Ignore {
+			continue
+		}
+		if spans {
+			b.enrichCalls(funDeclNode.Body, file, fset, logrusPkg)
+			continue
+		}
+		ctx := contextParam(funDeclNode.Type, contextPkg)
+		if ctx == "" {
+			continue
+		}
+		// declarations added by previous runs are replaced
+		funDeclNode.Body.List = trimPrologue(funDeclNode.Body.List)
+		if b.enrichCalls(funDeclNode.Body, file, fset, logrusPkg) {
+			astutil.AddNamedImport(fset, file, "__atel_trace", "go.opentelemetry.io/otel/trace")
+			funDeclNode.Body.List = append(makeSpanContextStmts(ctx), funDeclNode.Body.List...)
+		}
+	}
 }
 
 // WriteExtraFiles.
@@ -21,6 +21,8 @@ import (
 	"strings"
 
 	"golang.org/x/tools/go/ast/astutil"
+
+	"go.opentelemetry.io/contrib/instrgen/lib"
 )
 
 func removeStmt(slice []ast.Stmt, s int) []ast.Stmt {
@@ -35,6 +37,57 @@ func removeExpr(slice []ast.Expr, s int) []ast.Expr {
 	return append(slice[:s], slice[s+1:]...)
 }
 
+// isInstrgenName tells whether expr is name declared by instrumentation.
+func isInstrgenName(expr ast.Expr) bool {
+	ident, ok := expr.(*ast.Ident)
+	return ok && strings.HasPrefix(ident.Name, "__atel_")
+}
+
+// isInstrgenStmt tells whether stmt is part of instrumentation added
+// by rewriters. Only statements declaring, using or calling __atel_ names
+// and rtlib.Shutdown of entry points match, so user code calling the same
+// functions is kept.
+func isInstrgenStmt(stmt ast.Stmt) bool {
+	switch bodyStmt := stmt.(type) {
+	case *ast.IfStmt:
+		if assigment, ok := bodyStmt.Init.(*ast.AssignStmt); ok {
+			return isInstrgenName(assigment.Lhs[0])
+		}
+	case *ast.AssignStmt:
+		if isInstrgenName(bodyStmt.Lhs[0]) {
+			return true
+		}
+		// _ = __atel_name keeps name used
+		if ident, ok := bodyStmt.Lhs[0].(*ast.Ident); ok && ident.Name == "_" && len(bodyStmt.Rhs) == 1 {
+			return isInstrgenName(bodyStmt.Rhs[0])
+		}
+	case *ast.ExprStmt:
+		if call, ok := bodyStmt.X.(*ast.CallExpr); ok {
+			if sel, ok := call.Fun.(*ast.SelectorExpr); ok {
+				return isInstrgenName(sel.X)
+			}
+		}
+	case *ast.DeferStmt:
+		if sel, ok := bodyStmt.Call.Fun.(*ast.SelectorExpr); ok {
+			if isInstrgenName(sel.X) {
+				return true
+			}
+			if ident, ok := sel.X.(*ast.Ident); ok && ident.Name == "rtlib" && sel.Sel.Name == "Shutdown" {
+				return len(bodyStmt.Call.Args) == 1 && isInstrgenName(bodyStmt.Call.Args[0])
+			}
+		}
+	}
+	return false
+}
+
+// trimPrologue returns stmts without instrumentation prologue they start with.
+func trimPrologue(stmts []ast.Stmt) []ast.Stmt {
+	for len(stmts) > 0 && isInstrgenStmt(stmts[0]) {
+		stmts = stmts[1:]
+	}
+	return stmts
+}
+
 func inspectFuncContent(fType *ast.FuncType, fBody *ast.BlockStmt, remove bool) bool {
 	instrgenCode := false
 	for index := 0; index < len(fType.Params.List); index++ {
@@ -50,81 +103,12 @@ func inspectFuncContent(fType *ast.FuncType, fBody *ast.BlockStmt, remove bool)
 		}
 	}
 	for index := 0; index < len(fBody.List); index++ {
-		stmt := fBody.List[index]
-		switch bodyStmt := stmt.(type) {
-		case *ast.IfStmt:
-			if assigment, ok := bodyStmt.Init.(*ast.AssignStmt); ok {
-				if ident, ok := assigment.Lhs[0].(*ast.Ident); ok {
-					if strings.Contains(ident.Name, "__atel_") {
-						if remove == true {
-							fBody.List = removeStmt(fBody.List, index)
-							index--
-						}
-						instrgenCode = true
-					}
-				}
-			}
-		case *ast.AssignStmt:
-			if ident, ok := bodyStmt.Lhs[0].(*ast.Ident); ok {
-				if strings.Contains(ident.Name, "__atel_") {
-					if remove == true {
-						fBody.List = removeStmt(fBody.List, index)
-						index--
-					}
-					instrgenCode = true
-				}
-			}
-			if ident, ok := bodyStmt.Rhs[0].(*ast.Ident); ok {
-				if strings.Contains(ident.Name, "__atel_") {
-					if remove == true {
-						fBody.List = removeStmt(fBody.List, index)
-						index--
-					}
-					instrgenCode = true
-				}
-			}
-		case *ast.ExprStmt:
-			if call, ok := bodyStmt.X.(*ast.CallExpr); ok {
-				if sel, ok := call.Fun.(*ast.SelectorExpr); ok {
-					if strings.Contains(sel.Sel.Name, "SetTracerProvider") {
-						if remove == true {
-							fBody.List = removeStmt(fBody.List, index)
-							index--
-						}
-						instrgenCode = true
-					}
-					if strings.Contains(sel.Sel.Name, "InstrgenSetTls") {
-						if remove == true {
-							fBody.List = removeStmt(fBody.List, index)
-							index--
-						}
-						instrgenCode = true
-					}
-				}
-			}
-		case *ast.DeferStmt:
-			if sel, ok := bodyStmt.Call.Fun.(*ast.SelectorExpr); ok {
-				if strings.Contains(sel.Sel.Name, "Shutdown") {
-					if ident, ok := sel.X.(*ast.Ident); ok {
-						if strings.Contains(ident.Name, "rtlib") {
-							if remove == true {
-								fBody.List = removeStmt(fBody.List, index)
-								index--
-							}
-							instrgenCode = true
-						}
-					}
-				}
-				if ident, ok := sel.X.(*ast.Ident); ok {
-					if strings.Contains(ident.Name, "__atel_") {
-						if remove == true {
-							fBody.List = removeStmt(fBody.List, index)
-							index--
-						}
-						instrgenCode = true
-					}
-				}
+		if isInstrgenStmt(fBody.List[index]) {
+			if remove == true {
+				fBody.List = removeStmt(fBody.List, index)
+				index--
 			}
+			instrgenCode = true
 		}
 	}
 	return instrgenCode
@@ -195,10 +179,10 @@ func inspect(file *ast.File, remove bool) bool {
 	return instrgenCode
 }
 
-// OtelPruner.
+// OtelPruner removes instrumentation from files selected by Filter.
 type OtelPruner struct {
-	FilePattern string
-	Replace     bool
+	Filter  lib.FileFilter
+	Replace bool
 }
 
 // Id.
@@ -208,7 +192,7 @@ func (OtelPruner) Id() string {
 
 // Inject.
 func (pruner OtelPruner) Inject(pkg string, filepath string) bool {
-	return strings.Contains(filepath, pruner.FilePattern)
+	return pruner.Filter(pkg, filepath)
 }
 
 // ReplaceSource.
@@ -218,6 +202,8 @@ func (pruner OtelPruner) ReplaceSource(pkg string, filePath string) bool {
 
 // Rewrite.
 func (OtelPruner) Rewrite(pkg string, file *ast.File, fset *token.FileSet, trace *os.File) {
+	// instrumentation of code ignored since it was added is removed
+	// too, directives are comments and stay as they are
 	inspect(file, true)
 	astutil.DeleteNamedImport(fset, file, "__atel_context", "context")
 	astutil.DeleteNamedImport(fset, file, "__atel_otel", "go.opentelemetry.io/otel")
@@ -24,7 +24,6 @@ import (
 
 // RuntimeRewriter.
 type RuntimeRewriter struct {
-	FilePattern string
 }
 
 // Id.
@@ -22,6 +22,7 @@ import (
 	"log"
 	"os"
 
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
@@ -46,8 +47,34 @@ const (
 	exporterProtocol      = "OTEL_EXPORTER_OTLP_PROTOCOL"
 	exporterHTTPProtocol  = "http/protobuf"
 	traceFile             = "traces.txt"
+	// traceFileVar overrides traceFile, instrgen sets it for binaries
+	// run by instrgen run and instrgen test.
+	traceFileVar = "INSTRGEN_TRACES_FILE"
 )
 
+// Build metadata set by instrgen when linking instrumented binaries.
+var (
+	instrgenVersion    string
+	instrgenConfigHash string
+	vcsRevision        string
+)
+
+// buildAttributes returns resource attributes telling which
+// instrumented build produced the spans.
+func buildAttributes() []attribute.KeyValue {
+	var attrs []attribute.KeyValue
+	if instrgenVersion != "" {
+		attrs = append(attrs, attribute.String("instrgen.version", instrgenVersion))
+	}
+	if instrgenConfigHash != "" {
+		attrs = append(attrs, attribute.String("instrgen.config.hash", instrgenConfigHash))
+	}
+	if vcsRevision != "" {
+		attrs = append(attrs, attribute.String("vcs.ref.head.revision", vcsRevision))
+	}
+	return attrs
+}
+
 // TracingState type.
 type TracingState struct {
 	Logger *log.Logger
@@ -55,22 +82,45 @@ type TracingState struct {
 	Tp     *trace.TracerProvider
 }
 
+// Option sets default of an environment variable read by NewTracingState.
+type Option struct {
+	key   string
+	value string
+}
+
+// WithDefault returns Option that makes NewTracingState use value
+// when environment variable key is not set.
+func WithDefault(key string, value string) Option {
+	return Option{key: key, value: value}
+}
+
 // NewTracingState.
-func NewTracingState() TracingState {
+func NewTracingState(opts ...Option) TracingState {
 	var tracingState TracingState
 	tracingState.Logger = log.New(os.Stdout, "", 0)
 
+	defaults := make(map[string]string)
+	for _, opt := range opts {
+		defaults[opt.key] = opt.value
+	}
+	getenv := func(key string) string {
+		if value := os.Getenv(key); value != "" {
+			return value
+		}
+		return defaults[key]
+	}
+
 	// Write telemetry data to a file.
 	var err error
-	serviceName := os.Getenv(serviceName)
+	serviceName := getenv(serviceName)
 	// fallback to instrgen
 	if serviceName == "" {
 		serviceName = defaultServiceName
 	}
-	exporterVar := os.Getenv(tracesExporter)
+	exporterVar := getenv(tracesExporter)
 	switch exporterVar {
 	case zipkinExporter:
-		exporterEndpoint := os.Getenv(zipkinEndpoint)
+		exporterEndpoint := getenv(zipkinEndpoint)
 		// fallback to localhost
 		if exporterEndpoint == "" {
 			exporterEndpoint = defaultZipkinEndpoint
@@ -86,7 +136,7 @@ func NewTracingState() TracingState {
 			trace.WithSpanProcessor(batcher),
 			trace.WithResource(resource.NewWithAttributes(
 				semconv.SchemaURL,
-				semconv.ServiceName(serviceName),
+				append(buildAttributes(), semconv.ServiceName(serviceName))...,
 			)),
 		)
 	case otlpExporter:
@@ -96,14 +146,15 @@ func NewTracingState() TracingState {
 				semconv.ServiceNameKey.String(serviceName),
 				semconv.TelemetrySDKLanguageGo,
 			),
+			resource.WithAttributes(buildAttributes()...),
 		)
 		if err != nil {
 			tracingState.Logger.Fatal(err)
 		}
 
 		var client otlptrace.Client
-		protocol := os.Getenv(exporterProtocol)
-		exporterEndpoint := os.Getenv(otlpExporterEndpoint)
+		protocol := getenv(exporterProtocol)
+		exporterEndpoint := getenv(otlpExporterEndpoint)
 
 		if protocol == exporterHTTPProtocol {
 			if exporterEndpoint == "" {
@@ -141,7 +192,11 @@ func NewTracingState() TracingState {
 		)
 	default:
 		// fallback to file exporting
-		tracingState.File, err = os.Create(traceFile)
+		fileName := getenv(traceFileVar)
+		if fileName == "" {
+			fileName = traceFile
+		}
+		tracingState.File, err = os.Create(fileName)
 
 		if err != nil {
 			tracingState.Logger.Fatal(err)
@@ -175,6 +230,7 @@ func NewResource() *resource.Resource {
 		resource.Default(),
 		resource.NewWithAttributes(
 			semconv.SchemaURL,
+			buildAttributes()...,
 		),
 	)
 	return r